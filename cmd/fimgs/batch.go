@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	fimgs "github.com/rprtr258/fimgs/pkg"
+)
+
+const defaultBatchTemplate = "{dir}/{name}.{filter}.{ext}"
+
+// batchJob is input image and filename of its result
+type batchJob struct {
+	input  string
+	output string
+}
+
+// batchResult is outcome of one job, err is nil for processed and skipped images
+type batchResult struct {
+	batchJob
+	skipped  bool
+	duration time.Duration
+	err      error
+}
+
+// collectInputs expands globs and directories to image filenames. Directories are walked if recursive is set,
+// only files with image extensions are taken from them, files given explicitly are taken as is.
+func collectInputs(args []string, recursive bool) ([]string, error) {
+	inputs := []string{}
+	seen := map[string]bool{}
+	add := func(filename string) {
+		if !seen[filename] {
+			seen[filename] = true
+			inputs = append(inputs, filename)
+		}
+	}
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, usageError(fmt.Errorf("invalid pattern %q: %w", arg, err))
+		}
+		if len(matches) == 0 {
+			return nil, ioError(fmt.Errorf("no files match %q", arg))
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, ioError(err)
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				switch {
+				case err != nil:
+					return err
+				case d.IsDir() && path != match && !recursive:
+					return filepath.SkipDir
+				case !d.IsDir() && fimgs.IsImageFilename(path):
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, ioError(err)
+			}
+		}
+	}
+	return inputs, nil
+}
+
+// renderTemplate makes result filename of input by replacing {dir}, {name}, {filter} and {ext} in template
+func renderTemplate(template, input, filter, ext string) string {
+	base := filepath.Base(input)
+	return strings.NewReplacer(
+		"{dir}", filepath.Dir(input),
+		"{name}", strings.TrimSuffix(base, filepath.Ext(base)),
+		"{filter}", filter,
+		"{ext}", ext,
+	).Replace(template)
+}
+
+// batchFormat returns format of results, given by format flag or by extension of template, png by default
+func batchFormat(template string, format fimgs.ImageFormat) (fimgs.ImageFormat, error) {
+	if format != "" {
+		return format, nil
+	}
+	ext := filepath.Ext(template)
+	if ext == "" || strings.Contains(ext, "{") {
+		return fimgs.FormatPNG, nil
+	}
+	format, ok := fimgs.FormatFromFilename(template)
+	if !ok {
+		return "", usageError(fmt.Errorf("unknown format of template %q, set it by extension or format flag, one of: %s", template, strings.Join(fimgs.ImageFormats, ", ")))
+	}
+	return format, nil
+}
+
+// makeBatchJobs pairs inputs with their results. Inputs which are results of other inputs are left out,
+// so results of previous runs are not processed again.
+func makeBatchJobs(inputs []string, template, filter string, format fimgs.ImageFormat) ([]batchJob, error) {
+	jobs := make([]batchJob, 0, len(inputs))
+	outputs := map[string]string{}
+	for _, input := range inputs {
+		output := filepath.Clean(renderTemplate(template, input, filter, format))
+		if other, ok := outputs[output]; ok {
+			return nil, usageError(fmt.Errorf("%q and %q have same result %q, use {name} and {dir} in template", other, input, output))
+		}
+		outputs[output] = input
+		jobs = append(jobs, batchJob{input, output})
+	}
+	res := jobs[:0]
+	for _, job := range jobs {
+		if _, ok := outputs[filepath.Clean(job.input)]; !ok {
+			res = append(res, job)
+		}
+	}
+	return res, nil
+}
+
+// isUpToDate reports whether result exists and is not older than input
+func isUpToDate(job batchJob) bool {
+	output, err := os.Stat(job.output)
+	if err != nil {
+		return false
+	}
+	input, err := os.Stat(job.input)
+	return err == nil && !output.ModTime().Before(input.ModTime())
+}
+
+func runBatchJob(job batchJob, pipeline fimgs.Pipeline, opts fimgs.SaveOptions, force bool) batchResult {
+	if !force && isUpToDate(job) {
+		return batchResult{batchJob: job, skipped: true}
+	}
+	start := time.Now()
+	err := func() error {
+		im, err := fimgs.LoadImageFile(job.input)
+		if err != nil {
+			return err
+		}
+		res, err := pipeline.Apply(im)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(job.output), 0o755); err != nil {
+			return err
+		}
+		return fimgs.SaveImageFileOptions(res, job.output, opts)
+	}()
+	return batchResult{batchJob: job, duration: time.Since(start), err: err}
+}
+
+// runBatch processes jobs by given number of workers, results are in order of jobs
+func runBatch(jobs []batchJob, workers int, pipeline fimgs.Pipeline, opts fimgs.SaveOptions, force bool) []batchResult {
+	results := make([]batchResult, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = runBatchJob(jobs[i], pipeline, opts, force)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// printBatchSummary prints table of results and totals, returns number of failed images
+func printBatchSummary(out io.Writer, results []batchResult, elapsed time.Duration) int {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tINPUT\tOUTPUT\tTIME\tERROR")
+	var processed, skipped, failed int
+	var total time.Duration
+	for _, res := range results {
+		status, errText := "ok", ""
+		switch {
+		case res.err != nil:
+			status, errText = "failed", res.err.Error()
+			failed++
+		case res.skipped:
+			status = "skipped"
+			skipped++
+		default:
+			processed++
+		}
+		total += res.duration
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", status, res.input, res.output, res.duration.Round(time.Millisecond), errText)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d processed, %d skipped, %d failed, %s of work in %s\n",
+		processed, skipped, failed, total.Round(time.Millisecond), elapsed.Round(time.Millisecond))
+	return failed
+}
+
+func batchCommand(saveOptions *fimgs.SaveOptions, force *bool) *cli.Command {
+	var filter, template string
+	var recursive bool
+	var workers int
+	return &cli.Command{
+		Name:      "batch",
+		Usage:     "Apply filter or pipeline to many images",
+		ArgsUsage: "FILES, GLOBS OR DIRECTORIES...",
+		UsageText: `Apply filter or pipeline to every image given by filename, glob or directory using several workers.
+Results already newer than their inputs are skipped, unless --force is given.
+Template placeholders are {dir} and {name} of input, {filter} names of applied filters and {ext} of result format.
+Example:
+	fimgs batch -f 'median -w 5' photos
+	fimgs --format jpeg batch -r -j 8 -f 'median -w 5 | cluster -n 6' -t 'out/{name}.{ext}' 'photos/*.png' scans`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "filter",
+				Aliases:     []string{"f"},
+				Usage:       "filter or pipeline to apply, e.g. 'median -w 5 | cluster -n 6'",
+				Destination: &filter,
+			},
+			&cli.StringFlag{
+				Name:        "template",
+				Aliases:     []string{"t"},
+				Usage:       "result filename template",
+				Value:       defaultBatchTemplate,
+				Destination: &template,
+			},
+			&cli.BoolFlag{
+				Name:        "recursive",
+				Aliases:     []string{"r"},
+				Usage:       "take images from subdirectories of given directories",
+				Destination: &recursive,
+			},
+			&cli.IntFlag{
+				Name:        "jobs",
+				Aliases:     []string{"j"},
+				Usage:       "number of images processed in parallel",
+				Value:       runtime.NumCPU(),
+				Destination: &workers,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if filter == "" {
+				return usageError(fmt.Errorf(`required flag "filter" not set`))
+			}
+			if c.NArg() == 0 {
+				return usageError(fmt.Errorf("no input images given"))
+			}
+			if workers < 1 {
+				return usageError(fmt.Errorf("jobs must be positive, you gave %d", workers))
+			}
+			pipeline, err := fimgs.ParsePipeline(filter, readTextFile)
+			if err != nil {
+				return usageError(err)
+			}
+			opts := *saveOptions
+			opts.Format, err = batchFormat(template, opts.Format)
+			if err != nil {
+				return err
+			}
+			if err := opts.Validate(); err != nil {
+				return usageError(err)
+			}
+			inputs, err := collectInputs(c.Args().Slice(), recursive)
+			if err != nil {
+				return err
+			}
+			names := make([]string, len(pipeline))
+			for i, step := range pipeline {
+				names[i] = step.Filter.Name()
+			}
+			jobs, err := makeBatchJobs(inputs, template, strings.Join(names, "+"), opts.Format)
+			if err != nil {
+				return err
+			}
+
+			start := time.Now()
+			results := runBatch(jobs, workers, pipeline, opts, *force)
+			if failed := printBatchSummary(c.App.Writer, results, time.Since(start)); failed > 0 {
+				return exitError{exitFailure, fmt.Errorf("%d of %d images failed", failed, len(results))}
+			}
+			return nil
+		},
+	}
+}
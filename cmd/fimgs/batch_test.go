@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	for _, test := range []struct {
+		template, input, want string
+	}{
+		{defaultBatchTemplate, "photos/cat.jpg", "photos/cat.median+cluster.png"},
+		{"out/{name}.{ext}", "photos/2023/dog.tar.png", "out/dog.tar.png"},
+		{"{dir}/{filter}/{name}.{ext}", "cat", "./median+cluster/cat.png"},
+		{"{name}-{name}.jpeg", "a/b.png", "b-b.jpeg"},
+	} {
+		if got := renderTemplate(test.template, test.input, "median+cluster", "png"); got != test.want {
+			t.Errorf("%q for %q: got %q, want %q", test.template, test.input, got, test.want)
+		}
+	}
+}
+
+func TestMakeBatchJobs(t *testing.T) {
+	// b.blur.png is result of b.png from previous run, so it is not processed again
+	jobs, err := makeBatchJobs([]string{"a.png", "b.png", "b.blur.png"}, defaultBatchTemplate, "blur", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []batchJob{{"a.png", "a.blur.png"}, {"b.png", "b.blur.png"}}
+	if len(jobs) != len(want) || jobs[0] != want[0] || jobs[1] != want[1] {
+		t.Fatalf("got %v, want %v", jobs, want)
+	}
+
+	if _, err := makeBatchJobs([]string{"x/a.png", "y/a.png"}, "out/{name}.{ext}", "blur", "png"); err == nil {
+		t.Fatal("expected error for inputs with same result")
+	}
+}
+
+func TestIsUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	job := batchJob{filepath.Join(dir, "in.png"), filepath.Join(dir, "out.png")}
+	if err := os.WriteFile(job.input, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if isUpToDate(job) {
+		t.Fatal("missing result is up to date")
+	}
+	if err := os.WriteFile(job.output, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, test := range []struct {
+		input, output time.Time
+		want          bool
+	}{
+		{now.Add(-time.Hour), now, true},
+		{now, now, true},
+		{now, now.Add(-time.Hour), false},
+	} {
+		if err := os.Chtimes(job.input, test.input, test.input); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(job.output, test.output, test.output); err != nil {
+			t.Fatal(err)
+		}
+		if got := isUpToDate(job); got != test.want {
+			t.Errorf("input modified at %v, result at %v: got %t, want %t", test.input, test.output, got, test.want)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.png", "b.png"} {
+		writeTestImage(t, filepath.Join(dir, name))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, code := runApp(t, nil, "batch", "-f", "blur | median", "-j", "2", dir)
+	if code != 0 {
+		t.Fatalf("exit code %d, output:\n%s", code, stdout)
+	}
+	for _, name := range []string{"a.blur+median.png", "b.blur+median.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// results are up to date and are not taken as inputs
+	stdout, code = runApp(t, nil, "batch", "-f", "blur | median", dir)
+	if code != 0 || !strings.Contains(string(stdout), "0 processed, 2 skipped, 0 failed") {
+		t.Fatalf("exit code %d, output:\n%s", code, stdout)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -13,203 +18,451 @@ import (
 	fimgs "github.com/rprtr258/fimgs/pkg"
 )
 
-func makeResultFilename(filename string) string {
+// stdio is "-" filename meaning stdin for input and stdout for output
+const stdio = "-"
+
+// exit codes tell apart why fimgs failed
+const (
+	exitFailure = 1 // filter failed
+	exitUsage   = 2 // bad flags or params
+	exitIO      = 3 // input could not be read or result could not be written
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string { return e.err.Error() }
+func (e exitError) Unwrap() error { return e.err }
+
+func usageError(err error) error { return exitError{exitUsage, err} }
+func ioError(err error) error    { return exitError{exitIO, err} }
+
+// exitCode returns exit code of error, errors which are not wrapped are failures
+func exitCode(err error) int {
+	var exitErr exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitFailure
+}
+
+// applyError returns error of applying filter with exit code, errors caused by params are usage errors
+func applyError(err error) error {
+	var paramErr fimgs.ParamError
+	if errors.As(err, &paramErr) {
+		return usageError(err)
+	}
+	return exitError{exitFailure, err}
+}
+
+// onUsageError makes errors of parsing command line flags usage errors
+func onUsageError(_ *cli.Context, err error, _ bool) error {
+	return usageError(err)
+}
+
+// checkRequired fails if flags of required params are not set, cli doesn't check them, so that
+// missing flags are usage errors like all other flag errors
+func checkRequired(c *cli.Context, f fimgs.Filter) error {
+	for _, param := range f.Params() {
+		if param.Default == nil && !c.IsSet(param.Name) {
+			return usageError(fmt.Errorf("required flag %q not set", param.Name))
+		}
+	}
+	return nil
+}
+
+// checkOverwrite fails if file exists and overwriting is not forced
+func checkOverwrite(filename string, force bool) error {
+	if filename == "" || filename == stdio || force {
+		return nil
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return ioError(fmt.Errorf("%q already exists, use --force to overwrite it", filename))
+	}
+	return nil
+}
+
+func makeResultFilename(filename string, format fimgs.ImageFormat) string {
 	nowString := time.Now().Format(time.RFC3339Nano)
-	return fmt.Sprintf("%s.fimgs.%s.png", filename, nowString)
+	return fmt.Sprintf("%s.fimgs.%s.%s", filename, nowString, format)
 }
 
-func main() {
+func paramFlag(param fimgs.Param) cli.Flag {
+	var aliases []string
+	if param.Alias != "" {
+		aliases = []string{param.Alias}
+	}
+	required := param.Default == nil
+	usage := param.Usage
+	if len(param.Choices) > 0 {
+		usage = fmt.Sprintf("%s, one of: %s", usage, strings.Join(param.Choices, ", "))
+	}
+	switch {
+	case param.Repeated:
+		return &cli.StringSliceFlag{Name: param.Name, Aliases: aliases, Usage: usage}
+	case param.Type == fimgs.ParamInt:
+		flag := &cli.IntFlag{Name: param.Name, Aliases: aliases, Usage: usage}
+		if !required {
+			flag.Value = param.Default.(int)
+		}
+		return flag
+	case param.Type == fimgs.ParamFloat:
+		flag := &cli.Float64Flag{Name: param.Name, Aliases: aliases, Usage: usage}
+		if !required {
+			flag.Value = param.Default.(float64)
+		}
+		return flag
+	default:
+		flag := &cli.StringFlag{
+			Name:      param.Name,
+			Aliases:   aliases,
+			Usage:     usage,
+			TakesFile: param.Type == fimgs.ParamText || param.Type == fimgs.ParamFile,
+		}
+		if !required {
+			flag.Value = param.Default.(string)
+		}
+		return flag
+	}
+}
+
+func readTextFile(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// readParams collects params set in command line, text and file params are read from files by readText
+func readParams(c *cli.Context, f fimgs.Filter, readText func(string) (string, error)) (fimgs.Params, error) {
+	raw := map[string]string{}
+	for _, param := range f.Params() {
+		if !c.IsSet(param.Name) {
+			continue
+		}
+		value := fmt.Sprint(c.Value(param.Name))
+		if param.Repeated {
+			value = strings.Join(c.StringSlice(param.Name), "\n")
+		}
+		if param.Type == fimgs.ParamText || param.Type == fimgs.ParamFile {
+			text, err := readText(value)
+			if err != nil {
+				return nil, ioError(fmt.Errorf("error loading %q param from file: %w", param.Name, err))
+			}
+			value = text
+		}
+		raw[param.Name] = value
+	}
+	params, err := fimgs.ParseParams(f, func(name string) (string, bool) {
+		value, ok := raw[name]
+		return value, ok
+	})
+	if err != nil {
+		return nil, usageError(err)
+	}
+	return params, nil
+}
+
+// newApp makes CLI app reading input image from stdin and writing result to stdout if they are given as "-"
+func newApp(stdin io.Reader, stdout, stderr io.Writer) *cli.App {
 	var sourceImageFilename string
 	var resultImageFilename string
+	var paletteFilename string
+	var saveOptions fimgs.SaveOptions
+	var force bool
+	var watchMode bool
 
-	var nClusters int
-	clusterCmd := &cli.Command{
-		Name:  "cluster",
-		Usage: "Cluster colors",
-		UsageText: `Cluster colors using KMeans algorithm.
-Example:
-	fimgs cluster -i girl.png -n 4`,
-		Flags: []cli.Flag{&cli.IntFlag{
-			Name:        "nclusters",
-			Usage:       "number of clusters, must be greater than 1",
-			Aliases:     []string{"n"},
-			Required:    true,
-			Destination: &nClusters,
-		}},
-		Action: func(*cli.Context) error {
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.ApplyKMeansFilter(sourceImageFilename, resultImageFilename, nClusters)
-		},
+	// watched are input image and files read by last run of command, in watch mode command runs again when they change
+	var watched []string
+	readText := func(filename string) (string, error) {
+		watched = append(watched, filename)
+		return readTextFile(filename)
+	}
+	// runCommand runs command once or, in watch mode, every time files read by it change
+	runCommand := func(run func() error) error {
+		if !watchMode {
+			return run()
+		}
+		return watchFiles(stderr, func() ([]string, error) {
+			watched = []string{sourceImageFilename}
+			err := run()
+			return watched, err
+		})
 	}
 
-	var threshold int
-	var power float64
-	quadTreeCmd := &cli.Command{
-		Name:  "quadtree",
-		Usage: "Quad tree filter",
-		UsageText: `Apply quad tree like filter.
+	loadImage := func() (image.Image, error) {
+		var im image.Image
+		var err error
+		if sourceImageFilename == stdio {
+			im, err = fimgs.DecodeImage(stdin)
+		} else {
+			im, err = fimgs.LoadImageFile(sourceImageFilename)
+		}
+		if err != nil {
+			return nil, ioError(fmt.Errorf("error occured during loading image:\n%q", err))
+		}
+		return im, nil
+	}
+	// saveResult saves filtered image and its palette if palette file is given, prints its metadata
+	saveResult := func(res image.Image) error {
+		palette, ok := fimgs.ImagePalette(res)
+		if paletteFilename != "" && !ok {
+			return usageError(fmt.Errorf("result has no palette, only filters like cluster produce it"))
+		}
+		if resultImageFilename == stdio {
+			buffered := bufio.NewWriter(stdout)
+			if err := fimgs.EncodeImage(buffered, res, saveOptions); err != nil {
+				return ioError(err)
+			}
+			if err := buffered.Flush(); err != nil {
+				return ioError(err)
+			}
+		} else {
+			if err := fimgs.SaveImageFileOptions(res, resultImageFilename, saveOptions); err != nil {
+				return ioError(err)
+			}
+			fmt.Fprintln(stdout, resultImageFilename)
+		}
+		// metadata goes to stderr, so stdout has result only
+		_, metadata := fimgs.SplitMetadata(res)
+		for _, key := range metadata.Keys() {
+			fmt.Fprintf(stderr, "%s: %s\n", key, metadata[key])
+		}
+		if paletteFilename == "" {
+			return nil
+		}
+		if err := fimgs.SavePaletteFile(palette, paletteFilename); err != nil {
+			return ioError(err)
+		}
+		return nil
+	}
+
+	filterCmds := []*cli.Command{}
+	for _, f := range fimgs.Filters() {
+		f := f
+		flags := make([]cli.Flag, 0, len(f.Params()))
+		for _, param := range f.Params() {
+			flags = append(flags, paramFlag(param))
+		}
+		filterCmds = append(filterCmds, &cli.Command{
+			Name:  f.Name(),
+			Usage: fmt.Sprintf("%s filter", f.Title()),
+			UsageText: fmt.Sprintf(`%s
 Example:
-	fimgs -i girl.png quadtree`,
-		Flags: []cli.Flag{
-			&cli.IntFlag{
-				Name:        "threshold",
-				Aliases:     []string{"t"},
-				Usage:       "must be from 0 to 65536 exclusive",
-				Value:       32000,
-				Destination: &threshold,
-			},
-			&cli.Float64Flag{
-				Name:        "power",
-				Aliases:     []string{"p"},
-				Usage:       "must be greater than 0.0",
-				Value:       2.0,
-				Destination: &power,
+	fimgs -i girl.png %s`, f.Description(), f.Name()),
+			Flags: flags,
+			Action: func(c *cli.Context) error {
+				if err := checkRequired(c, f); err != nil {
+					return err
+				}
+				return runCommand(func() error {
+					params, err := readParams(c, f, readText)
+					if err != nil {
+						return err
+					}
+					im, err := loadImage()
+					if err != nil {
+						return err
+					}
+					res, err := f.Apply(im, params)
+					if err != nil {
+						return applyError(err)
+					}
+					return saveResult(res)
+				})
 			},
-		},
-		Action: func(*cli.Context) error {
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.QudTreeFilter(sourceImageFilename, resultImageFilename, power, threshold)
-		},
+		})
 	}
 
-	var fragmentShaderFilename string
-	shaderCmd := &cli.Command{
-		Name:  "shader",
-		Usage: "Shader filter",
-		UsageText: `Apply GLSL filter to image.
+	var pipelineFilename string
+	pipelineCmd := &cli.Command{
+		Name:  "pipeline",
+		Usage: "Apply several filters one after another",
+		UsageText: `Apply filters separated by "|" keeping image in memory between steps, only final result is saved.
+Pipeline is given as argument or loaded from file, "#" starts comment in it.
 Example:
-	fimgs shader -s shader_examples/rgb_coloring.glsl -i girl.png`,
+	fimgs -i girl.png pipeline 'median -w 5 | cluster -n 6 | edgedetect2'
+	fimgs -i girl.png pipeline -f looks/poster.fimgs`,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:        "shader",
-				Aliases:     []string{"s"},
-				Usage:       "shader file, must be valid fragment shader source, see shader_examples directory for examples",
-				Required:    true,
+				Name:        "file",
+				Aliases:     []string{"f"},
+				Usage:       "file with pipeline",
 				TakesFile:   true,
-				Destination: &fragmentShaderFilename,
+				Destination: &pipelineFilename,
 			},
 		},
-		Action: func(*cli.Context) error {
-			fragmentShaderFile, err := os.Open(fragmentShaderFilename)
-			if err != nil {
-				return fmt.Errorf("error opening fragment shader source file: %w", err)
-			}
-			fragmentShaderSourceData, err := io.ReadAll(fragmentShaderFile)
-			if err != nil {
-				return fmt.Errorf("error loading fragment shader source: %w", err)
+		Action: func(c *cli.Context) error {
+			source := strings.Join(c.Args().Slice(), " ")
+			if pipelineFilename != "" && source != "" {
+				return usageError(fmt.Errorf("pipeline must be given either as argument or as file, not both"))
 			}
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.ShaderFilter(sourceImageFilename, resultImageFilename, string(fragmentShaderSourceData))
-		},
-	}
-
-	hilbertCmd := &cli.Command{
-		Name:      "hilbert",
-		Usage:     "Hilbert curve filter",
-		UsageText: `Draws hilbert curve only through points on dark areas.`,
-		Action: func(*cli.Context) error {
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.HilbertCurve(sourceImageFilename, resultImageFilename)
+			return runCommand(func() error {
+				source := source
+				if pipelineFilename != "" {
+					text, err := readText(pipelineFilename)
+					if err != nil {
+						return ioError(fmt.Errorf("error loading pipeline file: %w", err))
+					}
+					source = text
+				}
+				pipeline, err := fimgs.ParsePipeline(source, readText)
+				if err != nil {
+					return usageError(err)
+				}
+				im, err := loadImage()
+				if err != nil {
+					return err
+				}
+				res, err := pipeline.Apply(im)
+				if err != nil {
+					return applyError(err)
+				}
+				return saveResult(res)
+			})
 		},
 	}
 
-	hilbertDarkenCmd := &cli.Command{
-		Name:      "hilbertdarken",
-		Usage:     "Hilbert darken curve filter",
-		UsageText: `Darken(image, hilbert filter).`,
-		Action: func(*cli.Context) error {
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.HilbertDarken(sourceImageFilename, resultImageFilename)
-		},
-	}
+	batchCmd := batchCommand(&saveOptions, &force)
 
-	zcurveCmd := &cli.Command{
-		Name:      "zcurve",
-		Usage:     "Z curve filter",
-		UsageText: `Draws Z curve only through points on dark areas.`,
-		Action: func(*cli.Context) error {
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.ZCurve(sourceImageFilename, resultImageFilename)
-		},
-	}
-
-	var windowSize int
-	medianCmd := &cli.Command{
-		Name:      "median",
-		Usage:     "Median filter",
-		UsageText: `Replace each pixel's color with median color of neighbourhood.`,
-		Flags: []cli.Flag{&cli.IntFlag{
-			Name:        "window",
-			Aliases:     []string{"w"},
-			Usage:       "window size, must be odd and positive",
-			Value:       5,
-			Destination: &windowSize,
-		}},
-		Action: func(*cli.Context) error {
-			resultImageFilename = makeResultFilename(sourceImageFilename)
-			return fimgs.MedianFilter(sourceImageFilename, resultImageFilename, windowSize)
-		},
-	}
-
-	convolutionCmds := []*cli.Command{}
-	// TODO: allow to specify custom kernel
-	for filterName, kernel := range map[string][][]int{
-		"blur":            fimgs.BLUR_KERNEL,
-		"weakblur":        fimgs.WEAK_BLUR_KERNEL,
-		"emboss":          fimgs.EMBOSS_KERNEL,
-		"sharpen":         fimgs.SHARPEN_KERNEL,
-		"edgeenhance":     fimgs.EDGE_ENHANCE_KERNEL,
-		"edgedetect1":     fimgs.EDGE_DETECT1_KERNEL,
-		"edgedetect2":     fimgs.EDGE_DETECT2_KERNEL,
-		"horizontallines": fimgs.HORIZONTAL_LINES_KERNEL,
-		"verticallines":   fimgs.VERTICAL_LINES_KERNEL,
-	} {
-		filterName := filterName
-		kernel := kernel
-		convolutionCmds = append(convolutionCmds, &cli.Command{
-			Name:  filterName,
-			Usage: fmt.Sprintf("%s filter", strings.Title(filterName)),
-			UsageText: fmt.Sprintf(`Apply %[1]s convolution filter.
-Example:
-	fimgs %[1]s -i girl.png`, filterName),
-			Action: func(*cli.Context) error {
-				resultImageFilename = makeResultFilename(sourceImageFilename)
-				return fimgs.ApplyConvolutionFilter(sourceImageFilename, resultImageFilename, kernel)
-			},
-		})
-	}
-
-	app := cli.App{
+	app := &cli.App{
 		Name:      "fimgs",
 		Usage:     "Applies filter to image",
 		UsageText: "Applies filter to image and saves new image",
+		// values of repeated params like shader uniforms contain commas
+		DisableSliceFlagSeparator: true,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "image",
 				Aliases:     []string{"i"},
 				Destination: &sourceImageFilename,
-				Required:    true,
 				TakesFile:   true,
-				Usage:       "input image filename",
-				// TODO: validate available extensions ("image", "png", "jpeg", "jpg")
+				Usage:       fmt.Sprintf("input image filename or - for stdin, format is detected by content, one of: %s", strings.Join(fimgs.InputFormats, ", ")),
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Destination: &resultImageFilename,
+				TakesFile:   true,
+				Usage:       "result image filename or - for stdout, its extension sets format, by default it is made from input filename and time, stdin input goes to stdout",
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Destination: &force,
+				Usage:       "overwrite existing output and palette files, in batch process images with up to date results too",
+			},
+			&cli.BoolFlag{
+				Name:        "watch",
+				Destination: &watchMode,
+				Usage:       "run filter again every time input image or files of params, like shader, change, result is overwritten",
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Destination: &saveOptions.Format,
+				Usage:       fmt.Sprintf("result image format, overrides output extension, one of: %s", strings.Join(fimgs.ImageFormats, ", ")),
+			},
+			&cli.StringFlag{
+				Name:        "palette",
+				Aliases:     []string{"p"},
+				Destination: &paletteFilename,
+				TakesFile:   true,
+				Usage:       fmt.Sprintf("save palette of result, e.g. found by cluster filter, to file, one of formats: %s", strings.Join(fimgs.PaletteFormats, ", ")),
+			},
+			&cli.IntFlag{
+				Name:        "depth",
+				Destination: &saveOptions.Depth,
+				Value:       8,
+				Usage:       "bits per channel of png and tiff result, 8 or 16, 16-bit paletted results are saved without palette",
+			},
+			&cli.IntFlag{
+				Name:        "quality",
+				Destination: &saveOptions.Quality,
+				Value:       jpeg.DefaultQuality,
+				Usage:       "quality of jpeg result, from 1 to 100",
+			},
+			&cli.IntFlag{
+				Name:        "colors",
+				Destination: &saveOptions.Colors,
+				Value:       256,
+				Usage:       "palette size of gif result, from 2 to 256",
+			},
+			&cli.StringFlag{
+				Name:        "compression",
+				Destination: &saveOptions.Compression,
+				Value:       fimgs.CompressionDefault,
+				Usage:       fmt.Sprintf("compression of png result, one of: %s", strings.Join(fimgs.PNGCompressions, ", ")),
 			},
 		},
-		Commands: append(
-			convolutionCmds,
-			clusterCmd,
-			quadTreeCmd,
-			shaderCmd,
-			hilbertCmd,
-			hilbertDarkenCmd,
-			zcurveCmd,
-			medianCmd,
-		),
-		After: func(*cli.Context) error {
-			fmt.Println(resultImageFilename)
-			return nil
+		Before: func(c *cli.Context) error {
+			switch cmd := c.App.Command(c.Args().First()); {
+			case cmd == nil && c.Args().Present():
+				return usageError(fmt.Errorf("unknown command %q", c.Args().First()))
+			case cmd == nil || cmd.Name == "help" || slices.Contains(c.Args().Slice(), "--help") || slices.Contains(c.Args().Slice(), "-h"):
+				return nil
+			case cmd == batchCmd:
+				if watchMode {
+					return usageError(fmt.Errorf("batch can't be run in watch mode"))
+				}
+				if sourceImageFilename != "" || resultImageFilename != "" || paletteFilename != "" {
+					return usageError(fmt.Errorf("batch takes images as arguments and results filenames as template, image, output and palette flags are not used"))
+				}
+				return nil
+			case sourceImageFilename == "":
+				return usageError(fmt.Errorf(`required flag "image" not set`))
+			}
+			if paletteFilename == stdio {
+				return usageError(fmt.Errorf("palette can't be written to stdout"))
+			}
+			if ext := strings.ToLower(filepath.Ext(paletteFilename)); paletteFilename != "" && !slices.Contains(fimgs.PaletteFormats, ext) {
+				return usageError(fmt.Errorf("unknown palette format %q, must be one of %s", ext, strings.Join(fimgs.PaletteFormats, ", ")))
+			}
+			if watchMode && (sourceImageFilename == stdio || resultImageFilename == stdio) {
+				return usageError(fmt.Errorf("watch mode needs input and output files, not stdin or stdout"))
+			}
+			if resultImageFilename == "" && sourceImageFilename == stdio {
+				resultImageFilename = stdio
+			}
+			if saveOptions.Format == "" {
+				saveOptions.Format = fimgs.FormatPNG
+				if resultImageFilename != "" && resultImageFilename != stdio {
+					format, ok := fimgs.FormatFromFilename(resultImageFilename)
+					if !ok {
+						return usageError(fmt.Errorf("unknown format of output %q, set it by extension or format flag, one of: %s", resultImageFilename, strings.Join(fimgs.ImageFormats, ", ")))
+					}
+					saveOptions.Format = format
+				}
+			}
+			if err := saveOptions.Validate(); err != nil {
+				return usageError(err)
+			}
+			if resultImageFilename == "" {
+				resultImageFilename = makeResultFilename(sourceImageFilename, saveOptions.Format)
+			}
+			if err := checkOverwrite(resultImageFilename, force); err != nil {
+				return err
+			}
+			return checkOverwrite(paletteFilename, force)
 		},
+		Commands:     append(filterCmds, pipelineCmd, batchCmd),
+		OnUsageError: onUsageError,
+		// errors are printed and exit codes are set by main
+		ExitErrHandler: func(*cli.Context, error) {},
+		Reader:         stdin,
+		Writer:         stdout,
+		ErrWriter:      stderr,
+	}
+	for _, cmd := range app.Commands {
+		cmd.OnUsageError = onUsageError
 	}
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err.Error())
+	return app
+}
+
+func main() {
+	if err := newApp(os.Stdin, os.Stdout, os.Stderr).Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "fimgs: %s\n", err)
+		os.Exit(exitCode(err))
 	}
 }
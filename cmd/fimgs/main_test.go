@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fimgs "github.com/rprtr258/fimgs/pkg"
+)
+
+// runApp runs fimgs with args and stdin, returns its stdout and exit code
+func runApp(t *testing.T, stdin []byte, args ...string) ([]byte, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	if err := newApp(bytes.NewReader(stdin), &stdout, &stderr).Run(append([]string{"fimgs"}, args...)); err != nil {
+		return stdout.Bytes(), exitCode(err)
+	}
+	return stdout.Bytes(), 0
+}
+
+// writeTestImage saves 8x8 opaque png image to file and returns its contents
+func writeTestImage(t *testing.T, filename string) []byte {
+	t.Helper()
+	im := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for k := range im.Pix {
+		im.Pix[k] = uint8(k * 7)
+		if k%4 == 3 {
+			im.Pix[k] = 255
+		}
+	}
+	var encoded bytes.Buffer
+	if err := fimgs.EncodeImage(&encoded, im, fimgs.SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, encoded.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+func TestStdio(t *testing.T) {
+	input := writeTestImage(t, filepath.Join(t.TempDir(), "in.png"))
+	for _, test := range []struct {
+		args   []string
+		format fimgs.ImageFormat
+	}{
+		{[]string{"-i", "-", "blur"}, fimgs.FormatPNG},
+		{[]string{"-i", "-", "-o", "-", "--format", "jpeg", "blur"}, fimgs.FormatJPEG},
+	} {
+		stdout, code := runApp(t, input, test.args...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d", test.args, code)
+		}
+		if format, err := fimgs.DetectFormat(stdout); err != nil || format != test.format {
+			t.Fatalf("%v: stdout has format %q, error %v", test.args, format, err)
+		}
+		res, err := fimgs.DecodeImage(bytes.NewReader(stdout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Bounds() != image.Rect(0, 0, 8, 8) {
+			t.Fatalf("%v: result has bounds %v", test.args, res.Bounds())
+		}
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.png")
+	writeTestImage(t, input)
+	if err := os.WriteFile(output, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, code := runApp(t, nil, "-i", input, "-o", output, "blur"); code != exitIO {
+		t.Fatalf("overwriting without --force gives exit code %d, want %d", code, exitIO)
+	}
+	if data, _ := os.ReadFile(output); string(data) != "old" {
+		t.Fatal("output is overwritten without --force")
+	}
+
+	stdout, code := runApp(t, nil, "-i", input, "-o", output, "--force", "blur")
+	if code != 0 {
+		t.Fatalf("overwriting with --force gives exit code %d", code)
+	}
+	if string(stdout) != output+"\n" {
+		t.Fatalf("stdout is %q, want result filename", stdout)
+	}
+	if _, err := fimgs.LoadImageFile(output); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.png")
+	writeTestImage(t, input)
+	badShader := filepath.Join(dir, "bad.glsl")
+	if err := os.WriteFile(badShader, []byte("void main() { gl_FragColor = 1; }"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goodShader := filepath.Join(dir, "tint.glsl")
+	if err := os.WriteFile(goodShader, []byte("uniform vec3 tint; void main() { gl_FragColor = vec4(tint, 1.); }"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output := func(name string) string { return filepath.Join(dir, name) }
+	for _, test := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-i", input, "-o", output("ok.png"), "blur"}, 0},
+		{[]string{"-i", input, "-o", output("ok.png"), "blur"}, exitIO},
+		{[]string{"-i", filepath.Join(dir, "missing.png"), "-o", output("missing.png"), "blur"}, exitIO},
+		{[]string{"-i", input, "-o", output("shader.png"), "shader", "-b", "cpu", "-s", badShader}, exitFailure},
+		{[]string{"-i", input, "-o", output("shader.png"), "shader", "-b", "cpu", "-s", output("missing.glsl")}, exitIO},
+		{[]string{"-i", input, "--nosuchflag", "blur"}, exitUsage},
+		{[]string{"-i", input, "blur", "--nosuchflag"}, exitUsage},
+		{[]string{"-i", input, "nosuchcommand"}, exitUsage},
+		{[]string{"-i", input, "-o", output("shader.png"), "shader"}, exitUsage},
+		{[]string{"-i", input, "-o", output("shader.png"), "shader", "-b", "cpu", "-s", goodShader, "-u", "foo=1"}, exitUsage},
+		{[]string{"-i", input, "-o", output("shader.png"), "shader", "-b", "cpu", "-s", goodShader, "-u", "tint=1,2"}, exitUsage},
+		{[]string{"-i", input, "-o", output("shader.png"), "pipeline", "shader -b cpu -s " + goodShader + " -u foo=1"}, exitUsage},
+		{[]string{"-i", input, "-o", output("median.png"), "median", "-w", "4"}, exitUsage},
+		{[]string{"-i", input, "-o", output("cluster.png"), "-p", "-", "cluster", "-n", "2"}, exitUsage},
+		{[]string{"-i", input, "-o", output("ok.jpg"), "--quality", "0", "blur"}, exitUsage},
+		{[]string{"blur"}, exitUsage},
+		{[]string{"batch", input}, exitUsage},
+	} {
+		if _, code := runApp(t, nil, test.args...); code != test.code {
+			t.Errorf("%v: exit code %d, want %d", test.args, code, test.code)
+		}
+	}
+}
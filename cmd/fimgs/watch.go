@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchInterval is how often watched files are checked for changes
+const watchInterval = 200 * time.Millisecond
+
+// fileState is what changes when file is written, missing file has zero state
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(files []string) map[string]fileState {
+	states := make(map[string]fileState, len(files))
+	for _, filename := range files {
+		var state fileState
+		if info, err := os.Stat(filename); err == nil {
+			state = fileState{info.ModTime(), info.Size()}
+		}
+		states[filename] = state
+	}
+	return states
+}
+
+// watchFiles calls run, then calls it again every time one of files read by previous run changes.
+// Errors of run and progress are printed to stderr and watching goes on until process is interrupted.
+func watchFiles(stderr io.Writer, run func() (files []string, err error)) error {
+	for {
+		start := time.Now()
+		files, err := run()
+		if err != nil {
+			fmt.Fprintf(stderr, "fimgs: %s\n", err)
+		} else {
+			fmt.Fprintf(stderr, "done in %s\n", time.Since(start).Round(time.Millisecond))
+		}
+		if len(files) == 0 {
+			return err
+		}
+		fmt.Fprintf(stderr, "watching %s for changes, press Ctrl+C to stop\n", strings.Join(files, ", "))
+		states := statFiles(files)
+		for maps.Equal(states, statFiles(files)) {
+			time.Sleep(watchInterval)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatFiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "kernel.txt")
+	files := []string{filename}
+	if state := statFiles(files)[filename]; state != (fileState{}) {
+		t.Fatalf("missing file has state %v", state)
+	}
+	if err := os.WriteFile(filename, []byte("1 2 1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := statFiles(files)
+	if before[filename] == (fileState{}) || !maps.Equal(before, statFiles(files)) {
+		t.Fatal("state of unchanged file must be the same")
+	}
+
+	// rewrite in the same second changes size only
+	if err := os.WriteFile(filename, []byte("1 2 3 2 1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, before[filename].modTime, before[filename].modTime); err != nil {
+		t.Fatal(err)
+	}
+	if maps.Equal(before, statFiles(files)) {
+		t.Fatal("change of size is not detected")
+	}
+
+	before = statFiles(files)
+	later := before[filename].modTime.Add(time.Second)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if maps.Equal(before, statFiles(files)) {
+		t.Fatal("change of modification time is not detected")
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "shader.glsl")
+	if err := os.WriteFile(filename, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	errStop := errors.New("stop")
+	runs := 0
+	var stderr bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- watchFiles(&stderr, func() ([]string, error) {
+			runs++
+			if runs == 1 {
+				go func() {
+					time.Sleep(2 * watchInterval)
+					os.WriteFile(filename, []byte("new source"), 0o644)
+				}()
+				return []string{filename}, nil
+			}
+			// no files to watch stops watching
+			return nil, errStop
+		})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errStop) || runs != 2 {
+			t.Fatalf("got error %v after %d runs", err, runs)
+		}
+		if !strings.Contains(stderr.String(), "watching "+filename) {
+			t.Fatalf("watched files are not reported, stderr:\n%s", stderr.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change of watched file is not detected")
+	}
+}
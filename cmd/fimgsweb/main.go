@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"html/template"
+	"image"
+	"image/jpeg"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,7 +25,7 @@ func generateNewImageId() string {
 	return time.Now().Format("2006-01-02-03-04-05")
 }
 
-// TODO: check if it is actually image, restrict size
+// TODO: restrict size
 func downloadImage(url string) (_imageFilename string, _imageId string, _err error) {
 	// TODO: cache files by url
 	imageId := generateNewImageId()
@@ -35,14 +40,15 @@ func downloadImage(url string) (_imageFilename string, _imageId string, _err err
 	}
 	defer r.Body.Close()
 
-	var format string
-	switch contentType := r.Header.Get("Content-Type"); contentType {
-	case "image/jpeg":
-		format = "jpeg"
-	case "image/png":
-		format = "png"
-	default:
-		return "", "", fmt.Errorf("image format %q is not supported", contentType)
+	// server may send wrong Content-Type, so format is detected by content
+	body := bufio.NewReader(r.Body)
+	header, err := body.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	format, err := fimgs.DetectFormat(header)
+	if err != nil {
+		return "", "", fmt.Errorf("%w (server sent %s with Content-Type %q)", err, r.Status, r.Header.Get("Content-Type"))
 	}
 
 	imageFilename := filepath.Join("img", fmt.Sprintf("%s.orig.%s", imageId, format))
@@ -52,7 +58,7 @@ func downloadImage(url string) (_imageFilename string, _imageId string, _err err
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(f, r.Body); err != nil {
+	if _, err := io.Copy(f, body); err != nil {
 		return "", "", err
 	}
 
@@ -64,80 +70,275 @@ func downloadImage(url string) (_imageFilename string, _imageId string, _err err
 var rootTemplate = template.Must(template.ParseGlob("templates/*.html")) // TODO: parse once // TODO: embed
 
 func renderTemplateOrPanic(w io.Writer, name string, data interface{}) {
-	if err := rootTemplate.ExecuteTemplate(w, name, data); err != nil {
+	// pages are escaped separately, otherwise escaping shared base.html blocks for one page breaks others
+	pageTemplate := template.Must(rootTemplate.Clone())
+	if err := pageTemplate.ExecuteTemplate(w, name, data); err != nil {
 		// TODO: return and handle error
 		log.Fatalf("Error rendering template: name=%q data=%v err=%q", name, data, err)
 	}
 }
 
+type FormField struct {
+	Name     string
+	Usage    string
+	Value    string
+	Textarea bool
+	Choices  []string
+}
+
 type FilterPageData struct {
 	FilterName string
+	Fields     []FormField
 	Message    string
 	ImageFile  *string
+	StageFiles []string
+	// Metadata of result, e.g. number of clusters chosen automatically
+	Metadata fimgs.Metadata
+	// Palette of paletted result, e.g. of cluster filter, PaletteFiles are it in all formats
+	Palette      []PaletteSwatch
+	PaletteFiles []string
 }
 
-func renderFilterPage(w http.ResponseWriter, templateName, filterName, message string) {
-	renderTemplateOrPanic(w, templateName, FilterPageData{
-		filterName,
-		message,
-		nil,
-	})
+type PaletteSwatch struct {
+	Hex   string
+	Share string
 }
 
-func noValidate(form url.Values) (struct{}, error) { return struct{}{}, nil }
+// saveResult saves result image encoded with opts and its palette if it has one
+func (ff *FilterPageData) saveResult(res image.Image, imageId string, opts fimgs.SaveOptions) error {
+	resultImageFile := filepath.Join("img", fmt.Sprintf("%s.res.%s", imageId, opts.Format))
+	if err := fimgs.SaveImageFileOptions(res, resultImageFile, opts); err != nil {
+		return err
+	}
+	ff.ImageFile = &resultImageFile
+	_, ff.Metadata = fimgs.SplitMetadata(res)
+	palette, ok := fimgs.ImagePalette(res)
+	if !ok {
+		return nil
+	}
+	for _, c := range palette {
+		ff.Palette = append(ff.Palette, PaletteSwatch{c.Hex(), fmt.Sprintf("%.1f%%", c.Share*100)})
+	}
+	for _, ext := range fimgs.PaletteFormats {
+		paletteFile := filepath.Join("img", fmt.Sprintf("%s.palette%s", imageId, ext))
+		if err := fimgs.SavePaletteFile(palette, paletteFile); err != nil {
+			return err
+		}
+		ff.PaletteFiles = append(ff.PaletteFiles, paletteFile)
+	}
+	return nil
+}
 
-type Filter[P any] struct {
-	filterName   string
-	templateName string
+func formFields(f fimgs.Filter, form url.Values) []FormField {
+	fields := make([]FormField, 0, len(f.Params()))
+	for _, param := range f.Params() {
+		if param.Type == fimgs.ParamFile {
+			continue
+		}
+		value := form.Get(param.Name)
+		if value == "" && param.Default != nil {
+			value = fmt.Sprint(param.Default)
+		}
+		fields = append(fields, FormField{
+			Name:     param.Name,
+			Usage:    param.Usage,
+			Value:    value,
+			Textarea: param.Type == fimgs.ParamText || param.Repeated,
+			Choices:  param.Choices,
+		})
+	}
+	return append(fields, outputFields(form)...)
+}
 
-	validate func(url.Values) (P, error)
-	process  func(sourceImageFilename, resultImageFilename string, params P) error
+// outputFields are fields of result image format and encoder options
+func outputFields(form url.Values) []FormField {
+	fields := []FormField{
+		{Name: "format", Usage: "result image format", Value: fimgs.FormatPNG, Choices: fimgs.ImageFormats},
+		{Name: "depth", Usage: "bits per channel of png and tiff result", Value: "8", Choices: []string{"8", "16"}},
+		{Name: "quality", Usage: "quality of jpeg result, from 1 to 100", Value: strconv.Itoa(jpeg.DefaultQuality)},
+		{Name: "colors", Usage: "palette size of gif result, from 2 to 256", Value: "256"},
+		{Name: "compression", Usage: "compression of png result", Value: fimgs.CompressionDefault, Choices: fimgs.PNGCompressions},
+	}
+	for k := range fields {
+		if value := form.Get(fields[k].Name); value != "" {
+			fields[k].Value = value
+		}
+	}
+	return fields
 }
 
-func filterHandler[P any](f Filter[P]) http.HandlerFunc {
+// saveOptions parses output fields of form
+func saveOptions(form url.Values) (fimgs.SaveOptions, error) {
+	opts := fimgs.SaveOptions{Format: fimgs.FormatPNG, Compression: form.Get("compression")}
+	if format := form.Get("format"); format != "" {
+		opts.Format = format
+	}
+	for name, value := range map[string]*int{"depth": &opts.Depth, "quality": &opts.Quality, "colors": &opts.Colors} {
+		raw := form.Get(name)
+		if raw == "" {
+			continue
+		}
+		x, err := strconv.Atoi(raw)
+		if err != nil {
+			return opts, fmt.Errorf("%q must be integer, you gave %q", name, raw)
+		}
+		*value = x
+	}
+	return opts, opts.Validate()
+}
+
+func filterHandler(f fimgs.Filter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ff := FilterPageData{
+			FilterName: f.Title(),
+			Fields:     formFields(f, nil),
+		}
 		if r.Method != "POST" {
-			renderFilterPage(w, f.templateName, f.filterName, "")
+			renderTemplateOrPanic(w, "filter.html", ff)
 			return
 		}
 
 		r.ParseForm()
-		if !r.PostForm.Has("url") {
-			renderFilterPage(w, f.templateName, f.filterName, "'url' is not provided")
-			return
-		}
+		ff.Fields = formFields(f, r.PostForm)
 		imageUrl := r.PostFormValue("url")
 		if imageUrl == "" {
-			renderFilterPage(w, f.templateName, f.filterName, "'url' is not provided")
+			ff.Message = "'url' is not provided"
+			renderTemplateOrPanic(w, "filter.html", ff)
 			return
 		}
 
-		params, err := f.validate(r.PostForm)
+		params, err := fimgs.ParseParams(f, func(name string) (string, bool) {
+			value := r.PostForm.Get(name)
+			return value, value != ""
+		})
+		if err == nil {
+			err = checkNoFiles(fimgs.PipelineStep{Filter: f, Params: params})
+		}
 		if err != nil {
-			renderFilterPage(w, f.templateName, f.filterName, fmt.Sprintf("Error in request params:\n%q", err))
+			ff.Message = fmt.Sprintf("Error in request params:\n%q", err)
+			renderTemplateOrPanic(w, "filter.html", ff)
+			return
+		}
+		opts, err := saveOptions(r.PostForm)
+		if err != nil {
+			ff.Message = fmt.Sprintf("Error in request params:\n%q", err)
+			renderTemplateOrPanic(w, "filter.html", ff)
 			return
 		}
 
 		sourceImageFilename, imageId, err := downloadImage(imageUrl)
 		if err != nil {
-			renderFilterPage(w, f.templateName, f.filterName, fmt.Sprintf("Error occured during loading image:\n%q", err))
+			ff.Message = fmt.Sprintf("Error occured during loading image:\n%q", err)
+			renderTemplateOrPanic(w, "filter.html", ff)
 			return
 		}
 
-		resultImageFile := filepath.Join("img", fmt.Sprintf("img/%s.res.png", imageId))
+		im, err := fimgs.LoadImageFile(sourceImageFilename)
+		if err != nil {
+			ff.Message = fmt.Sprintf("Error occured during loading image:\n%q", err)
+			renderTemplateOrPanic(w, "filter.html", ff)
+			return
+		}
 
-		ff := FilterPageData{
-			FilterName: f.filterName,
+		res, err := f.Apply(im, params)
+		if err == nil {
+			err = ff.saveResult(res, imageId, opts)
 		}
-		if err := f.process(sourceImageFilename, resultImageFile, params); err != nil {
+		if err != nil {
 			ff.Message = fmt.Sprintf("Error occured:\n%q", err)
 		} else {
 			ff.Message = fmt.Sprintf("Processed image %q", imageUrl)
-			ff.ImageFile = &resultImageFile
 			// TODO: add timing
 		}
-		renderTemplateOrPanic(w, f.templateName, ff)
+		renderTemplateOrPanic(w, "filter.html", ff)
+	}
+}
+
+func inlineText(text string) (string, error) { return text, nil }
+
+// checkNoFiles rejects file params of step, they are given by CLI only, so server files are not exposed
+func checkNoFiles(step fimgs.PipelineStep) error {
+	for _, param := range step.Filter.Params() {
+		if param.Type == fimgs.ParamFile && step.Params.String(param.Name) != "" {
+			return fmt.Errorf("%s: %q param is not supported by web server", step.Filter.Name(), param.Name)
+		}
 	}
+	return nil
+}
+
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	ff := FilterPageData{
+		FilterName: "Pipeline",
+		Fields: append([]FormField{{
+			Name:     "pipeline",
+			Usage:    `filters separated by "|", e.g. "quadtree -t 20000 | hilbertdarken", text params are given inline`,
+			Textarea: true,
+		}}, outputFields(nil)...),
+	}
+	if r.Method != "POST" {
+		renderTemplateOrPanic(w, "filter.html", ff)
+		return
+	}
+
+	r.ParseForm()
+	ff.Fields[0].Value = r.PostFormValue("pipeline")
+	ff.Fields = append(ff.Fields[:1], outputFields(r.PostForm)...)
+	imageUrl := r.PostFormValue("url")
+	if imageUrl == "" {
+		ff.Message = "'url' is not provided"
+		renderTemplateOrPanic(w, "filter.html", ff)
+		return
+	}
+
+	pipeline, err := fimgs.ParsePipeline(r.PostFormValue("pipeline"), inlineText)
+	for _, step := range pipeline {
+		if err == nil {
+			err = checkNoFiles(step)
+		}
+	}
+	if err != nil {
+		ff.Message = fmt.Sprintf("Error in request params:\n%q", err)
+		renderTemplateOrPanic(w, "filter.html", ff)
+		return
+	}
+	opts, err := saveOptions(r.PostForm)
+	if err != nil {
+		ff.Message = fmt.Sprintf("Error in request params:\n%q", err)
+		renderTemplateOrPanic(w, "filter.html", ff)
+		return
+	}
+
+	sourceImageFilename, imageId, err := downloadImage(imageUrl)
+	if err != nil {
+		ff.Message = fmt.Sprintf("Error occured during loading image:\n%q", err)
+		renderTemplateOrPanic(w, "filter.html", ff)
+		return
+	}
+
+	im, err := fimgs.LoadImageFile(sourceImageFilename)
+	if err != nil {
+		ff.Message = fmt.Sprintf("Error occured during loading image:\n%q", err)
+		renderTemplateOrPanic(w, "filter.html", ff)
+		return
+	}
+
+	res, err := pipeline.ApplyEach(im, func(step int, im image.Image) error {
+		if step == len(pipeline) {
+			return nil
+		}
+		stageImageFile := filepath.Join("img", fmt.Sprintf("%s.step%d.png", imageId, step))
+		ff.StageFiles = append(ff.StageFiles, stageImageFile)
+		return fimgs.SaveImageFile(im, stageImageFile)
+	})
+	if err == nil {
+		err = ff.saveResult(res, imageId, opts)
+	}
+	if err != nil {
+		ff.Message = fmt.Sprintf("Error occured:\n%q", err)
+	} else {
+		ff.Message = fmt.Sprintf("Processed image %q", imageUrl)
+	}
+	renderTemplateOrPanic(w, "filter.html", ff)
 }
 
 // TODO: load assets https://github.com/go-gl/example/blob/d71b0d9f823d97c3b5ac2a79fdcdb56ca1677eba/gl41core-cube/cube.go#L322
@@ -163,6 +364,11 @@ func main() {
 			log.Printf("2 %v", err)
 			return
 		}
+		if format, ok := fimgs.FormatFromFilename(img_path); ok {
+			w.Header().Set("Content-Type", fimgs.ContentType(format))
+		} else if contentType := mime.TypeByExtension(filepath.Ext(img_path)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
 		w.Write(img_data)
 	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -171,7 +377,7 @@ func main() {
 			renderTemplateOrPanic(w, "404.html", nil)
 			return
 		}
-		renderTemplateOrPanic(w, "index.html", nil)
+		renderTemplateOrPanic(w, "index.html", fimgs.Filters())
 	})
 	mux.HandleFunc("/lasts", func(w http.ResponseWriter, r *http.Request) {
 		saved_images, err := os.ReadDir("img")
@@ -181,6 +387,8 @@ func main() {
 		}
 		sourceImages := make(map[string]template.URL)
 		resultImages := make(map[string]template.URL)
+		stageImages := make(map[string][]template.URL)
+		stageNumbers := make(map[template.URL]int)
 		for _, x := range saved_images {
 			filename := x.Name()
 			dotBeforeExtension := strings.LastIndex(filename, ".")
@@ -198,82 +406,33 @@ func main() {
 				sourceImages[imageId] = fullFilepathURL
 			case "res":
 				resultImages[imageId] = fullFilepathURL
+			default:
+				step, err := strconv.Atoi(strings.TrimPrefix(filename[dotBeforeOrigOrRes+1:dotBeforeExtension], "step"))
+				if err != nil {
+					continue
+				}
+				stageImages[imageId] = append(stageImages[imageId], fullFilepathURL)
+				stageNumbers[fullFilepathURL] = step
 			}
 		}
+		for _, stages := range stageImages {
+			sort.Slice(stages, func(i, j int) bool {
+				return stageNumbers[stages[i]] < stageNumbers[stages[j]]
+			})
+		}
 		// TODO: sort
 		renderTemplateOrPanic(w, "lasts.html", struct {
 			SourceImages map[string]template.URL
+			StageImages  map[string][]template.URL
 			ResultImages map[string]template.URL
-		}{sourceImages, resultImages})
+		}{sourceImages, stageImages, resultImages})
 	})
-	for route, hndlr := range map[string]struct {
-		name   string
-		kernel [][]int
-	}{
-		"blur":            {"Blur", fimgs.BLUR_KERNEL},
-		"weakblur":        {"Weak blur", fimgs.WEAK_BLUR_KERNEL},
-		"emboss":          {"Emboss", fimgs.EMBOSS_KERNEL},
-		"sharpen":         {"Sharpen", fimgs.SHARPEN_KERNEL},
-		"edgeenhance":     {"Edge enhance", fimgs.EDGE_ENHANCE_KERNEL},
-		"edgedetect1":     {"Edge detect 1", fimgs.EDGE_DETECT1_KERNEL},
-		"edgedetect2":     {"Edge detect 2", fimgs.EDGE_DETECT2_KERNEL},
-		"horizontallines": {"Horizontal lines", fimgs.HORIZONTAL_LINES_KERNEL},
-		"verticallines":   {"Vertical lines", fimgs.VERTICAL_LINES_KERNEL},
-	} {
-		mux.HandleFunc("/"+route, filterHandler(Filter[struct{}]{
-			hndlr.name, "filter.html", noValidate,
-			func(sourceImageFilename, resultImageFilename string, _ struct{}) error {
-				return fimgs.ApplyConvolutionFilter(sourceImageFilename, resultImageFilename, hndlr.kernel)
-			},
-		}))
-	}
 	// TODO: draw lokot'
 	// TODO: fix double POST???
-	mux.HandleFunc("/cluster", filterHandler(Filter[int]{
-		"Cluster", "cluster.html",
-		func(form url.Values) (int, error) {
-			if !form.Has("n") {
-				return 0, fmt.Errorf("'n' (number of clusters) is not provided")
-			}
-			n_clusters, err := strconv.Atoi(form.Get("n"))
-			switch {
-			case err != nil:
-				return 0, fmt.Errorf("error parsing parameter 'n':\n%q", err)
-			case n_clusters < 2:
-				return 0, fmt.Errorf("'n' must be at least 2, you gave n=%d", n_clusters)
-			}
-			return n_clusters, nil
-		},
-		func(sourceImageFilename, resultImageFilename string, n_clusters int) error {
-			return fimgs.ApplyKMeansFilter(sourceImageFilename, resultImageFilename, n_clusters)
-		},
-	}))
-	mux.HandleFunc("/hilbert", filterHandler(Filter[struct{}]{
-		"Hilbert curve", "filter.html", noValidate,
-		func(sourceImageFilename, resultImageFilename string, _ struct{}) error {
-			return fimgs.HilbertCurve(sourceImageFilename, resultImageFilename)
-		},
-	}))
-	mux.HandleFunc("/hilbertdarken", filterHandler(Filter[struct{}]{
-		"Hilbert curve darken", "filter.html", noValidate,
-		func(sourceImageFilename, resultImageFilename string, _ struct{}) error {
-			return fimgs.HilbertDarken(sourceImageFilename, resultImageFilename)
-		},
-	}))
-	mux.HandleFunc("/shader", filterHandler(Filter[string]{
-		"Shader", "shader.html",
-		func(form url.Values) (string, error) {
-			if !form.Has("fragment_shader_source") {
-				return "", fmt.Errorf("'fragment_shader_source' is not provided")
-			}
-			fragment_shader_source := form.Get("fragment_shader_source")
-			// TODO: compile shader and return any errors
-			return fragment_shader_source, nil
-		},
-		func(sourceImageFilename, resultImageFilename string, fragment_shader_source string) error {
-			return fimgs.ShaderFilter(sourceImageFilename, resultImageFilename, fragment_shader_source)
-		},
-	}))
+	for _, f := range fimgs.Filters() {
+		mux.HandleFunc("/"+f.Name(), filterHandler(f))
+	}
+	mux.HandleFunc("/pipeline", pipelineHandler)
 
 	s := &http.Server{
 		Addr: ":8080",
@@ -6,6 +6,7 @@ require (
 	github.com/go-gl/gl v0.0.0-20211210172815-726fda9656d6
 	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20220806181222-55e207c401ad
 	github.com/urfave/cli/v2 v2.25.3
+	golang.org/x/image v0.18.0
 )
 
 require (
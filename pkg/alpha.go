@@ -0,0 +1,110 @@
+package fimgs
+
+import (
+	"image"
+	"image/color"
+)
+
+// AlphaMode is the way filter treats transparency
+type AlphaMode = string
+
+const (
+	// AlphaKeep filters non-premultiplied colors as if image was opaque and keeps source alpha
+	AlphaKeep AlphaMode = "keep"
+	// AlphaFilter processes alpha as fourth channel, so e.g. blur makes edges of shapes soft
+	AlphaFilter AlphaMode = "filter"
+)
+
+var AlphaModes = []string{AlphaKeep, AlphaFilter}
+
+// alphaParam is param of filters able to process alpha as fourth channel
+func alphaParam() Param {
+	return Param{
+		Name:    "alpha",
+		Type:    ParamString,
+		Usage:   "keep source alpha or filter it as fourth channel",
+		Default: AlphaKeep,
+		Choices: AlphaModes,
+	}
+}
+
+func isOpaque(im image.Image) bool {
+	if opaque, ok := im.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+	return false
+}
+
+// splitAlpha returns opaque image of non-premultiplied colors and alpha of image
+func splitAlpha(im image.Image) (*image.NRGBA64, *image.Alpha16) {
+	bounds := im.Bounds()
+	opaque := image.NewNRGBA64(bounds)
+	alpha := image.NewAlpha16(bounds)
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			c := color.NRGBA64Model.Convert(im.At(i, j)).(color.NRGBA64)
+			alpha.SetAlpha16(i, j, color.Alpha16{c.A})
+			c.A = 0xFFFF
+			opaque.SetNRGBA64(i, j, c)
+		}
+	}
+	return opaque, alpha
+}
+
+// mergeAlpha returns result of filtering opaque image with alpha put back. Paletted result stays paletted,
+// colors with different alpha become different palette entries, if there are more than 256 of them
+// result is not paletted.
+func mergeAlpha(res image.Image, alpha *image.Alpha16) image.Image {
+	res, metadata := SplitMetadata(res)
+	if paletted, ok := res.(*image.Paletted); ok {
+		if merged, ok := palettedWithAlpha(paletted, alpha); ok {
+			return WithMetadata(merged, metadata)
+		}
+	}
+	bounds := res.Bounds()
+	merged := image.NewNRGBA64(bounds)
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			c := color.NRGBA64Model.Convert(res.At(i, j)).(color.NRGBA64)
+			c.A = alpha.Alpha16At(i, j).A
+			merged.SetNRGBA64(i, j, c)
+		}
+	}
+	return WithMetadata(merged, metadata)
+}
+
+func palettedWithAlpha(paletted *image.Paletted, alpha *image.Alpha16) (*image.Paletted, bool) {
+	bounds := paletted.Bounds()
+	merged := image.NewPaletted(bounds, nil)
+	index := map[[2]uint8]uint8{}
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			key := [2]uint8{paletted.ColorIndexAt(i, j), uint8(alpha.Alpha16At(i, j).A >> 8)}
+			if key[1] == 0 {
+				key[0] = 0 // color of invisible pixels does not matter
+			}
+			k, ok := index[key]
+			if !ok {
+				if len(merged.Palette) == 256 {
+					return nil, false
+				}
+				c := color.NRGBAModel.Convert(paletted.Palette[key[0]]).(color.NRGBA)
+				c.A = key[1]
+				k = uint8(len(merged.Palette))
+				index[key] = k
+				merged.Palette = append(merged.Palette, c)
+			}
+			merged.SetColorIndex(i, j, k)
+		}
+	}
+	return merged, true
+}
+
+// keepAlpha puts alpha of source image back into result of filtering it
+func keepAlpha(source, res image.Image) image.Image {
+	if isOpaque(source) {
+		return res
+	}
+	_, alpha := splitAlpha(source)
+	return mergeAlpha(res, alpha)
+}
@@ -0,0 +1,99 @@
+package fimgs
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// stickerImage is red on the left and blue on the right square of side 16 in the middle of transparent 32x32 image,
+// transparent pixels are white
+func stickerImage() *image.NRGBA {
+	im := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			switch {
+			case x < 8 || x >= 24 || y < 8 || y >= 24:
+				im.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 0})
+			case x < 16:
+				im.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+			default:
+				im.SetNRGBA(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	return im
+}
+
+func TestFiltersKeepAlpha(t *testing.T) {
+	im := stickerImage()
+	for _, f := range Filters() {
+		params, err := ParseParams(f, func(name string) (string, bool) {
+			value, ok := map[string]string{
+				"nclusters": "2",
+				"palette":   "bw",
+				"kernel":    "1 1 1",
+				"shader":    "uniform sampler2D source; in vec2 outTexCoords; void main() { gl_FragColor = texture(source, outTexCoords); }",
+				"backend":   ShaderCPU,
+			}[name]
+			return value, ok
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name(), err)
+		}
+		res, err := f.Apply(im, params)
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name(), err)
+		}
+		res, _ = SplitMetadata(res)
+		bounds := res.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				_, _, _, a := res.At(x, y).RGBA()
+				if want := uint32(im.NRGBAAt(x, y).A) * 0x101; a != want {
+					t.Fatalf("%s: alpha at (%d, %d) is %d, want %d", f.Name(), x, y, a, want)
+				}
+			}
+		}
+	}
+}
+
+func TestBlurFilterAlpha(t *testing.T) {
+	res := ApplyConvolutionAlpha(stickerImage(), GaussianKernel(2).Kernel(), Border{Mode: BorderClamp})
+	if a := res.NRGBA64At(16, 16).A; a != 0xFFFF {
+		t.Fatalf("alpha inside sticker is %d, want 0xFFFF", a)
+	}
+	if a := res.NRGBA64At(0, 0).A; a != 0 {
+		t.Fatalf("alpha far from sticker is %d, want 0", a)
+	}
+	// white of transparent pixels must not leak into color of soft edge
+	if c := res.NRGBA64At(8, 12); c.A == 0 || c.A == 0xFFFF || c != (color.NRGBA64{0xFFFF, 0, 0, c.A}) {
+		t.Fatalf("edge of sticker must be semi-transparent red, got %v", c)
+	}
+}
+
+func TestClusterTransparentImage(t *testing.T) {
+	cluster, _ := LookupFilter("cluster")
+	params, err := ParseParams(cluster, func(name string) (string, bool) {
+		return "2", name == "nclusters"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := cluster.Apply(stickerImage(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	palette, ok := ImagePalette(res)
+	if !ok {
+		t.Fatal("result of clustering must be paletted")
+	}
+	if len(palette) != 2 || palette[0].Share != 0.5 || palette[1].Share != 0.5 {
+		t.Fatalf("transparent pixels must not be clustered, got palette %v", palette)
+	}
+	for _, c := range palette {
+		if hex := c.Hex(); hex != "#ff0000" && hex != "#0000ff" {
+			t.Fatalf("palette must be red and blue, got %v", palette)
+		}
+	}
+}
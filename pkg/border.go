@@ -0,0 +1,122 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// BorderMode is the way neighbourhood filters sample pixels outside of image
+type BorderMode = string
+
+const (
+	// BorderClamp repeats edge pixels
+	BorderClamp BorderMode = "clamp"
+	// BorderMirror reflects image around edge pixels
+	BorderMirror BorderMode = "mirror"
+	// BorderWrap tiles image
+	BorderWrap BorderMode = "wrap"
+	// BorderConstant fills outside with Border.Color
+	BorderConstant BorderMode = "constant"
+	// BorderCrop leaves only pixels whose neighbourhood lies inside of image, so result is smaller
+	BorderCrop BorderMode = "crop"
+)
+
+var BorderModes = []string{BorderClamp, BorderMirror, BorderWrap, BorderConstant, BorderCrop}
+
+// Border is policy of sampling pixels outside of image bounds, zero value clamps coordinates
+type Border struct {
+	Mode  BorderMode
+	Color color.Color
+}
+
+// borderIndex maps coordinate x into [lo, hi), ok is false if x is outside and must be filled with constant
+func borderIndex(x, lo, hi int, mode BorderMode) (_ int, ok bool) {
+	if lo <= x && x < hi {
+		return x, true
+	}
+	n := hi - lo
+	switch mode {
+	case BorderConstant:
+		return 0, false
+	case BorderWrap:
+		return lo + ((x-lo)%n+n)%n, true
+	case BorderMirror:
+		if n == 1 {
+			return lo, true
+		}
+		period := 2 * (n - 1)
+		x = ((x-lo)%period + period) % period
+		if x >= n {
+			x = period - x
+		}
+		return lo + x, true
+	default:
+		return min(max(x, lo), hi-1), true
+	}
+}
+
+// at returns color of pixel (x, y) of image extended beyond its bounds by border
+func (b Border) at(im image.Image, x, y int) color.Color {
+	r := im.Bounds()
+	x, okX := borderIndex(x, r.Min.X, r.Max.X, b.Mode)
+	y, okY := borderIndex(y, r.Min.Y, r.Max.Y, b.Mode)
+	if !okX || !okY {
+		if b.Color == nil {
+			return color.Transparent
+		}
+		return b.Color
+	}
+	return im.At(x, y)
+}
+
+// bounds returns bounds of neighbourhood filter result, window of size width x height
+// has its center at (width/2, height/2)
+func (b Border) bounds(r image.Rectangle, width, height int) image.Rectangle {
+	if b.Mode != BorderCrop {
+		return r
+	}
+	// not image.Rect, it would swap coordinates of empty rectangle
+	res := image.Rectangle{
+		image.Pt(r.Min.X+width/2, r.Min.Y+height/2),
+		image.Pt(r.Max.X-(width-1-width/2), r.Max.Y-(height-1-height/2)),
+	}
+	if res.Empty() {
+		return image.Rectangle{}
+	}
+	return res
+}
+
+func borderParams() []Param {
+	return []Param{
+		{
+			Name:    "border",
+			Alias:   "B",
+			Type:    ParamString,
+			Usage:   "how pixels outside of image are sampled",
+			Default: BorderClamp,
+			Choices: BorderModes,
+		},
+		{
+			Name:    "bordercolor",
+			Type:    ParamString,
+			Usage:   "color of pixels outside of image for constant border, e.g. #ff8000",
+			Default: "#000000",
+		},
+	}
+}
+
+func borderFromParams(params Params) (Border, error) {
+	c, err := ParseHexColor(params.String("bordercolor"))
+	if err != nil {
+		return Border{}, err
+	}
+	return Border{params.String("border"), c}, nil
+}
+
+func validateBorder(params Params) error {
+	_, err := borderFromParams(params)
+	return err
+}
+
+var errEmptyResult = fmt.Errorf("image is smaller than filter window, nothing is left after crop")
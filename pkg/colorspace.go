@@ -0,0 +1,283 @@
+package fimgs
+
+import (
+	"math"
+)
+
+// ColorSpace is the space where colors are compared and averaged
+type ColorSpace = string
+
+const (
+	// ColorSpaceRGB is gamma encoded sRGB
+	ColorSpaceRGB ColorSpace = "rgb"
+	// ColorSpaceLinear is sRGB without gamma, proportional to light intensity
+	ColorSpaceLinear ColorSpace = "linear"
+	// ColorSpaceLab is CIE L*a*b* with D65 white point
+	ColorSpaceLab ColorSpace = "lab"
+	// ColorSpaceOKLab is perceptually uniform Oklab
+	ColorSpaceOKLab ColorSpace = "oklab"
+	// ColorSpaceHSV is HSV cone, hue is stored as angle in cartesian coordinates so it can be averaged
+	ColorSpaceHSV ColorSpace = "hsv"
+)
+
+var ColorSpaces = []string{ColorSpaceRGB, ColorSpaceLinear, ColorSpaceLab, ColorSpaceOKLab, ColorSpaceHSV}
+
+// colorSpace converts sRGB colors with channels in 0..1 to space coordinates and back
+type colorSpace struct {
+	from, to func([3]float64) [3]float64
+	// scale is size of space along lightness axis
+	scale float64
+}
+
+var colorSpaces = map[ColorSpace]colorSpace{
+	ColorSpaceRGB: {
+		from:  func(c [3]float64) [3]float64 { return c },
+		to:    func(c [3]float64) [3]float64 { return c },
+		scale: 1,
+	},
+	ColorSpaceLinear: {
+		from:  srgbToLinear,
+		to:    linearToSRGB,
+		scale: 1,
+	},
+	ColorSpaceLab: {
+		from:  func(c [3]float64) [3]float64 { return xyzToLab(linearToXYZ(srgbToLinear(c))) },
+		to:    func(c [3]float64) [3]float64 { return linearToSRGB(xyzToLinear(labToXYZ(c))) },
+		scale: 100,
+	},
+	ColorSpaceOKLab: {
+		from:  func(c [3]float64) [3]float64 { return linearToOKLab(srgbToLinear(c)) },
+		to:    func(c [3]float64) [3]float64 { return linearToSRGB(okLabToLinear(c)) },
+		scale: 1,
+	},
+	ColorSpaceHSV: {
+		from:  rgbToHSVCone,
+		to:    hsvConeToRGB,
+		scale: 1,
+	},
+}
+
+func mapChannels(c [3]float64, f func(float64) float64) [3]float64 {
+	return [3]float64{f(c[0]), f(c[1]), f(c[2])}
+}
+
+func srgbToLinear(c [3]float64) [3]float64 {
+	return mapChannels(c, func(x float64) float64 {
+		if x <= 0.04045 {
+			return x / 12.92
+		}
+		return math.Pow((x+0.055)/1.055, 2.4)
+	})
+}
+
+func linearToSRGB(c [3]float64) [3]float64 {
+	return mapChannels(c, func(x float64) float64 {
+		if x <= 0.0031308 {
+			return x * 12.92
+		}
+		return 1.055*math.Pow(x, 1/2.4) - 0.055
+	})
+}
+
+func mulMatrix(m [3][3]float64, c [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*c[0] + m[0][1]*c[1] + m[0][2]*c[2],
+		m[1][0]*c[0] + m[1][1]*c[1] + m[1][2]*c[2],
+		m[2][0]*c[0] + m[2][1]*c[1] + m[2][2]*c[2],
+	}
+}
+
+// D65 white point
+var whiteXYZ = [3]float64{0.95047, 1, 1.08883}
+
+func linearToXYZ(c [3]float64) [3]float64 {
+	return mulMatrix([3][3]float64{
+		{0.4124564, 0.3575761, 0.1804375},
+		{0.2126729, 0.7151522, 0.0721750},
+		{0.0193339, 0.1191920, 0.9503041},
+	}, c)
+}
+
+func xyzToLinear(c [3]float64) [3]float64 {
+	return mulMatrix([3][3]float64{
+		{3.2404542, -1.5371385, -0.4985314},
+		{-0.9692660, 1.8760108, 0.0415560},
+		{0.0556434, -0.2040259, 1.0572252},
+	}, c)
+}
+
+func xyzToLab(c [3]float64) [3]float64 {
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(c[0]/whiteXYZ[0]), f(c[1]/whiteXYZ[1]), f(c[2]/whiteXYZ[2])
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func labToXYZ(c [3]float64) [3]float64 {
+	fy := (c[0] + 16) / 116
+	fx, fz := fy+c[1]/500, fy-c[2]/200
+	f := func(t float64) float64 {
+		if t*t*t > 216.0/24389 {
+			return t * t * t
+		}
+		return (116*t - 16) * 27 / 24389
+	}
+	return [3]float64{f(fx) * whiteXYZ[0], f(fy) * whiteXYZ[1], f(fz) * whiteXYZ[2]}
+}
+
+func linearToOKLab(c [3]float64) [3]float64 {
+	lms := mulMatrix([3][3]float64{
+		{0.4122214708, 0.5363325363, 0.0514459929},
+		{0.2119034982, 0.6806995451, 0.1073969566},
+		{0.0883024619, 0.2817188376, 0.6299787005},
+	}, c)
+	return mulMatrix([3][3]float64{
+		{0.2104542553, 0.7936177850, -0.0040720468},
+		{1.9779984951, -2.4285922050, 0.4505937099},
+		{0.0259040371, 0.7827717662, -0.8086757660},
+	}, mapChannels(lms, math.Cbrt))
+}
+
+func okLabToLinear(c [3]float64) [3]float64 {
+	lms := mulMatrix([3][3]float64{
+		{1, 0.3963377774, 0.2158037573},
+		{1, -0.1055613458, -0.0638541728},
+		{1, -0.0894841775, -1.2914855480},
+	}, c)
+	return mulMatrix([3][3]float64{
+		{4.0767416621, -3.3077115913, 0.2309699292},
+		{-1.2684380046, 2.6097574011, -0.3413193965},
+		{-0.0041960863, -0.7034186147, 1.7076147010},
+	}, mapChannels(lms, func(x float64) float64 { return x * x * x }))
+}
+
+// rgbToHSV returns hue in 0..1, saturation and value
+func rgbToHSV(c [3]float64) [3]float64 {
+	v := math.Max(math.Max(c[0], c[1]), c[2])
+	diff := v - math.Min(math.Min(c[0], c[1]), c[2])
+	if diff == 0 {
+		return [3]float64{0, 0, v}
+	}
+	var h float64
+	switch v {
+	case c[0]:
+		h = math.Mod((c[1]-c[2])/diff+6, 6)
+	case c[1]:
+		h = (c[2]-c[0])/diff + 2
+	default:
+		h = (c[0]-c[1])/diff + 4
+	}
+	return [3]float64{h / 6, diff / v, v}
+}
+
+func hsvToRGB(c [3]float64) [3]float64 {
+	h, s, v := c[0]*6, c[1], c[2]
+	channel := func(n float64) float64 {
+		k := math.Mod(n+h, 6)
+		return v - v*s*math.Max(0, math.Min(math.Min(k, 4-k), 1))
+	}
+	return [3]float64{channel(5), channel(3), channel(1)}
+}
+
+// rgbToHSVCone returns (s*cos(h), s*sin(h), v)
+func rgbToHSVCone(c [3]float64) [3]float64 {
+	hsv := rgbToHSV(c)
+	h := hsv[0] * 2 * math.Pi
+	return [3]float64{hsv[1] * math.Cos(h), hsv[1] * math.Sin(h), hsv[2]}
+}
+
+func hsvConeToRGB(c [3]float64) [3]float64 {
+	h := math.Atan2(c[1], c[0]) / (2 * math.Pi)
+	if h < 0 {
+		h++
+	}
+	return hsvToRGB([3]float64{h, math.Min(math.Hypot(c[0], c[1]), 1), c[2]})
+}
+
+// ColorMetric is distance between colors in color space
+type ColorMetric = string
+
+const (
+	MetricL1 ColorMetric = "l1"
+	MetricL2 ColorMetric = "l2"
+	// MetricCIEDE2000 is perceptual color difference, it is defined for Lab colors only
+	MetricCIEDE2000 ColorMetric = "ciede2000"
+)
+
+var ColorMetrics = []string{MetricL1, MetricL2, MetricCIEDE2000}
+
+var colorMetrics = map[ColorMetric]func(a, b [3]float64) float64{
+	MetricL1: func(a, b [3]float64) float64 {
+		return math.Abs(a[0]-b[0]) + math.Abs(a[1]-b[1]) + math.Abs(a[2]-b[2])
+	},
+	MetricL2: func(a, b [3]float64) float64 {
+		d0, d1, d2 := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+		return math.Sqrt(d0*d0 + d1*d1 + d2*d2)
+	},
+	MetricCIEDE2000: ciede2000,
+}
+
+// ciede2000 returns CIEDE2000 difference of Lab colors with unit weighting factors
+func ciede2000(lab1, lab2 [3]float64) float64 {
+	const deg = math.Pi / 180
+	c1, c2 := math.Hypot(lab1[1], lab1[2]), math.Hypot(lab2[1], lab2[2])
+	meanC := (c1 + c2) / 2
+	meanC7 := math.Pow(meanC, 7)
+	g := 0.5 * (1 - math.Sqrt(meanC7/(meanC7+math.Pow(25, 7))))
+	a1, a2 := (1+g)*lab1[1], (1+g)*lab2[1]
+	c1, c2 = math.Hypot(a1, lab1[2]), math.Hypot(a2, lab2[2])
+	hue := func(b, a float64) float64 {
+		if a == 0 && b == 0 {
+			return 0
+		}
+		h := math.Atan2(b, a)
+		if h < 0 {
+			h += 2 * math.Pi
+		}
+		return h
+	}
+	h1, h2 := hue(lab1[2], a1), hue(lab2[2], a2)
+
+	dL := lab2[0] - lab1[0]
+	dC := c2 - c1
+	var dh float64
+	switch {
+	case c1*c2 == 0:
+		dh = 0
+	case math.Abs(h2-h1) <= math.Pi:
+		dh = h2 - h1
+	case h2-h1 > math.Pi:
+		dh = h2 - h1 - 2*math.Pi
+	default:
+		dh = h2 - h1 + 2*math.Pi
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(dh/2)
+
+	meanL := (lab1[0] + lab2[0]) / 2
+	meanC = (c1 + c2) / 2
+	var meanH float64
+	switch {
+	case c1*c2 == 0:
+		meanH = h1 + h2
+	case math.Abs(h1-h2) <= math.Pi:
+		meanH = (h1 + h2) / 2
+	case h1+h2 < 2*math.Pi:
+		meanH = (h1 + h2 + 2*math.Pi) / 2
+	default:
+		meanH = (h1 + h2 - 2*math.Pi) / 2
+	}
+	t := 1 - 0.17*math.Cos(meanH-30*deg) + 0.24*math.Cos(2*meanH) + 0.32*math.Cos(3*meanH+6*deg) - 0.20*math.Cos(4*meanH-63*deg)
+	dTheta := 30 * deg * math.Exp(-math.Pow((meanH/deg-275)/25, 2))
+	meanC7 = math.Pow(meanC, 7)
+	rc := 2 * math.Sqrt(meanC7/(meanC7+math.Pow(25, 7)))
+	l50 := (meanL - 50) * (meanL - 50)
+	sl := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sc := 1 + 0.045*meanC
+	sh := 1 + 0.015*meanC*t
+	rt := -math.Sin(2*dTheta) * rc
+	return math.Sqrt(math.Pow(dL/sl, 2) + math.Pow(dC/sc, 2) + math.Pow(dH/sh, 2) + rt*(dC/sc)*(dH/sh))
+}
@@ -0,0 +1,69 @@
+package fimgs
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestColorSpacesRoundTrip(t *testing.T) {
+	for _, name := range ColorSpaces {
+		space := colorSpaces[name]
+		for _, c := range [][3]float64{{0, 0, 0}, {1, 1, 1}, {1, 0, 0}, {0.2, 0.7, 0.4}, {0.9, 0.1, 0.95}, {0.5, 0.5, 0.5}} {
+			got := space.to(space.from(c))
+			for k := range c {
+				if math.Abs(got[k]-c[k]) > 1e-5 {
+					t.Fatalf("%s: %v converted back to %v", name, c, got)
+				}
+			}
+		}
+	}
+}
+
+func TestCIEDE2000(t *testing.T) {
+	// pairs from Sharma, Wu, Dalal "The CIEDE2000 color-difference formula" test data
+	for _, test := range []struct {
+		a, b [3]float64
+		want float64
+	}{
+		{[3]float64{50, 2.6772, -79.7751}, [3]float64{50, 0, -82.7485}, 2.0425},
+		{[3]float64{50, 2.5, 0}, [3]float64{73, 25, -18}, 27.1492},
+		{[3]float64{50, -0.001, 2.49}, [3]float64{50, 0.0011, -2.49}, 4.7461},
+		{[3]float64{60.2574, -34.0099, 36.2677}, [3]float64{60.4626, -34.1751, 39.4387}, 1.2644},
+		{[3]float64{2.0776, 0.0795, -1.135}, [3]float64{0.9033, -0.0636, -0.5514}, 0.9082},
+	} {
+		if got := ciede2000(test.a, test.b); math.Abs(got-test.want) > 1e-4 {
+			t.Fatalf("ciede2000(%v, %v) = %.4f, want %.4f", test.a, test.b, got, test.want)
+		}
+		if got := ciede2000(test.b, test.a); math.Abs(got-test.want) > 1e-4 {
+			t.Fatalf("ciede2000 is not symmetric for %v, %v: %.4f", test.a, test.b, got)
+		}
+	}
+}
+
+func TestKMeansTwoColors(t *testing.T) {
+	colors := []color.RGBA{{200, 30, 40, 255}, {20, 120, 220, 255}}
+	im := image.NewRGBA(image.Rect(-4, 2, 36, 22))
+	for y := im.Rect.Min.Y; y < im.Rect.Max.Y; y++ {
+		for x := im.Rect.Min.X; x < im.Rect.Max.X; x++ {
+			im.SetRGBA(x, y, colors[(x*x+y)%3/2])
+		}
+	}
+	for _, space := range ColorSpaces {
+		for _, metric := range ColorMetrics {
+			if metric == MetricCIEDE2000 && space != ColorSpaceLab {
+				continue
+			}
+			res := ApplyKMeans(im, 2, KMeansOptions{ColorSpace: space, Metric: metric})
+			for y := im.Rect.Min.Y; y < im.Rect.Max.Y; y++ {
+				for x := im.Rect.Min.X; x < im.Rect.Max.X; x++ {
+					got, want := color.RGBAModel.Convert(res.At(x, y)).(color.RGBA), im.RGBAAt(x, y)
+					if d := max3(abs(int(got.R)-int(want.R)), abs(int(got.G)-int(want.G)), abs(int(got.B)-int(want.B))); d > 1 {
+						t.Fatalf("%s %s: pixel (%d, %d) is %v, want %v", space, metric, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
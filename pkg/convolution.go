@@ -1,125 +1,764 @@
 package fimgs
 
 import (
+	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
 )
 
 var (
-	// TODO: flat data layout
-	BLUR_KERNEL = [][]int{
+	BLUR_KERNEL = Kernel{
 		{1, 1, 1},
 		{1, 1, 1},
 		{1, 1, 1},
 	}
-	WEAK_BLUR_KERNEL = [][]int{
+	WEAK_BLUR_KERNEL = Kernel{
 		{0, 1, 0},
 		{1, 1, 1},
 		{0, 1, 0},
 	}
-	EMBOSS_KERNEL = [][]int{
+	EMBOSS_KERNEL = Kernel{
 		{-2, -1, 0},
 		{-1, 1, 1},
 		{0, 1, 2},
 	}
-	SHARPEN_KERNEL = [][]int{
+	SHARPEN_KERNEL = Kernel{
 		{0, -1, 0},
 		{-1, 5, -1},
 		{0, -1, 0},
 	}
-	EDGE_ENHANCE_KERNEL = [][]int{
+	EDGE_ENHANCE_KERNEL = Kernel{
 		{0, 0, 0},
 		{-1, 1, 0},
 		{0, 0, 0},
 	}
-	EDGE_DETECT1_KERNEL = [][]int{
+	EDGE_DETECT1_KERNEL = Kernel{
 		{1, 0, -1},
 		{0, 0, 0},
 		{-1, 0, 1},
 	}
-	EDGE_DETECT2_KERNEL = [][]int{
+	EDGE_DETECT2_KERNEL = Kernel{
 		{0, -1, 0},
 		{-1, 4, -1},
 		{0, -1, 0},
 	}
-	HORIZONTAL_LINES_KERNEL = [][]int{
+	HORIZONTAL_LINES_KERNEL = Kernel{
 		{-1, -1, -1},
 		{2, 2, 2},
 		{-1, -1, -1},
 	}
-	VERTICAL_LINES_KERNEL = [][]int{
+	VERTICAL_LINES_KERNEL = Kernel{
 		{-1, 2, -1},
 		{-1, 2, -1},
 		{-1, 2, -1},
 	}
 )
 
-func ApplyConvolution(im image.Image, kernel [][]int) image.RGBA {
-	kernelHalfWidth, kernelHalfHeight := len(kernel)/2, len(kernel)/2
-	// TODO: flat data layout
-	R := make([][]Color, im.Bounds().Dx())
-	for i := im.Bounds().Min.X; i < im.Bounds().Max.X; i++ {
-		R[i] = make([]Color, im.Bounds().Dy())
-	}
-	for i := im.Bounds().Min.X; i < im.Bounds().Max.X; i++ {
-		for j := im.Bounds().Min.Y; j < im.Bounds().Max.Y; j++ {
-			r, g, b := 0, 0, 0
-			for di := 0; di < len(kernel); di++ {
-				for dj := 0; dj < len(kernel[0]); dj++ {
-					i1 := i + dj - kernelHalfWidth
-					if i1 < 0 {
-						i1 = 0
-					}
-					if i1 >= im.Bounds().Dx() {
-						i1 = im.Bounds().Dx() - 1
-					}
-					j1 := j + di - kernelHalfHeight
-					if j1 < 0 {
-						j1 = 0
+// Kernel is convolution matrix of any rectangular shape, its center is at (width/2, height/2)
+type Kernel = [][]float64
+
+// SeparableKernel is rank-1 kernel given by column and row vectors, its matrix is kernel[i][j] = Col[i]*Row[j]
+type SeparableKernel struct {
+	Col, Row []float64
+}
+
+// Kernel returns kernel matrix
+func (k SeparableKernel) Kernel() Kernel {
+	kernel := make(Kernel, len(k.Col))
+	for i, x := range k.Col {
+		kernel[i] = make([]float64, len(k.Row))
+		for j, y := range k.Row {
+			kernel[i][j] = x * y
+		}
+	}
+	return kernel
+}
+
+// separate decomposes rank-1 kernel into column and row vectors, so that kernel[i][j] = col[i]*row[j]
+func separate(kernel Kernel) (col, row []float64, ok bool) {
+	p, q := 0, 0
+	for i := range kernel {
+		for j := range kernel[i] {
+			if math.Abs(kernel[i][j]) > math.Abs(kernel[p][q]) {
+				p, q = i, j
+			}
+		}
+	}
+	pivot := kernel[p][q]
+	if pivot == 0 {
+		return nil, nil, false
+	}
+	row = append([]float64(nil), kernel[p]...)
+	col = make([]float64, len(kernel))
+	for i := range kernel {
+		col[i] = kernel[i][q] / pivot
+	}
+	eps := 1e-9 * math.Abs(pivot)
+	for i := range kernel {
+		for j := range kernel[i] {
+			if math.Abs(kernel[i][j]-col[i]*row[j]) > eps {
+				return nil, nil, false
+			}
+		}
+	}
+	return col, row, true
+}
+
+func rgbFloat(c color.Color) [3]float64 {
+	if c == nil {
+		return [3]float64{}
+	}
+	r, g, b, _ := c.RGBA()
+	return [3]float64{float64(r), float64(g), float64(b)}
+}
+
+// toRGBA64 returns image in flat layout with the same RGBA() values
+func toRGBA64(im image.Image) *image.RGBA64 {
+	if res, ok := im.(*image.RGBA64); ok {
+		return res
+	}
+	res := image.NewRGBA64(im.Bounds())
+	draw.Draw(res, res.Bounds(), im, im.Bounds().Min, draw.Src)
+	return res
+}
+
+// borderOffsets returns offsets of source pixels for coordinates from..from+n-1 mapped into [lo, hi) by border,
+// offset is (x-lo)*scale or -1 if pixel must be filled with border color
+func borderOffsets(from, n, lo, hi, scale int, mode BorderMode) []int {
+	offsets := make([]int, n)
+	for k := range offsets {
+		x, ok := borderIndex(from+k, lo, hi, mode)
+		if !ok {
+			offsets[k] = -1
+			continue
+		}
+		offsets[k] = (x - lo) * scale
+	}
+	return offsets
+}
+
+// convolver computes kernel responses of result rows, it can be used from several goroutines,
+// each of them must use its own worker
+type convolver struct {
+	pix    []uint8
+	kernel Kernel
+	// rank-1 kernel decomposition, nil if kernel is not separable
+	col, row []float64
+	// set for large non-separable kernels
+	fft *fftConvolution
+	// sum of kernel values
+	sum    float64
+	bounds image.Rectangle
+	// byte offsets in pix of source columns and rows for every result coordinate plus kernel offset
+	xOffsets, yOffsets []int
+	constant           [3]float64
+}
+
+// convolverFactory makes convolver of some kernel for image and border
+type convolverFactory func(im image.Image, border Border) *convolver
+
+// matrixConvolvers returns factory of convolvers of kernel matrix
+func matrixConvolvers(kernel Kernel) convolverFactory {
+	return func(im image.Image, border Border) *convolver {
+		return newConvolver(im, kernel, border)
+	}
+}
+
+// newSourceConvolver returns convolver of kernel of given size without kernel values set
+func newSourceConvolver(im image.Image, kernelWidth, kernelHeight int, border Border) *convolver {
+	src := toRGBA64(im)
+	bounds := border.bounds(src.Rect, kernelWidth, kernelHeight)
+	return &convolver{
+		pix:      src.Pix,
+		bounds:   bounds,
+		xOffsets: borderOffsets(bounds.Min.X-kernelWidth/2, bounds.Dx()+kernelWidth-1, src.Rect.Min.X, src.Rect.Max.X, 8, border.Mode),
+		yOffsets: borderOffsets(bounds.Min.Y-kernelHeight/2, bounds.Dy()+kernelHeight-1, src.Rect.Min.Y, src.Rect.Max.Y, src.Stride, border.Mode),
+		constant: rgbFloat(border.Color),
+	}
+}
+
+func newConvolver(im image.Image, kernel Kernel, border Border) *convolver {
+	kernelWidth, kernelHeight := len(kernel[0]), len(kernel)
+	if kernelWidth > 1 && kernelHeight > 1 {
+		if col, row, ok := separate(kernel); ok {
+			c := SeparableKernel{col, row}.newConvolver(im, border)
+			c.sum = kernelSum(kernel)
+			return c
+		}
+	}
+	c := newSourceConvolver(im, kernelWidth, kernelHeight, border)
+	c.kernel = kernel
+	c.sum = kernelSum(kernel)
+	if kernelWidth*kernelHeight >= fftThreshold {
+		c.fft = newFFTConvolution(kernel)
+	}
+	return c
+}
+
+// newConvolver returns convolver applying kernel as row pass and column pass, it is convolverFactory
+func (k SeparableKernel) newConvolver(im image.Image, border Border) *convolver {
+	c := newSourceConvolver(im, len(k.Row), len(k.Col), border)
+	c.col, c.row = k.Col, k.Row
+	c.sum = kernelSum(Kernel{k.Col}) * kernelSum(Kernel{k.Row})
+	return c
+}
+
+func (c *convolver) pixel(xOffset, yOffset int) [3]float64 {
+	if xOffset == -1 || yOffset == -1 {
+		return c.constant
+	}
+	p := c.pix[xOffset+yOffset : xOffset+yOffset+6]
+	return [3]float64{
+		float64(uint16(p[0])<<8 | uint16(p[1])),
+		float64(uint16(p[2])<<8 | uint16(p[3])),
+		float64(uint16(p[4])<<8 | uint16(p[5])),
+	}
+}
+
+// sourceRow decodes v-th source row used by result, padded by border to width of result plus kernel width - 1
+func (c *convolver) sourceRow(v int, dst [][3]float64) {
+	yOffset := c.yOffsets[v]
+	for k, xOffset := range c.xOffsets {
+		dst[k] = c.pixel(xOffset, yOffset)
+	}
+}
+
+// rowsRing keeps results of processing of the last rows, so each row is processed once by worker
+type rowsRing struct {
+	data   [][3]float64
+	width  int
+	stored []int
+	rows   [][][3]float64
+}
+
+func newRowsRing(size, width int) *rowsRing {
+	r := &rowsRing{
+		data:   make([][3]float64, size*width),
+		width:  width,
+		stored: make([]int, size),
+		rows:   make([][][3]float64, size),
+	}
+	for slot := range r.stored {
+		r.stored[slot] = -1
+	}
+	return r
+}
+
+// window returns rows v..v+size-1, missing ones are filled using process
+func (r *rowsRing) window(v int, process func(v int, dst [][3]float64)) [][][3]float64 {
+	for k := range r.rows {
+		slot := (v + k) % len(r.rows)
+		r.rows[k] = r.data[slot*r.width : (slot+1)*r.width]
+		if r.stored[slot] != v+k {
+			process(v+k, r.rows[k])
+			r.stored[slot] = v + k
+		}
+	}
+	return r.rows
+}
+
+// worker returns function computing responses of result row j into dst
+func (c *convolver) worker() func(j int, dst [][3]float64) {
+	if c.fft != nil {
+		return c.fftWorker()
+	}
+	if c.col == nil {
+		sourceRows := newRowsRing(len(c.kernel), len(c.xOffsets))
+		return func(j int, dst [][3]float64) {
+			rows := sourceRows.window(j-c.bounds.Min.Y, c.sourceRow)
+			for i := range dst {
+				var sum [3]float64
+				for di, kernelRow := range c.kernel {
+					row := rows[di][i : i+len(kernelRow)]
+					for dj, w := range kernelRow {
+						p := row[dj]
+						sum[0] += p[0] * w
+						sum[1] += p[1] * w
+						sum[2] += p[2] * w
 					}
-					if j1 >= im.Bounds().Dy() {
-						j1 = im.Bounds().Dy() - 1
+				}
+				dst[i] = sum
+			}
+		}
+	}
+
+	rowSum := 0.0
+	for _, w := range c.row {
+		rowSum += w
+	}
+	source := make([][3]float64, len(c.xOffsets))
+	horizontalRows := newRowsRing(len(c.col), c.bounds.Dx())
+	// horizontalRow applies row vector to v-th source row
+	horizontalRow := func(v int, dst [][3]float64) {
+		if c.yOffsets[v] == -1 {
+			// rows outside of image consist of border color for constant border
+			for i := range dst {
+				dst[i] = [3]float64{c.constant[0] * rowSum, c.constant[1] * rowSum, c.constant[2] * rowSum}
+			}
+			return
+		}
+		c.sourceRow(v, source)
+		for i := range dst {
+			row := source[i : i+len(c.row)]
+			var sum [3]float64
+			for dj, w := range c.row {
+				p := row[dj]
+				sum[0] += p[0] * w
+				sum[1] += p[1] * w
+				sum[2] += p[2] * w
+			}
+			dst[i] = sum
+		}
+	}
+	return func(j int, dst [][3]float64) {
+		rows := horizontalRows.window(j-c.bounds.Min.Y, horizontalRow)
+		for i := range dst {
+			var sum [3]float64
+			for di, w := range c.col {
+				h := rows[di][i]
+				sum[0] += h[0] * w
+				sum[1] += h[1] * w
+				sum[2] += h[2] * w
+			}
+			dst[i] = sum
+		}
+	}
+}
+
+// parallelRows splits rows of bounds into contiguous bands processed by runtime.NumCPU() goroutines,
+// worker gets its index and band
+func parallelRows(bounds image.Rectangle, process func(worker, j0, j1 int)) int {
+	workers := min(runtime.NumCPU(), bounds.Dy())
+	band := (bounds.Dy() + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		j0 := bounds.Min.Y + w*band
+		j1 := min(j0+band, bounds.Max.Y)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			process(w, j0, j1)
+		}(w)
+	}
+	wg.Wait()
+	return workers
+}
+
+// Normalization is the way raw kernel response is mapped into colors
+type Normalization = string
+
+const (
+	// NormalizeSum divides response by kernel sum (or 1 if it is zero) and clamps it, standard blur behaviour
+	NormalizeSum Normalization = "sum"
+	// NormalizeClamp clamps response
+	NormalizeClamp Normalization = "clamp"
+	// NormalizeAbs takes absolute value of response and clamps it, useful for edge detectors
+	NormalizeAbs Normalization = "abs"
+	// NormalizeChannel stretches every channel separately to full range
+	NormalizeChannel Normalization = "channel"
+	// NormalizeStretch stretches all channels together to full range
+	NormalizeStretch Normalization = "stretch"
+)
+
+var Normalizations = []string{NormalizeSum, NormalizeClamp, NormalizeAbs, NormalizeChannel, NormalizeStretch}
+
+type ConvolutionOptions struct {
+	Normalization Normalization
+	// Divisor of kernel response, like in classic image editors. Zero means kernel sum (or 1 if sum is zero)
+	// for NormalizeSum and 1 otherwise. Divisor makes no difference for stretching normalizations.
+	Divisor float64
+	// Bias is added to normalized response, in 0..255 scale
+	Bias   int
+	Border Border
+}
+
+func kernelSum(kernel Kernel) float64 {
+	sum := 0.0
+	for _, row := range kernel {
+		for _, x := range row {
+			sum += x
+		}
+	}
+	return sum
+}
+
+func clamp8(x float64) uint8 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 255:
+		return 255
+	default:
+		return uint8(x + 0.5)
+	}
+}
+
+func clamp16(x float64) uint16 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 0xFFFF:
+		return 0xFFFF
+	default:
+		return uint16(x + 0.5)
+	}
+}
+
+// setPixel16 writes channels of pixel into Pix of 64-bit image, pix starts at pixel offset
+func setPixel16(pix []uint8, c [4]uint16) {
+	for k, x := range c {
+		binary.BigEndian.PutUint16(pix[k*2:], x)
+	}
+}
+
+// stretch maps x from lo..hi to 0..0xFFFF, flat range is mapped to 0
+func stretch(x, lo, hi float64) float64 {
+	if hi == lo {
+		return 0
+	}
+	return (x - lo) * 0xFFFF / (hi - lo)
+}
+
+// ApplyConvolution applies kernel to image, result is smaller than image for BorderCrop.
+// Rows are processed in parallel, rank-1 kernels are applied as two 1D passes, large ones using FFT.
+func ApplyConvolution(im image.Image, kernel Kernel, opts ConvolutionOptions) image.NRGBA64 {
+	return applyConvolution(newConvolver(im, kernel, opts.Border), opts)
+}
+
+// ApplySeparableConvolution is ApplyConvolution of rank-1 kernel, its matrix is never built
+func ApplySeparableConvolution(im image.Image, kernel SeparableKernel, opts ConvolutionOptions) image.NRGBA64 {
+	return applyConvolution(kernel.newConvolver(im, opts.Border), opts)
+}
+
+func applyConvolution(conv *convolver, opts ConvolutionOptions) image.NRGBA64 {
+	divisor := opts.Divisor
+	if divisor == 0 {
+		divisor = 1
+		if opts.Normalization == NormalizeSum && conv.sum != 0 {
+			divisor = conv.sum
+		}
+	}
+	bounds := conv.bounds
+	filtered_im := image.NewNRGBA64(bounds)
+	if bounds.Empty() {
+		return *filtered_im
+	}
+
+	// stretching needs range of all responses, so they are computed twice instead of being stored
+	var lo, hi [3]float64
+	switch opts.Normalization {
+	case NormalizeChannel, NormalizeStretch:
+		workersLo := make([][3]float64, runtime.NumCPU())
+		workersHi := make([][3]float64, runtime.NumCPU())
+		workers := parallelRows(bounds, func(w, j0, j1 int) {
+			lo := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+			hi := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+			convolveRow := conv.worker()
+			responses := make([][3]float64, bounds.Dx())
+			for j := j0; j < j1; j++ {
+				convolveRow(j, responses)
+				for _, response := range responses {
+					for c := 0; c < 3; c++ {
+						lo[c] = math.Min(lo[c], response[c])
+						hi[c] = math.Max(hi[c], response[c])
 					}
-					dr, dg, db, _ := im.At(i1, j1).RGBA()
-					r += int(dr) * kernel[di][dj]
-					g += int(dg) * kernel[di][dj]
-					b += int(db) * kernel[di][dj]
 				}
 			}
-			R[i][j] = Color{r, g, b}
-		}
-	}
-	kernelMin, kernelMax := math.MaxInt, math.MinInt
-	for i := im.Bounds().Min.X; i < im.Bounds().Max.X; i++ {
-		for j := im.Bounds().Min.Y; j < im.Bounds().Max.Y; j++ {
-			kernelMin = min4(kernelMin, R[i][j][0], R[i][j][1], R[i][j][2])
-			kernelMax = max4(kernelMax, R[i][j][0], R[i][j][1], R[i][j][2])
-		}
-	}
-	var (
-		filtered_im *image.RGBA = image.NewRGBA(im.Bounds())
-		diff        int         = kernelMax - kernelMin
-	)
-	for i := im.Bounds().Min.X; i < im.Bounds().Max.X; i++ {
-		for j := im.Bounds().Min.Y; j < im.Bounds().Max.Y; j++ {
-			filtered_im.Set(i, j, color.RGBA{
-				uint8((R[i][j][0] - kernelMin) * 255 / diff),
-				uint8((R[i][j][1] - kernelMin) * 255 / diff),
-				uint8((R[i][j][2] - kernelMin) * 255 / diff),
-				255,
-			})
+			workersLo[w], workersHi[w] = lo, hi
+		})
+		lo, hi = workersLo[0], workersHi[0]
+		for w := 1; w < workers; w++ {
+			for c := 0; c < 3; c++ {
+				lo[c] = math.Min(lo[c], workersLo[w][c])
+				hi[c] = math.Max(hi[c], workersHi[w][c])
+			}
+		}
+		if opts.Normalization == NormalizeStretch {
+			globalMin := math.Min(math.Min(lo[0], lo[1]), lo[2])
+			globalMax := math.Max(math.Max(hi[0], hi[1]), hi[2])
+			lo = [3]float64{globalMin, globalMin, globalMin}
+			hi = [3]float64{globalMax, globalMax, globalMax}
 		}
 	}
+
+	parallelRows(bounds, func(_, j0, j1 int) {
+		convolveRow := conv.worker()
+		responses := make([][3]float64, bounds.Dx())
+		for j := j0; j < j1; j++ {
+			convolveRow(j, responses)
+			pix := filtered_im.Pix[(j-bounds.Min.Y)*filtered_im.Stride:]
+			for i, response := range responses {
+				p := [4]uint16{3: 0xFFFF}
+				for c := 0; c < 3; c++ {
+					x := response[c]
+					switch opts.Normalization {
+					case NormalizeChannel, NormalizeStretch:
+						x = stretch(x, lo[c], hi[c])
+					case NormalizeAbs:
+						x = math.Abs(x) / divisor
+					default:
+						x = x / divisor
+					}
+					p[c] = clamp16(x + float64(opts.Bias)*0x101)
+				}
+				setPixel16(pix[i*8:], p)
+			}
+		}
+	})
 	return *filtered_im
 }
 
-func ApplyConvolutionFilter(sourceImageFilename, resultImageFilename string, kernel [][]int) error {
-	im, err := LoadImageFile(sourceImageFilename)
+// ApplyConvolutionAlpha applies blurring kernel to premultiplied colors and alpha, so colors of transparent
+// pixels do not leak into result. Kernel response is divided by kernel sum, like for NormalizeSum.
+func ApplyConvolutionAlpha(im image.Image, kernel Kernel, border Border) image.NRGBA64 {
+	return applyConvolutionAlpha(im, matrixConvolvers(kernel), border)
+}
+
+func applyConvolutionAlpha(im image.Image, newConvolver convolverFactory, border Border) image.NRGBA64 {
+	conv := newConvolver(im, border)
+	bounds, colors := convolveResponses(conv)
+	alphaBorder := border
+	if border.Color != nil {
+		_, _, _, a := border.Color.RGBA()
+		alphaBorder.Color = color.Gray16{uint16(a)}
+	}
+	_, alphas := convolveResponses(newConvolver(alphaImage(im), alphaBorder))
+	divisor := conv.sum
+	if divisor == 0 {
+		divisor = 1
+	}
+	res := image.NewNRGBA64(bounds)
+	for k, response := range colors {
+		a := alphas[k][0]
+		if a <= 0 {
+			continue
+		}
+		setPixel16(res.Pix[k*8:], [4]uint16{
+			clamp16(response[0] / a * 0xFFFF),
+			clamp16(response[1] / a * 0xFFFF),
+			clamp16(response[2] / a * 0xFFFF),
+			clamp16(a / divisor),
+		})
+	}
+	return *res
+}
+
+// alphaImage returns alpha of image as grayscale image
+func alphaImage(im image.Image) *image.Gray16 {
+	bounds := im.Bounds()
+	res := image.NewGray16(bounds)
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			_, _, _, a := im.At(i, j).RGBA()
+			res.SetGray16(i, j, color.Gray16{uint16(a)})
+		}
+	}
+	return res
+}
+
+// convolveResponses returns raw kernel responses of result pixels row by row, in 0..0xFFFF scale
+func convolveResponses(conv *convolver) (image.Rectangle, [][3]float64) {
+	bounds := conv.bounds
+	responses := make([][3]float64, bounds.Dx()*bounds.Dy())
+	if bounds.Empty() {
+		return bounds, responses
+	}
+	parallelRows(bounds, func(_, j0, j1 int) {
+		convolveRow := conv.worker()
+		for j := j0; j < j1; j++ {
+			k := (j - bounds.Min.Y) * bounds.Dx()
+			convolveRow(j, responses[k:k+bounds.Dx()])
+		}
+	})
+	return bounds, responses
+}
+
+// ParseKernel parses kernel matrix, rows are separated by ";" or new lines, values by spaces or ",".
+func ParseKernel(s string) (Kernel, error) {
+	kernel := Kernel{}
+	for _, line := range strings.FieldsFunc(s, func(c rune) bool { return c == ';' || c == '\n' }) {
+		values := strings.FieldsFunc(line, func(c rune) bool { return c == ',' || unicode.IsSpace(c) })
+		if len(values) == 0 {
+			continue
+		}
+		row := make([]float64, len(values))
+		for i, value := range values {
+			x, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q in row %d of kernel", value, len(kernel)+1)
+			}
+			row[i] = x
+		}
+		if len(kernel) > 0 && len(row) != len(kernel[0]) {
+			return nil, fmt.Errorf("kernel must be rectangular, but row %d has %d values while row 1 has %d", len(kernel)+1, len(row), len(kernel[0]))
+		}
+		kernel = append(kernel, row)
+	}
+	if len(kernel) == 0 {
+		return nil, fmt.Errorf("kernel is empty")
+	}
+	return kernel, nil
+}
+
+// kernelParam returns kernel given either inline or as file contents
+func kernelParam(params Params) (Kernel, error) {
+	kernel, kernelFile := params.String("kernel"), params.String("kernelfile")
+	switch {
+	case kernel != "" && kernelFile != "":
+		return nil, fmt.Errorf("kernel must be given either inline or as file, not both")
+	case kernel != "":
+		return ParseKernel(kernel)
+	case kernelFile != "":
+		return ParseKernel(kernelFile)
+	default:
+		return nil, fmt.Errorf("kernel is not provided")
+	}
+}
+
+func normalizationParam(normalization Normalization) Param {
+	return Param{
+		Name:    "normalize",
+		Alias:   "N",
+		Type:    ParamString,
+		Usage:   "how kernel response is mapped into colors",
+		Default: normalization,
+		Choices: Normalizations,
+	}
+}
+
+// convolutionParams are params common for convolution filters
+func convolutionParams(normalization Normalization) []Param {
+	return append([]Param{normalizationParam(normalization)}, borderParams()...)
+}
+
+// blurParams are convolution params of blurring filters, which can process alpha as fourth channel
+func blurParams() []Param {
+	return append(convolutionParams(NormalizeSum), alphaParam())
+}
+
+func validateBlur(params Params) error {
+	if params.String("alpha") == AlphaFilter && params.String("normalize") != NormalizeSum {
+		return fmt.Errorf("alpha can be filtered with %q normalization only, you gave %q", NormalizeSum, params.String("normalize"))
+	}
+	return validateBorder(params)
+}
+
+// applyConvolutionParams applies kernel using normalization and border from convolutionParams,
+// alpha is filtered too if blurParams ask for it
+func applyConvolutionParams(im image.Image, newConvolver convolverFactory, params Params, opts ConvolutionOptions) (image.Image, error) {
+	border, err := borderFromParams(params)
 	if err != nil {
-		return fmt.Errorf("error occured during loading image:\n%q", err)
+		return nil, err
 	}
-	resImage := ApplyConvolution(im, kernel)
-	return saveImage(resImage, resultImageFilename)
+	if alpha, ok := params["alpha"]; ok && alpha == AlphaFilter {
+		res := applyConvolutionAlpha(im, newConvolver, border)
+		if res.Bounds().Empty() {
+			return nil, errEmptyResult
+		}
+		return &res, nil
+	}
+	opts.Normalization = params.String("normalize")
+	opts.Border = border
+	res := applyConvolution(newConvolver(im, border), opts)
+	if res.Bounds().Empty() {
+		return nil, errEmptyResult
+	}
+	return &res, nil
+}
+
+func init() {
+	for _, f := range []struct {
+		name, title   string
+		kernel        Kernel
+		normalization Normalization
+		blur          bool
+	}{
+		{"blur", "Blur", BLUR_KERNEL, NormalizeSum, true},
+		{"weakblur", "Weak blur", WEAK_BLUR_KERNEL, NormalizeSum, true},
+		{"emboss", "Emboss", EMBOSS_KERNEL, NormalizeSum, false},
+		{"sharpen", "Sharpen", SHARPEN_KERNEL, NormalizeSum, false},
+		{"edgeenhance", "Edge enhance", EDGE_ENHANCE_KERNEL, NormalizeAbs, false},
+		{"edgedetect1", "Edge detect 1", EDGE_DETECT1_KERNEL, NormalizeAbs, false},
+		{"edgedetect2", "Edge detect 2", EDGE_DETECT2_KERNEL, NormalizeAbs, false},
+		{"horizontallines", "Horizontal lines", HORIZONTAL_LINES_KERNEL, NormalizeAbs, false},
+		{"verticallines", "Vertical lines", VERTICAL_LINES_KERNEL, NormalizeAbs, false},
+	} {
+		kernel := f.kernel
+		conv := &filter{
+			name:        f.name,
+			title:       f.title,
+			description: fmt.Sprintf("Apply %s convolution filter.", f.name),
+			params:      convolutionParams(f.normalization),
+			validate:    validateBorder,
+			apply: func(im image.Image, params Params) (image.Image, error) {
+				return applyConvolutionParams(im, matrixConvolvers(kernel), params, ConvolutionOptions{})
+			},
+		}
+		if f.blur {
+			conv.params = blurParams()
+			conv.validate = validateBlur
+			conv.filtersAlpha = filtersAlphaParam
+		}
+		Register(conv)
+	}
+	Register(&filter{
+		name:  "convolve",
+		title: "Custom convolution",
+		description: `Apply custom kernel of any rectangular shape, result is divided by divisor, normalized and biased.
+Kernel rows are separated by ";" or new lines, values by spaces or ",", e.g. "1 2 1; 2 4 2; 1 2 1".`,
+		params: append([]Param{
+			{
+				Name:    "kernel",
+				Alias:   "k",
+				Type:    ParamString,
+				Usage:   "kernel matrix, e.g. \"0 -1 0; -1 5 -1; 0 -1 0\"",
+				Default: "",
+			},
+			{
+				Name:    "kernelfile",
+				Alias:   "K",
+				Type:    ParamText,
+				Usage:   "file with kernel matrix, one row per line",
+				Default: "",
+			},
+			{
+				Name:    "divisor",
+				Alias:   "d",
+				Type:    ParamFloat,
+				Usage:   "result divisor, 0 means sum of kernel (or 1 if it is zero) for \"sum\" normalization and 1 otherwise",
+				Default: 0.0,
+			},
+			{
+				Name:    "bias",
+				Alias:   "b",
+				Type:    ParamInt,
+				Usage:   "value added to result, in 0..255 scale",
+				Default: 0,
+			},
+		}, convolutionParams(NormalizeSum)...),
+		validate: func(params Params) error {
+			if _, err := kernelParam(params); err != nil {
+				return err
+			}
+			return validateBorder(params)
+		},
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			kernel, err := kernelParam(params)
+			if err != nil {
+				return nil, err
+			}
+			return applyConvolutionParams(im, matrixConvolvers(kernel), params, ConvolutionOptions{
+				Divisor: params.Float("divisor"),
+				Bias:    params.Int("bias"),
+			})
+		},
+	})
 }
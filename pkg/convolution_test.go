@@ -0,0 +1,396 @@
+package fimgs
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// convolveDirectReference computes kernel response for every pixel of bounds, responses are stored row by row
+func convolveDirectReference(im image.Image, kernel Kernel, border Border, bounds image.Rectangle) [][3]float64 {
+	kernelHalfWidth, kernelHalfHeight := len(kernel[0])/2, len(kernel)/2
+	res := make([][3]float64, bounds.Dx()*bounds.Dy())
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			var sum [3]float64
+			for di := range kernel {
+				for dj, w := range kernel[di] {
+					c := rgbFloat(border.at(im, i+dj-kernelHalfWidth, j+di-kernelHalfHeight))
+					sum[0] += c[0] * w
+					sum[1] += c[1] * w
+					sum[2] += c[2] * w
+				}
+			}
+			res[(j-bounds.Min.Y)*bounds.Dx()+i-bounds.Min.X] = sum
+		}
+	}
+	return res
+}
+
+// convolveSeparableReference computes the same as convolveDirectReference for kernel col x row, applying row to
+// every image row first and then col to results, so it takes O(w+h) instead of O(w*h) per pixel
+func convolveSeparableReference(im image.Image, col, row []float64, border Border, bounds image.Rectangle) [][3]float64 {
+	kernelHalfWidth, kernelHalfHeight := len(row)/2, len(col)/2
+	r := im.Bounds()
+	width := bounds.Dx()
+	horizontal := make([][3]float64, width*r.Dy())
+	for j := r.Min.Y; j < r.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			var sum [3]float64
+			for dj, w := range row {
+				c := rgbFloat(border.at(im, i+dj-kernelHalfWidth, j))
+				sum[0] += c[0] * w
+				sum[1] += c[1] * w
+				sum[2] += c[2] * w
+			}
+			horizontal[(j-r.Min.Y)*width+i-bounds.Min.X] = sum
+		}
+	}
+	// rows outside of image consist of border color for constant border
+	rowSum := 0.0
+	for _, w := range row {
+		rowSum += w
+	}
+	constantRow := rgbFloat(border.Color)
+	for c := range constantRow {
+		constantRow[c] *= rowSum
+	}
+	res := make([][3]float64, width*bounds.Dy())
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			var sum [3]float64
+			for di, w := range col {
+				h := constantRow
+				if j1, ok := borderIndex(j+di-kernelHalfHeight, r.Min.Y, r.Max.Y, border.Mode); ok {
+					h = horizontal[(j1-r.Min.Y)*width+i-bounds.Min.X]
+				}
+				sum[0] += h[0] * w
+				sum[1] += h[1] * w
+				sum[2] += h[2] * w
+			}
+			res[(j-bounds.Min.Y)*width+i-bounds.Min.X] = sum
+		}
+	}
+	return res
+}
+
+// convolveReference computes raw kernel response for every pixel of result bounds, responses are stored row by row.
+// Rank-1 kernels are applied as two 1D passes.
+func convolveReference(im image.Image, kernel Kernel, border Border) (image.Rectangle, [][3]float64) {
+	bounds := border.bounds(im.Bounds(), len(kernel[0]), len(kernel))
+	if bounds.Empty() {
+		return bounds, nil
+	}
+	if len(kernel) > 1 && len(kernel[0]) > 1 {
+		if col, row, ok := separate(kernel); ok {
+			return bounds, convolveSeparableReference(im, col, row, border, bounds)
+		}
+	}
+	return bounds, convolveDirectReference(im, kernel, border, bounds)
+}
+
+// applyConvolutionReference is single threaded engine storing all responses, ApplyConvolution must give identical results
+func applyConvolutionReference(im image.Image, kernel Kernel, opts ConvolutionOptions) image.NRGBA64 {
+	divisor := opts.Divisor
+	if divisor == 0 {
+		divisor = 1
+		if sum := kernelSum(kernel); opts.Normalization == NormalizeSum && sum != 0 {
+			divisor = sum
+		}
+	}
+	bounds, R := convolveReference(im, kernel, opts.Border)
+	var lo, hi [3]float64
+	switch opts.Normalization {
+	case NormalizeChannel, NormalizeStretch:
+		lo = [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+		hi = [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+		for _, response := range R {
+			for c := 0; c < 3; c++ {
+				lo[c] = math.Min(lo[c], response[c])
+				hi[c] = math.Max(hi[c], response[c])
+			}
+		}
+		if opts.Normalization == NormalizeStretch {
+			globalMin := math.Min(math.Min(lo[0], lo[1]), lo[2])
+			globalMax := math.Max(math.Max(hi[0], hi[1]), hi[2])
+			lo = [3]float64{globalMin, globalMin, globalMin}
+			hi = [3]float64{globalMax, globalMax, globalMax}
+		}
+	}
+	filtered_im := image.NewNRGBA64(bounds)
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			response := R[(j-bounds.Min.Y)*bounds.Dx()+i-bounds.Min.X]
+			var res [3]uint16
+			for c := 0; c < 3; c++ {
+				x := response[c]
+				switch opts.Normalization {
+				case NormalizeChannel, NormalizeStretch:
+					x = stretch(x, lo[c], hi[c])
+				case NormalizeAbs:
+					x = math.Abs(x) / divisor
+				default:
+					x = x / divisor
+				}
+				res[c] = clamp16(x + float64(opts.Bias)*0x101)
+			}
+			filtered_im.SetNRGBA64(i, j, color.NRGBA64{res[0], res[1], res[2], 0xFFFF})
+		}
+	}
+	return *filtered_im
+}
+
+func TestParseKernel(t *testing.T) {
+	kernel, err := ParseKernel("1 2 1; 2,4,2\n1 2 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Kernel{{1, 2, 1}, {2, 4, 2}, {1, 2, 1}}); !reflect.DeepEqual(kernel, want) {
+		t.Fatalf("got %v, want %v", kernel, want)
+	}
+
+	for _, s := range []string{"", " ; \n", "1 2; 3", "1 x"} {
+		if _, err := ParseKernel(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestApplyConvolutionNonSquare(t *testing.T) {
+	im := image.NewGray(image.Rect(0, 0, 4, 2))
+	for i := 0; i < 4; i++ {
+		im.SetGray(i, 0, color.Gray{uint8(i * 10)})
+		im.SetGray(i, 1, color.Gray{uint8(i * 10)})
+	}
+	// horizontal difference: right neighbour minus left one
+	res := ApplyConvolution(im, Kernel{{-1, 0, 1}}, ConvolutionOptions{Normalization: NormalizeClamp, Bias: 100})
+	for i, want := range []uint8{110, 120, 120, 110} {
+		if got := rgba8(&res, i, 1).R; got != want {
+			t.Errorf("pixel %d: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestApplyConvolutionFlatImage(t *testing.T) {
+	im := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			im.Set(i, j, color.RGBA{10, 20, 30, 255})
+		}
+	}
+	for _, test := range []struct {
+		kernel        Kernel
+		normalization Normalization
+		want          color.RGBA
+	}{
+		{BLUR_KERNEL, NormalizeSum, color.RGBA{10, 20, 30, 255}},
+		{BLUR_KERNEL, NormalizeClamp, color.RGBA{90, 180, 255, 255}},
+		{BLUR_KERNEL, NormalizeChannel, color.RGBA{0, 0, 0, 255}},
+		{BLUR_KERNEL, NormalizeStretch, color.RGBA{0, 128, 255, 255}},
+		{EDGE_DETECT2_KERNEL, NormalizeAbs, color.RGBA{0, 0, 0, 255}},
+		{EDGE_DETECT2_KERNEL, NormalizeStretch, color.RGBA{0, 0, 0, 255}},
+	} {
+		res := ApplyConvolution(im, test.kernel, ConvolutionOptions{Normalization: test.normalization})
+		if got := rgba8(&res, 1, 1); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.normalization, got, test.want)
+		}
+	}
+}
+
+func TestBorderModes(t *testing.T) {
+	// non-zero origin, as produced by SubImage
+	im := image.NewGray(image.Rect(10, 20, 13, 21))
+	for i, v := range []uint8{10, 20, 30} {
+		im.SetGray(10+i, 20, color.Gray{v})
+	}
+	kernel := Kernel{{1, 0, 0, 0, 0}} // takes pixel two steps to the left
+	for _, test := range []struct {
+		border Border
+		want   []uint8
+	}{
+		{Border{Mode: BorderClamp}, []uint8{10, 10, 10}},
+		{Border{Mode: BorderMirror}, []uint8{30, 20, 10}},
+		{Border{Mode: BorderWrap}, []uint8{20, 30, 10}},
+		{Border{Mode: BorderConstant, Color: color.Gray{77}}, []uint8{77, 77, 10}},
+		{Border{Mode: BorderCrop}, []uint8{}},
+	} {
+		res := ApplyConvolution(im, kernel, ConvolutionOptions{Normalization: NormalizeSum, Border: test.border})
+		got := []uint8{}
+		for i := res.Bounds().Min.X; i < res.Bounds().Max.X; i++ {
+			got = append(got, rgba8(&res, i, 20).R)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.border.Mode, got, test.want)
+		}
+	}
+
+	res := ApplyConvolution(im, Kernel{{1, 1, 1}}, ConvolutionOptions{Normalization: NormalizeSum, Border: Border{Mode: BorderCrop}})
+	if want := image.Rect(11, 20, 12, 21); res.Bounds() != want {
+		t.Errorf("crop: got bounds %v, want %v", res.Bounds(), want)
+	}
+}
+
+// rgba8 returns color of pixel truncated to 8 bits
+func rgba8(im image.Image, x, y int) color.RGBA {
+	return color.RGBAModel.Convert(im.At(x, y)).(color.RGBA)
+}
+
+func randomImage(r image.Rectangle) *image.RGBA {
+	im := image.NewRGBA(r)
+	for i := range im.Pix {
+		im.Pix[i] = uint8(i * 7919 % 251)
+	}
+	return im
+}
+
+func TestSeparableMatchesDirect(t *testing.T) {
+	im := randomImage(image.Rect(3, 5, 40, 30))
+	for _, kernel := range []Kernel{GaussianKernel(1.5).Kernel(), BoxKernel(2).Kernel(), {{1, 2, 1}, {2, 4, 2}}} {
+		col, row, ok := separate(kernel)
+		if !ok {
+			t.Fatalf("kernel %v must be separable", kernel)
+		}
+		for _, mode := range BorderModes {
+			border := Border{Mode: mode, Color: color.RGBA{200, 100, 50, 255}}
+			bounds := border.bounds(im.Bounds(), len(kernel[0]), len(kernel))
+			direct := convolveDirectReference(im, kernel, border, bounds)
+			separable := convolveSeparableReference(im, col, row, border, bounds)
+			for k := range direct {
+				for c := 0; c < 3; c++ {
+					if math.Abs(direct[k][c]-separable[k][c]) > 1e-6 {
+						t.Fatalf("%s: pixel %d differs: direct %v, separable %v", mode, k, direct[k], separable[k])
+					}
+				}
+			}
+		}
+	}
+	if _, _, ok := separate(MotionBlurKernel(30, 9)); ok {
+		t.Errorf("diagonal motion blur kernel must not be separable")
+	}
+}
+
+func TestApplyConvolutionMatchesReference(t *testing.T) {
+	var images []image.Image
+	images = append(images, randomImage(image.Rect(3, 5, 70, 41)))
+	gray := image.NewGray(image.Rect(-4, 0, 33, 17))
+	copy(gray.Pix, randomImage(gray.Rect).Pix)
+	images = append(images, gray)
+	for _, im := range images {
+		for _, kernel := range []Kernel{EMBOSS_KERNEL, GaussianKernel(1.3).Kernel(), MotionBlurKernel(30, 7), {{1, -2, 3, 0, 1}}} {
+			for _, mode := range BorderModes {
+				for _, normalization := range Normalizations {
+					opts := ConvolutionOptions{
+						Normalization: normalization,
+						Bias:          7,
+						Border:        Border{Mode: mode, Color: color.RGBA{200, 100, 50, 255}},
+					}
+					want := applyConvolutionReference(im, kernel, opts)
+					got := ApplyConvolution(im, kernel, opts)
+					if got.Rect != want.Rect || !reflect.DeepEqual(got.Pix, want.Pix) {
+						t.Fatalf("%T %s %s kernel %v: result differs from reference", im, mode, normalization, kernel)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestApplySeparableConvolution(t *testing.T) {
+	im := randomImage(image.Rect(3, 5, 40, 30))
+	for _, kernel := range []SeparableKernel{GaussianKernel(1.5), BoxKernel(3), {[]float64{1, 2, 1}, []float64{-1, 0, 1}}} {
+		for _, mode := range BorderModes {
+			opts := ConvolutionOptions{Normalization: NormalizeSum, Border: Border{Mode: mode, Color: color.RGBA{200, 100, 50, 255}}}
+			want := ApplyConvolution(im, kernel.Kernel(), opts)
+			got := ApplySeparableConvolution(im, kernel, opts)
+			if got.Rect != want.Rect {
+				t.Fatalf("%s: got bounds %v, want %v", mode, got.Rect, want.Rect)
+			}
+			for k := range got.Pix {
+				if diff := int(got.Pix[k]) - int(want.Pix[k]); diff < -1 || diff > 1 {
+					t.Fatalf("%s kernel %v: byte %d is %d, want %d", mode, kernel, k, got.Pix[k], want.Pix[k])
+				}
+			}
+		}
+	}
+}
+
+func TestBlurKernelLimits(t *testing.T) {
+	for _, test := range []struct {
+		filter, param, value string
+		ok                   bool
+	}{
+		{"gaussian", "sigma", "100", true},
+		{"gaussian", "sigma", "100.5", false},
+		{"box", "radius", "300", true},
+		{"box", "radius", "301", false},
+		{"motionblur", "len", "300", true},
+		{"motionblur", "len", "301", false},
+	} {
+		f, _ := LookupFilter(test.filter)
+		_, err := ParseParams(f, func(name string) (string, bool) {
+			return test.value, name == test.param
+		})
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s=%s: got error %v", test.filter, test.param, test.value, err)
+		}
+	}
+}
+
+func TestFFTMatchesDirect(t *testing.T) {
+	defer func(threshold int) { fftThreshold = threshold }(fftThreshold)
+	im := randomImage(image.Rect(-3, 5, 150, 90))
+	for _, kernel := range []Kernel{EMBOSS_KERNEL, MotionBlurKernel(30, 31), MotionBlurKernel(-70, 20)[3:]} {
+		for _, mode := range BorderModes {
+			for _, normalization := range Normalizations {
+				opts := ConvolutionOptions{
+					Normalization: normalization,
+					Border:        Border{Mode: mode, Color: color.RGBA{200, 100, 50, 255}},
+				}
+				fftThreshold = math.MaxInt
+				want := ApplyConvolution(im, kernel, opts)
+				fftThreshold = 0
+				got := ApplyConvolution(im, kernel, opts)
+				if got.Rect != want.Rect {
+					t.Fatalf("%s %s: bounds differ: fft %v, direct %v", mode, normalization, got.Rect, want.Rect)
+				}
+				for k := 0; k < len(got.Pix); k += 2 {
+					g, w := int(got.Pix[k])<<8|int(got.Pix[k+1]), int(want.Pix[k])<<8|int(want.Pix[k+1])
+					if d := g - w; d < -1 || d > 1 {
+						t.Fatalf("%s %s %dx%d kernel: channel %d differs: fft %d, direct %d",
+							mode, normalization, len(kernel[0]), len(kernel), k/2, g, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkApplyConvolution(b *testing.B) {
+	im := randomImage(image.Rect(0, 0, 1024, 1024))
+	for _, kernel := range []struct {
+		name   string
+		kernel Kernel
+	}{
+		{"blur3x3", BLUR_KERNEL},
+		{"emboss3x3", EMBOSS_KERNEL},
+		{"gaussian13x13", GaussianKernel(2).Kernel()},
+		{"motionblur31x31", MotionBlurKernel(30, 31)},
+	} {
+		opts := ConvolutionOptions{Normalization: NormalizeSum}
+		b.Run(kernel.name+"/reference", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res := applyConvolutionReference(im, kernel.kernel, opts)
+				runtime.KeepAlive(res)
+			}
+		})
+		b.Run(kernel.name+"/engine", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res := ApplyConvolution(im, kernel.kernel, opts)
+				runtime.KeepAlive(res)
+			}
+		})
+	}
+}
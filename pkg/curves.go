@@ -236,21 +236,8 @@ func HilbertCurveFilter(im image.Image) *image.RGBA {
 	return himage
 }
 
-func HilbertCurve(sourceImageFilename, resultImageFilename string) error {
-	im, err := LoadImageFile(sourceImageFilename)
-	if err != nil {
-		return err
-	}
-	tmp := HilbertCurveFilter(im)
-	return saveImage(*tmp, resultImageFilename)
-}
-
 // TODO: extract and make blendings
-func HilbertDarken(sourceImageFilename, resultImageFilename string) error {
-	im, err := LoadImageFile(sourceImageFilename)
-	if err != nil {
-		return err
-	}
+func HilbertDarkenFilter(im image.Image) *image.RGBA {
 	tmp := HilbertCurveFilter(im)
 	for i := tmp.Bounds().Min.X; i < tmp.Bounds().Max.X; i++ {
 		for j := tmp.Bounds().Min.Y; j < tmp.Bounds().Max.Y; j++ {
@@ -260,7 +247,7 @@ func HilbertDarken(sourceImageFilename, resultImageFilename string) error {
 			}
 		}
 	}
-	return saveImage(*tmp, resultImageFilename)
+	return tmp
 }
 
 func ZCurveFilter(im image.Image) *image.RGBA {
@@ -274,12 +261,29 @@ func ZCurveFilter(im image.Image) *image.RGBA {
 	return himage
 }
 
-// TODO: extract repeating loading, saving image
-func ZCurve(sourceImageFilename, resultImageFilename string) error {
-	im, err := LoadImageFile(sourceImageFilename)
-	if err != nil {
-		return err
-	}
-	tmp := ZCurveFilter(im)
-	return saveImage(*tmp, resultImageFilename)
+func init() {
+	Register(&filter{
+		name:        "hilbert",
+		title:       "Hilbert curve",
+		description: "Draws hilbert curve only through points on dark areas.",
+		apply: func(im image.Image, _ Params) (image.Image, error) {
+			return HilbertCurveFilter(im), nil
+		},
+	})
+	Register(&filter{
+		name:        "hilbertdarken",
+		title:       "Hilbert darken",
+		description: "Darken(image, hilbert filter).",
+		apply: func(im image.Image, _ Params) (image.Image, error) {
+			return HilbertDarkenFilter(im), nil
+		},
+	})
+	Register(&filter{
+		name:        "zcurve",
+		title:       "Z curve",
+		description: "Draws Z curve only through points on dark areas.",
+		apply: func(im image.Image, _ Params) (image.Image, error) {
+			return ZCurveFilter(im), nil
+		},
+	})
 }
@@ -0,0 +1,256 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// GradientOperator is the kernel pair estimating derivatives of image along x and y axes
+type GradientOperator = string
+
+const (
+	GradientSobel   GradientOperator = "sobel"
+	GradientPrewitt GradientOperator = "prewitt"
+	GradientScharr  GradientOperator = "scharr"
+)
+
+var GradientOperators = []string{GradientSobel, GradientPrewitt, GradientScharr}
+
+// gradientKernels returns kernels of derivatives along x and y axes, y axis points down
+func gradientKernels(operator GradientOperator) (Kernel, Kernel) {
+	smooth := []float64{1, 2, 1}
+	switch operator {
+	case GradientPrewitt:
+		smooth = []float64{1, 1, 1}
+	case GradientScharr:
+		smooth = []float64{3, 10, 3}
+	}
+	kernelX := make(Kernel, 3)
+	for i, w := range smooth {
+		kernelX[i] = []float64{-w, 0, w}
+	}
+	kernelY := Kernel{
+		{-smooth[0], -smooth[1], -smooth[2]},
+		{0, 0, 0},
+		{smooth[0], smooth[1], smooth[2]},
+	}
+	return kernelX, kernelY
+}
+
+// gradient keeps derivatives of luminance in 0..255 scale, row by row
+type gradient struct {
+	bounds image.Rectangle
+	dx, dy []float64
+}
+
+func luminanceGradient(im image.Image, kernelX, kernelY Kernel, border Border) gradient {
+	luminance := func(responses [][3]float64) []float64 {
+		res := make([]float64, len(responses))
+		for k, p := range responses {
+			res[k] = (0.299*p[0] + 0.587*p[1] + 0.114*p[2]) / 0x101
+		}
+		return res
+	}
+	bounds, responsesX := convolveResponses(newConvolver(im, kernelX, border))
+	_, responsesY := convolveResponses(newConvolver(im, kernelY, border))
+	return gradient{bounds, luminance(responsesX), luminance(responsesY)}
+}
+
+func (g gradient) magnitudes() ([]float64, float64) {
+	res := make([]float64, len(g.dx))
+	maxMagnitude := 0.0
+	for k := range res {
+		res[k] = math.Hypot(g.dx[k], g.dy[k])
+		maxMagnitude = math.Max(maxMagnitude, res[k])
+	}
+	return res, maxMagnitude
+}
+
+// GradientMagnitude draws gradient magnitude stretched to full range, if direction is set
+// hue shows gradient direction counterclockwise from x axis
+func GradientMagnitude(im image.Image, operator GradientOperator, direction bool, border Border) image.NRGBA64 {
+	kernelX, kernelY := gradientKernels(operator)
+	g := luminanceGradient(im, kernelX, kernelY, border)
+	magnitudes, maxMagnitude := g.magnitudes()
+	res := image.NewNRGBA64(g.bounds)
+	for k, magnitude := range magnitudes {
+		value := stretch(magnitude, 0, maxMagnitude) / 0xFFFF
+		rgb := [3]float64{value, value, value}
+		if direction {
+			hue := math.Atan2(-g.dy[k], g.dx[k]) / (2 * math.Pi)
+			if hue < 0 {
+				hue++
+			}
+			rgb = hsvToRGB([3]float64{hue, 1, value})
+		}
+		setPixel16(res.Pix[k*8:], [4]uint16{clamp16(rgb[0] * 0xFFFF), clamp16(rgb[1] * 0xFFFF), clamp16(rgb[2] * 0xFFFF), 0xFFFF})
+	}
+	return *res
+}
+
+// Canny draws white one pixel wide edges on black. Image is blurred with Gaussian of given sigma (0 disables blur),
+// Sobel gradient magnitude is thinned by non-maximum suppression, then pixels above high threshold
+// and pixels above low threshold connected to them are kept.
+func Canny(im image.Image, sigma, low, high float64, border Border) image.RGBA {
+	kernelX, kernelY := gradientKernels(GradientSobel)
+	if sigma > 0 {
+		blur := GaussianKernel(sigma).Kernel()
+		kernelX, kernelY = composeKernels(blur, kernelX), composeKernels(blur, kernelY)
+	}
+	g := luminanceGradient(im, kernelX, kernelY, border)
+	magnitudes, _ := g.magnitudes()
+	width, height := g.bounds.Dx(), g.bounds.Dy()
+	magnitudeAt := func(x, y int) float64 {
+		if x < 0 || x >= width || y < 0 || y >= height {
+			return 0
+		}
+		return magnitudes[y*width+x]
+	}
+
+	// non-maximum suppression, neighbours are taken along gradient direction rounded to 45 degrees
+	thin := make([]float64, len(magnitudes))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			k := y*width + x
+			angle := math.Atan2(g.dy[k], g.dx[k]) * 180 / math.Pi
+			if angle < 0 {
+				angle += 180
+			}
+			var dx, dy int
+			switch {
+			case angle < 22.5 || angle >= 157.5:
+				dx, dy = 1, 0
+			case angle < 67.5:
+				dx, dy = 1, 1
+			case angle < 112.5:
+				dx, dy = 0, 1
+			default:
+				dx, dy = -1, 1
+			}
+			if magnitudes[k] > magnitudeAt(x+dx, y+dy) && magnitudes[k] >= magnitudeAt(x-dx, y-dy) {
+				thin[k] = magnitudes[k]
+			}
+		}
+	}
+
+	// hysteresis
+	edges := make([]bool, len(thin))
+	stack := []int{}
+	for k, magnitude := range thin {
+		if magnitude >= high && magnitude > 0 {
+			edges[k] = true
+			stack = append(stack, k)
+		}
+	}
+	for len(stack) > 0 {
+		k := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		x, y := k%width, k/width
+		for ny := max(y-1, 0); ny <= min(y+1, height-1); ny++ {
+			for nx := max(x-1, 0); nx <= min(x+1, width-1); nx++ {
+				n := ny*width + nx
+				if !edges[n] && thin[n] >= low && thin[n] > 0 {
+					edges[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+	}
+
+	res := image.NewRGBA(g.bounds)
+	for k, edge := range edges {
+		if edge {
+			res.Pix[k*4], res.Pix[k*4+1], res.Pix[k*4+2] = 255, 255, 255
+		}
+		res.Pix[k*4+3] = 255
+	}
+	return *res
+}
+
+func init() {
+	Register(&filter{
+		name:        "gradient",
+		title:       "Gradient magnitude",
+		description: "Detect edges as magnitude of brightness gradient, optionally colored by gradient direction.",
+		params: append([]Param{
+			{
+				Name:    "operator",
+				Alias:   "o",
+				Type:    ParamString,
+				Usage:   "kernels estimating derivatives",
+				Default: GradientSobel,
+				Choices: GradientOperators,
+			},
+			{
+				Name:    "coloring",
+				Alias:   "c",
+				Type:    ParamString,
+				Usage:   "gray shows magnitude only, direction also shows gradient direction as hue",
+				Default: "gray",
+				Choices: []string{"gray", "direction"},
+			},
+		}, borderParams()...),
+		validate: validateBorder,
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			border, err := borderFromParams(params)
+			if err != nil {
+				return nil, err
+			}
+			res := GradientMagnitude(im, params.String("operator"), params.String("coloring") == "direction", border)
+			if res.Bounds().Empty() {
+				return nil, errEmptyResult
+			}
+			return &res, nil
+		},
+	})
+	Register(&filter{
+		name:  "canny",
+		title: "Canny edge detector",
+		description: `Detect thin edges: blur image, find Sobel gradient, keep only its local maximums
+and trace edges from pixels above high threshold through pixels above low one.`,
+		params: append([]Param{
+			{
+				Name:    "sigma",
+				Alias:   "s",
+				Type:    ParamFloat,
+				Usage:   "standard deviation of Gaussian blur in pixels, 0 disables blur",
+				Default: 1.4,
+			},
+			{
+				Name:    "low",
+				Alias:   "l",
+				Type:    ParamFloat,
+				Usage:   "low threshold of gradient magnitude, sharp black to white step has magnitude 1020 without blur and about 520 with sigma 1.4, stronger blur lowers it",
+				Default: 40.0,
+			},
+			{
+				Name:    "high",
+				Alias:   "H",
+				Type:    ParamFloat,
+				Usage:   "high threshold of gradient magnitude",
+				Default: 80.0,
+			},
+		}, borderParams()...),
+		validate: func(params Params) error {
+			if sigma := params.Float("sigma"); sigma < 0 {
+				return fmt.Errorf("sigma must not be negative, you gave %v", sigma)
+			}
+			if low, high := params.Float("low"), params.Float("high"); low < 0 || low > high {
+				return fmt.Errorf("thresholds must satisfy 0 <= low <= high, you gave low=%v, high=%v", low, high)
+			}
+			return validateBorder(params)
+		},
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			border, err := borderFromParams(params)
+			if err != nil {
+				return nil, err
+			}
+			res := Canny(im, params.Float("sigma"), params.Float("low"), params.Float("high"), border)
+			if res.Bounds().Empty() {
+				return nil, errEmptyResult
+			}
+			return &res, nil
+		},
+	})
+}
@@ -0,0 +1,75 @@
+package fimgs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// stepImage is black on the left of x = step and white on the right
+func stepImage(r image.Rectangle, step int) *image.RGBA {
+	im := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if x >= step {
+				im.Set(x, y, color.White)
+			} else {
+				im.Set(x, y, color.Black)
+			}
+		}
+	}
+	return im
+}
+
+func TestGradientMagnitudeFlatImage(t *testing.T) {
+	im := stepImage(image.Rect(0, 0, 10, 10), 100)
+	for _, operator := range GradientOperators {
+		res := GradientMagnitude(im, operator, true, Border{})
+		for k := 0; k < len(res.Pix); k += 8 {
+			if c := res.Pix[k : k+6]; !bytes.Equal(c, make([]byte, 6)) {
+				t.Fatalf("%s: flat image must have no edges, got %v at %d", operator, c, k/8)
+			}
+		}
+	}
+}
+
+// TestStepMagnitude checks magnitudes of sharp step given in usage of canny thresholds
+func TestStepMagnitude(t *testing.T) {
+	for _, test := range []struct {
+		sigma, want float64
+	}{
+		{0, 1020},
+		{1.4, 520},
+	} {
+		kernelX, kernelY := gradientKernels(GradientSobel)
+		if test.sigma > 0 {
+			blur := GaussianKernel(test.sigma).Kernel()
+			kernelX, kernelY = composeKernels(blur, kernelX), composeKernels(blur, kernelY)
+		}
+		g := luminanceGradient(stepImage(image.Rect(0, 0, 40, 20), 20), kernelX, kernelY, Border{})
+		if _, magnitude := g.magnitudes(); math.Abs(magnitude-test.want) > 10 {
+			t.Errorf("sigma %v: step has magnitude %v, want about %v", test.sigma, magnitude, test.want)
+		}
+	}
+}
+
+func TestCannyStep(t *testing.T) {
+	r := image.Rect(-5, 3, 35, 23)
+	res := Canny(stepImage(r, 15), 1.4, 40, 80, Border{})
+	if res.Rect != r {
+		t.Fatalf("bounds changed: %v", res.Rect)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		edges := []int{}
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if res.RGBAAt(x, y).R != 0 {
+				edges = append(edges, x)
+			}
+		}
+		if len(edges) != 1 || (edges[0] != 14 && edges[0] != 15) {
+			t.Fatalf("row %d must have single edge pixel at the step, got %v", y, edges)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package fimgs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// ImageFormat is file format of saved image
+type ImageFormat = string
+
+const (
+	FormatPNG  ImageFormat = "png"
+	FormatJPEG ImageFormat = "jpeg"
+	FormatGIF  ImageFormat = "gif"
+	FormatBMP  ImageFormat = "bmp"
+	FormatTIFF ImageFormat = "tiff"
+)
+
+var ImageFormats = []string{FormatPNG, FormatJPEG, FormatGIF, FormatBMP, FormatTIFF}
+
+var formatExtensions = map[string]ImageFormat{
+	".png":  FormatPNG,
+	".jpg":  FormatJPEG,
+	".jpeg": FormatJPEG,
+	".gif":  FormatGIF,
+	".bmp":  FormatBMP,
+	".tif":  FormatTIFF,
+	".tiff": FormatTIFF,
+}
+
+// FormatFromFilename returns format by filename extension, ok is false if extension is unknown
+func FormatFromFilename(filename string) (_ ImageFormat, ok bool) {
+	format, ok := formatExtensions[strings.ToLower(filepath.Ext(filename))]
+	return format, ok
+}
+
+// ContentType returns MIME type of format
+func ContentType(format ImageFormat) string {
+	return "image/" + format
+}
+
+// PNGCompression is compression level of PNG
+type PNGCompression = string
+
+const (
+	CompressionDefault PNGCompression = "default"
+	CompressionNone    PNGCompression = "none"
+	CompressionFast    PNGCompression = "fast"
+	CompressionBest    PNGCompression = "best"
+)
+
+var PNGCompressions = []string{CompressionDefault, CompressionNone, CompressionFast, CompressionBest}
+
+var pngCompressionLevels = map[PNGCompression]png.CompressionLevel{
+	CompressionDefault: png.DefaultCompression,
+	CompressionNone:    png.NoCompression,
+	CompressionFast:    png.BestSpeed,
+	CompressionBest:    png.BestCompression,
+}
+
+// SaveOptions set how saved image is encoded, zero values mean defaults
+type SaveOptions struct {
+	// Format of image, empty means format by filename extension or PNG
+	Format ImageFormat
+	// Depth is number of bits per channel of PNG and TIFF, 8 or 16, zero means 8. Paletted images are saved as is unless depth is 16.
+	Depth int
+	// Quality of JPEG, 1..100, must be set for JPEG, other formats ignore zero quality
+	Quality int
+	// Colors is palette size of GIF, 2..256, zero means 256
+	Colors int
+	// Compression of PNG
+	Compression PNGCompression
+}
+
+func (opts SaveOptions) Validate() error {
+	switch {
+	case opts.Format != "" && !slices.Contains(ImageFormats, opts.Format):
+		return fmt.Errorf("unknown image format %q, must be one of %s", opts.Format, strings.Join(ImageFormats, ", "))
+	case opts.Depth != 0 && opts.Depth != 8 && opts.Depth != 16:
+		return fmt.Errorf("depth must be 8 or 16, you gave %d", opts.Depth)
+	case opts.Depth == 16 && opts.Format != "" && opts.Format != FormatPNG && opts.Format != FormatTIFF:
+		return fmt.Errorf("16-bit depth is supported by png and tiff only, not %s", opts.Format)
+	case opts.Quality < 0 || opts.Quality > 100 || opts.Quality == 0 && opts.Format == FormatJPEG:
+		return fmt.Errorf("quality must be in 1..100, you gave %d", opts.Quality)
+	case opts.Colors != 0 && (opts.Colors < 2 || opts.Colors > 256):
+		return fmt.Errorf("colors must be in 2..256, you gave %d", opts.Colors)
+	case opts.Compression != "" && !slices.Contains(PNGCompressions, opts.Compression):
+		return fmt.Errorf("compression must be one of %s, you gave %q", strings.Join(PNGCompressions, ", "), opts.Compression)
+	}
+	return nil
+}
+
+// gifPaletted dithers image to palette of at most colors colors clustered by KMeans. GIF has no partial
+// transparency, so if image isn't opaque, pixels which aren't fully opaque get reserved transparent color.
+func gifPaletted(im image.Image, colors int) *image.Paletted {
+	if paletted, ok := im.(*image.Paletted); ok && len(paletted.Palette) <= colors {
+		return paletted
+	}
+	var palette color.Palette
+	if isOpaque(im) {
+		palette = ApplyKMeans(im, colors, KMeansOptions{}).Palette
+	} else {
+		bounds := im.Bounds()
+		masked := image.NewNRGBA64(bounds)
+		for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+			for i := bounds.Min.X; i < bounds.Max.X; i++ {
+				if c := color.NRGBA64Model.Convert(im.At(i, j)).(color.NRGBA64); c.A == 0xFFFF {
+					masked.SetNRGBA64(i, j, c)
+				}
+			}
+		}
+		im = masked
+		palette = append(ApplyKMeans(im, colors-1, KMeansOptions{}).Palette, color.Transparent)
+	}
+	res := image.NewPaletted(im.Bounds(), palette)
+	draw.FloydSteinberg.Draw(res, res.Rect, im, im.Bounds().Min)
+	return res
+}
+
+// EncodeImage writes image in format of opts, PNG by default. Metadata is saved as PNG text chunks,
+// other formats drop it.
+func EncodeImage(w io.Writer, im image.Image, opts SaveOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	im, metadata := SplitMetadata(im)
+	switch opts.Format {
+	case FormatJPEG:
+		return jpeg.Encode(w, im, &jpeg.Options{Quality: opts.Quality})
+	case FormatGIF:
+		colors := opts.Colors
+		if colors == 0 {
+			colors = 256
+		}
+		return gif.Encode(w, gifPaletted(im, colors), &gif.Options{NumColors: colors})
+	case FormatBMP:
+		return bmp.Encode(w, withDepth(im, 8))
+	case FormatTIFF:
+		return tiff.Encode(w, withDepth(im, opts.Depth), &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+	default:
+		var encoded bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: pngCompressionLevels[opts.Compression]}
+		if err := encoder.Encode(&encoded, withDepth(im, opts.Depth)); err != nil {
+			return err
+		}
+		_, err := w.Write(pngWithText(encoded.Bytes(), metadata))
+		return err
+	}
+}
+
+// SaveImageFileOptions saves image encoded with opts, format is chosen by filename extension if opts have none
+func SaveImageFileOptions(im image.Image, imageFilename string, opts SaveOptions) error {
+	if opts.Format == "" {
+		opts.Format, _ = FormatFromFilename(imageFilename)
+	}
+	var encoded bytes.Buffer
+	if err := EncodeImage(&encoded, im, opts); err != nil {
+		return err
+	}
+	return os.WriteFile(imageFilename, encoded.Bytes(), 0o644)
+}
+
+// withDepth converts image to 8 or 16 bits per channel non-premultiplied colors, if it has other depth
+func withDepth(im image.Image, depth int) image.Image {
+	var res draw.Image
+	switch im.(type) {
+	case *image.Gray, *image.RGBA, *image.NRGBA, *image.Paletted:
+		if depth != 16 {
+			return im
+		}
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		if depth == 16 {
+			return im
+		}
+	}
+	if depth == 16 {
+		res = image.NewNRGBA64(im.Bounds())
+	} else {
+		res = image.NewNRGBA(im.Bounds())
+	}
+	draw.Draw(res, res.Bounds(), im, im.Bounds().Min, draw.Src)
+	return res
+}
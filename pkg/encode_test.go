@@ -0,0 +1,97 @@
+package fimgs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeImageFormats(t *testing.T) {
+	im := randomImage(image.Rect(0, 0, 16, 8))
+	for _, format := range ImageFormats {
+		var encoded bytes.Buffer
+		if err := EncodeImage(&encoded, im, SaveOptions{Format: format, Quality: 90, Colors: 16}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		config, decodedFormat, err := image.DecodeConfig(&encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if decodedFormat != format || config.Width != 16 || config.Height != 8 {
+			t.Fatalf("%s: decoded as %s %dx%d", format, decodedFormat, config.Width, config.Height)
+		}
+	}
+}
+
+func TestEncodeImageOptions(t *testing.T) {
+	im := randomImage(image.Rect(0, 0, 64, 64))
+	sizes := map[PNGCompression]int{}
+	for _, compression := range []PNGCompression{CompressionNone, CompressionBest} {
+		var encoded bytes.Buffer
+		if err := EncodeImage(&encoded, im, SaveOptions{Compression: compression}); err != nil {
+			t.Fatal(err)
+		}
+		sizes[compression] = encoded.Len()
+	}
+	if sizes[CompressionBest] >= sizes[CompressionNone] {
+		t.Errorf("best compression gives %d bytes, no compression %d", sizes[CompressionBest], sizes[CompressionNone])
+	}
+
+	var encoded bytes.Buffer
+	if err := EncodeImage(&encoded, im, SaveOptions{Format: FormatGIF, Colors: 4}); err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if palette, ok := config.ColorModel.(color.Palette); !ok || len(palette) > 4 {
+		t.Fatalf("gif palette must have at most 4 colors, got %v", config.ColorModel)
+	}
+
+	for _, opts := range []SaveOptions{
+		{Format: "webp"},
+		{Format: FormatJPEG, Depth: 16},
+		{Quality: 101},
+		{Format: FormatJPEG},
+		{Colors: 1},
+		{Compression: "max"},
+	} {
+		if err := EncodeImage(&encoded, im, opts); err == nil {
+			t.Errorf("expected error for %+v", opts)
+		}
+	}
+}
+
+func TestEncodeGIFTransparency(t *testing.T) {
+	im := image.NewNRGBA(image.Rect(0, 0, 12, 4))
+	for x := 0; x < 12; x++ {
+		for y := 0; y < 4; y++ {
+			im.SetNRGBA(x, y, color.NRGBA{uint8(x * 20), 100, uint8(y * 60), []uint8{0, 128, 255}[x%3]})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := EncodeImage(&encoded, im, SaveOptions{Format: FormatGIF, Colors: 4}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeImage(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if palette := decoded.ColorModel().(color.Palette); len(palette) > 4 {
+		t.Fatalf("gif palette must have at most 4 colors, got %d", len(palette))
+	}
+	for x := 0; x < 12; x++ {
+		for y := 0; y < 4; y++ {
+			_, _, _, a := decoded.At(x, y).RGBA()
+			want := uint32(0)
+			if x%3 == 2 {
+				want = 0xFFFF
+			}
+			if a != want {
+				t.Fatalf("pixel (%d, %d) has alpha %#x, want %#x", x, y, a, want)
+			}
+		}
+	}
+}
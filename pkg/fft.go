@@ -0,0 +1,149 @@
+package fimgs
+
+import (
+	"math"
+	"math/bits"
+	"math/cmplx"
+)
+
+// fftPlan precomputes data for 2D FFT of size x size matrices, size must be power of 2
+type fftPlan struct {
+	size     int
+	twiddles []complex128
+	reversed []int
+}
+
+func newFFTPlan(size int) *fftPlan {
+	p := &fftPlan{
+		size:     size,
+		twiddles: make([]complex128, size/2),
+		reversed: make([]int, size),
+	}
+	for k := range p.twiddles {
+		p.twiddles[k] = cmplx.Exp(complex(0, -2*math.Pi*float64(k)/float64(size)))
+	}
+	shift := bits.UintSize - bits.Len(uint(size-1))
+	for i := range p.reversed {
+		p.reversed[i] = int(bits.Reverse(uint(i)) >> shift)
+	}
+	return p
+}
+
+// transform computes discrete Fourier transform of x in place, inverse transform is not scaled
+func (p *fftPlan) transform(x []complex128, inverse bool) {
+	for i, j := range p.reversed {
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for half := 1; half < p.size; half *= 2 {
+		step := p.size / (2 * half)
+		for start := 0; start < p.size; start += 2 * half {
+			for k := 0; k < half; k++ {
+				w := p.twiddles[k*step]
+				if inverse {
+					w = cmplx.Conj(w)
+				}
+				a, b := x[start+k], x[start+k+half]*w
+				x[start+k], x[start+k+half] = a+b, a-b
+			}
+		}
+	}
+}
+
+// transform2D computes 2D Fourier transform of size x size matrix stored row by row,
+// column is buffer of size elements
+func (p *fftPlan) transform2D(data, column []complex128, inverse bool) {
+	for y := 0; y < p.size; y++ {
+		p.transform(data[y*p.size:(y+1)*p.size], inverse)
+	}
+	for x := 0; x < p.size; x++ {
+		for y := range column {
+			column[y] = data[y*p.size+x]
+		}
+		p.transform(column, inverse)
+		for y, v := range column {
+			data[y*p.size+x] = v
+		}
+	}
+}
+
+// fftThreshold is minimal area of non-separable kernel applied using FFT
+var fftThreshold = 15 * 15
+
+// fftConvolution keeps spectrum of kernel for applying it to tiles of image using overlap-save method
+type fftConvolution struct {
+	plan *fftPlan
+	// conjugated spectrum of kernel, so product with tile spectrum gives correlation
+	kernel []complex128
+}
+
+func newFFTConvolution(kernel Kernel) *fftConvolution {
+	size := 64
+	for size < 2*max(len(kernel), len(kernel[0])) {
+		size *= 2
+	}
+	f := &fftConvolution{
+		plan:   newFFTPlan(size),
+		kernel: make([]complex128, size*size),
+	}
+	for di, row := range kernel {
+		for dj, w := range row {
+			f.kernel[di*size+dj] = complex(w, 0)
+		}
+	}
+	f.plan.transform2D(f.kernel, make([]complex128, size), false)
+	for k, v := range f.kernel {
+		f.kernel[k] = cmplx.Conj(v)
+	}
+	return f
+}
+
+// fftWorker returns function computing responses of result row j into dst. Responses are computed by strips
+// of tiles, red and green channels are transformed together as real and imaginary parts.
+func (c *convolver) fftWorker() func(j int, dst [][3]float64) {
+	size := c.fft.plan.size
+	kernelWidth, kernelHeight := len(c.kernel[0]), len(c.kernel)
+	tileWidth, tileHeight := size-kernelWidth+1, size-kernelHeight+1
+	width := c.bounds.Dx()
+	redGreen := make([]complex128, size*size)
+	blue := make([]complex128, size*size)
+	column := make([]complex128, size)
+	strip := make([][3]float64, tileHeight*width)
+	stripStart, stripEnd := -1, -1
+	scale := 1 / float64(size*size)
+	return func(j int, dst [][3]float64) {
+		r := j - c.bounds.Min.Y
+		if r < stripStart || r >= stripEnd {
+			stripStart, stripEnd = r, min(r+tileHeight, c.bounds.Dy())
+			for x0 := 0; x0 < width; x0 += tileWidth {
+				w := min(tileWidth, width-x0)
+				clear(redGreen)
+				clear(blue)
+				for y := 0; y < stripEnd-stripStart+kernelHeight-1; y++ {
+					yOffset := c.yOffsets[stripStart+y]
+					for x := 0; x < w+kernelWidth-1; x++ {
+						p := c.pixel(c.xOffsets[x0+x], yOffset)
+						redGreen[y*size+x] = complex(p[0], p[1])
+						blue[y*size+x] = complex(p[2], 0)
+					}
+				}
+				c.fft.plan.transform2D(redGreen, column, false)
+				c.fft.plan.transform2D(blue, column, false)
+				for k, v := range c.fft.kernel {
+					redGreen[k] *= v
+					blue[k] *= v
+				}
+				c.fft.plan.transform2D(redGreen, column, true)
+				c.fft.plan.transform2D(blue, column, true)
+				for y := 0; y < stripEnd-stripStart; y++ {
+					for x := 0; x < w; x++ {
+						rg, b := redGreen[y*size+x], blue[y*size+x]
+						strip[y*width+x0+x] = [3]float64{real(rg) * scale, imag(rg) * scale, real(b) * scale}
+					}
+				}
+			}
+		}
+		copy(dst, strip[(r-stripStart)*width:(r-stripStart+1)*width])
+	}
+}
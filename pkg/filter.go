@@ -0,0 +1,178 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ParamType int
+
+const (
+	ParamInt ParamType = iota
+	ParamFloat
+	ParamString
+	// ParamText is multiline text, e.g. shader source. CLI reads it from file.
+	ParamText
+	// ParamFile is contents of file, e.g. image. CLI reads it from file, web server doesn't accept it.
+	ParamFile
+)
+
+func (t ParamType) parse(s string) (any, error) {
+	switch t {
+	case ParamInt:
+		return strconv.Atoi(s)
+	case ParamFloat:
+		return strconv.ParseFloat(s, 64)
+	case ParamString, ParamText, ParamFile:
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown param type %d", t)
+	}
+}
+
+// Param describes single filter parameter.
+type Param struct {
+	Name  string
+	Alias string // short name, used in CLI
+	Type  ParamType
+	Usage string
+	// Default value of type corresponding to Type, nil means param is required
+	Default any
+	// Choices restricts ParamString values, empty means any value is allowed
+	Choices []string
+	// Repeated param can be given several times in CLI and pipelines, values are joined by newlines
+	Repeated bool
+}
+
+type Params map[string]any
+
+// ParamError is error of Apply caused by params, which can't be checked before image is processed,
+// e.g. shader uniforms not used by shader
+type ParamError struct {
+	Err error
+}
+
+func (e ParamError) Error() string { return e.Err.Error() }
+func (e ParamError) Unwrap() error { return e.Err }
+
+func (p Params) Int(name string) int {
+	return p[name].(int)
+}
+
+func (p Params) Float(name string) float64 {
+	return p[name].(float64)
+}
+
+func (p Params) String(name string) string {
+	return p[name].(string)
+}
+
+type Filter interface {
+	// Name is used as CLI subcommand and web route
+	Name() string
+	// Title is human readable name
+	Title() string
+	Description() string
+	Params() []Param
+	Validate(Params) error
+	Apply(image.Image, Params) (image.Image, error)
+}
+
+type filter struct {
+	name        string
+	title       string
+	description string
+	params      []Param
+	validate    func(Params) error
+	apply       func(image.Image, Params) (image.Image, error)
+	// filtersAlpha reports whether apply processes transparency itself, otherwise apply gets opaque image
+	// of non-premultiplied colors and source alpha is put back into result. Nil means false.
+	filtersAlpha func(Params) bool
+}
+
+func (f *filter) Name() string        { return f.name }
+func (f *filter) Title() string       { return f.title }
+func (f *filter) Description() string { return f.description }
+func (f *filter) Params() []Param     { return f.params }
+
+func (f *filter) Validate(params Params) error {
+	if f.validate == nil {
+		return nil
+	}
+	return f.validate(params)
+}
+
+func (f *filter) Apply(im image.Image, params Params) (image.Image, error) {
+	if isOpaque(im) || f.filtersAlpha != nil && f.filtersAlpha(params) {
+		return f.apply(im, params)
+	}
+	opaque, alpha := splitAlpha(im)
+	res, err := f.apply(opaque, params)
+	if err != nil {
+		return nil, err
+	}
+	return mergeAlpha(res, alpha), nil
+}
+
+// filtersAlphaParam is filtersAlpha of filters having alphaParam
+func filtersAlphaParam(params Params) bool {
+	return params.String("alpha") == AlphaFilter
+}
+
+var registry = map[string]Filter{}
+
+// Register makes filter available to CLI and web server, panics if filter with same name is registered already.
+func Register(f Filter) {
+	if _, ok := registry[f.Name()]; ok {
+		panic(fmt.Sprintf("filter %q is already registered", f.Name()))
+	}
+	registry[f.Name()] = f
+}
+
+func LookupFilter(name string) (Filter, bool) {
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Filters returns all registered filters sorted by name.
+func Filters() []Filter {
+	res := make([]Filter, 0, len(registry))
+	for _, f := range registry {
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res
+}
+
+// ParseParams parses raw param values using lookup, fills missing ones with defaults and validates them.
+func ParseParams(f Filter, lookup func(name string) (string, bool)) (Params, error) {
+	params := make(Params, len(f.Params()))
+	for _, param := range f.Params() {
+		raw, ok := lookup(param.Name)
+		if !ok {
+			if param.Default == nil {
+				return nil, fmt.Errorf("%q is not provided", param.Name)
+			}
+			params[param.Name] = param.Default
+			continue
+		}
+		value, err := param.Type.parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing parameter %q:\n%q", param.Name, err)
+		}
+		if len(param.Choices) > 0 && !slices.Contains(param.Choices, raw) {
+			return nil, fmt.Errorf("%q must be one of %s, you gave %q", param.Name, strings.Join(param.Choices, ", "), raw)
+		}
+		params[param.Name] = value
+	}
+	if err := f.Validate(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
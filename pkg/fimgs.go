@@ -1,35 +1,114 @@
 package fimgs
 
 import (
+	"bufio"
+	"fmt"
 	"image"
-	_ "image/jpeg"
-	"image/png"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 type Color = [3]int
 
-func LoadImageFile(image_filename string) (im image.Image, err error) {
-	imageFile, err := os.Open(image_filename)
+// FormatWebP can be loaded, but not saved
+const FormatWebP ImageFormat = "webp"
+
+// InputFormats are formats of images which can be loaded
+var InputFormats = []string{FormatPNG, FormatJPEG, FormatGIF, FormatBMP, FormatTIFF, FormatWebP}
+
+// formatMagics are first bytes of encoded images, "?" matches any byte
+var formatMagics = []struct {
+	format ImageFormat
+	magic  string
+}{
+	{FormatPNG, "\x89PNG\r\n\x1a\n"},
+	{FormatJPEG, "\xff\xd8\xff"},
+	{FormatGIF, "GIF87a"},
+	{FormatGIF, "GIF89a"},
+	{FormatBMP, "BM????\x00\x00\x00\x00"},
+	{FormatTIFF, "II*\x00"},
+	{FormatTIFF, "MM\x00*"},
+	{FormatWebP, "RIFF????WEBPVP8"},
+}
+
+// DetectFormat returns format of encoded image by its first bytes, at least 512 bytes are enough.
+// Error names content type of data if it is not an image of one of InputFormats.
+func DetectFormat(header []byte) (ImageFormat, error) {
+	for _, m := range formatMagics {
+		if len(header) < len(m.magic) {
+			continue
+		}
+		matches := true
+		for k := 0; k < len(m.magic); k++ {
+			if m.magic[k] != '?' && m.magic[k] != header[k] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return m.format, nil
+		}
+	}
+	return "", fmt.Errorf("data is %s, not an image of supported format: %s", http.DetectContentType(header), strings.Join(InputFormats, ", "))
+}
+
+// DecodeImage decodes image of format detected by its content
+func DecodeImage(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	format, err := DetectFormat(header)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer imageFile.Close()
-	im, _, err = image.Decode(imageFile)
+	im, _, err := image.Decode(br)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("invalid %s image: %w", format, err)
+	}
+	return im, nil
+}
+
+// IsImageFilename reports whether filename has extension of one of InputFormats
+func IsImageFilename(filename string) bool {
+	if _, ok := FormatFromFilename(filename); ok {
+		return true
 	}
-	return
+	return strings.EqualFold(filepath.Ext(filename), ".webp")
 }
 
-func saveImage(im image.RGBA, imageFilename string) (err error) {
-	imageFile, err := os.Create(imageFilename)
+func LoadImageFile(image_filename string) (im image.Image, err error) {
+	imageFile, err := os.Open(image_filename)
 	if err != nil {
 		return
 	}
 	defer imageFile.Close()
-	if err = png.Encode(imageFile, &im); err != nil {
-		return err
+	return DecodeImage(imageFile)
+}
+
+// ParseHexColor parses colors like "#ff8000" or "ff8000"
+func ParseHexColor(s string) (color.RGBA, error) {
+	var c color.RGBA
+	if _, err := fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &c.R, &c.G, &c.B); err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return c, fmt.Errorf("invalid color %q, expected hex like #ff8000", s)
 	}
-	return
+	c.A = 255
+	return c, nil
+}
+
+// SaveImageFile saves image in format chosen by filename extension, PNG if it is unknown, JPEG has default quality
+func SaveImageFile(im image.Image, imageFilename string) error {
+	return SaveImageFileOptions(im, imageFilename, SaveOptions{Quality: jpeg.DefaultQuality})
 }
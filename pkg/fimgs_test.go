@@ -0,0 +1,83 @@
+package fimgs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveImageFileDepth(t *testing.T) {
+	im := image.NewNRGBA64(image.Rect(0, 0, 2, 2))
+	im.SetNRGBA64(1, 1, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xFFFF})
+	for _, test := range []struct {
+		depth int
+		want  color.RGBA64
+	}{
+		{0, color.RGBA64{0x1212, 0x5656, 0x9a9a, 0xFFFF}},
+		{8, color.RGBA64{0x1212, 0x5656, 0x9a9a, 0xFFFF}},
+		{16, color.RGBA64{0x1234, 0x5678, 0x9abc, 0xFFFF}},
+	} {
+		filename := filepath.Join(t.TempDir(), "res.png")
+		if err := SaveImageFileOptions(im, filename, SaveOptions{Depth: test.depth}); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := LoadImageFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.RGBA64Model.Convert(saved.At(1, 1)); got != test.want {
+			t.Errorf("depth %d: got %v, want %v", test.depth, got, test.want)
+		}
+	}
+}
+
+func TestBlurKeeps16Bit(t *testing.T) {
+	// gradient too smooth for 8 bits, every 8-bit level is shared by 16 columns
+	im := image.NewGray16(image.Rect(0, 0, 64, 3))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 3; y++ {
+			im.SetGray16(x, y, color.Gray16{uint16(0x8000 + x*0x10)})
+		}
+	}
+	res := ApplyConvolution(im, Kernel{{1, 1, 1}}, ConvolutionOptions{Normalization: NormalizeSum, Border: Border{Mode: BorderCrop}})
+	for x := 1; x < 63; x++ {
+		if got, want := res.NRGBA64At(x, 1).R, uint16(0x8000+x*0x10); got != want {
+			t.Fatalf("pixel %d: got %#x, want %#x", x, got, want)
+		}
+	}
+}
+
+func TestDecodeImageFormats(t *testing.T) {
+	im := randomImage(image.Rect(0, 0, 16, 8))
+	for _, format := range ImageFormats {
+		var encoded bytes.Buffer
+		if err := EncodeImage(&encoded, im, SaveOptions{Format: format, Quality: 90}); err != nil {
+			t.Fatal(err)
+		}
+		if detected, err := DetectFormat(encoded.Bytes()); err != nil || detected != format {
+			t.Fatalf("%s: detected %q, error %v", format, detected, err)
+		}
+		decoded, err := DecodeImage(&encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if decoded.Bounds() != im.Bounds() {
+			t.Fatalf("%s: decoded bounds %v", format, decoded.Bounds())
+		}
+	}
+
+	// 1x1 lossless webp
+	webp, _ := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	if decoded, err := DecodeImage(bytes.NewReader(webp)); err != nil || decoded.Bounds() != image.Rect(0, 0, 1, 1) {
+		t.Fatalf("webp: %v", err)
+	}
+
+	_, err := DecodeImage(strings.NewReader("<!DOCTYPE html><html><body>Not found</body></html>"))
+	if err == nil || !strings.Contains(err.Error(), "text/html") {
+		t.Fatalf("error must name received content type, got %v", err)
+	}
+}
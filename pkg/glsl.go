@@ -0,0 +1,1846 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Compiler of GLSL fragment shaders subset into Go closures run by cpuShader for every pixel.
+// Supported are bool, int, float, vectors, square matrices and sampler2D types, uniforms, global
+// variables and constants, functions with in, out and inout params, if, for, while, do-while, break,
+// continue, return, discard, ?:, swizzles, indexing, object-like #define and common built-in functions.
+// Arrays, structs, bool vectors, bitwise operators and conditional compilation are not supported.
+// Values are computed in float32 like on GPU, ints are stored as floats too.
+
+type glslKind uint8
+
+const (
+	glslVoid glslKind = iota
+	glslBool
+	glslInt
+	glslFloat
+	glslMat
+	glslSampler
+)
+
+// glslType is scalar or vector of size components or matrix of size columns and rows
+type glslType struct {
+	kind glslKind
+	size int
+}
+
+var glslTypes = map[string]glslType{
+	"void":      {glslVoid, 0},
+	"bool":      {glslBool, 1},
+	"int":       {glslInt, 1},
+	"ivec2":     {glslInt, 2},
+	"ivec3":     {glslInt, 3},
+	"ivec4":     {glslInt, 4},
+	"float":     {glslFloat, 1},
+	"vec2":      {glslFloat, 2},
+	"vec3":      {glslFloat, 3},
+	"vec4":      {glslFloat, 4},
+	"mat2":      {glslMat, 2},
+	"mat3":      {glslMat, 3},
+	"mat4":      {glslMat, 4},
+	"sampler2D": {glslSampler, 1},
+}
+
+var (
+	glslBoolType  = glslType{glslBool, 1}
+	glslIntType   = glslType{glslInt, 1}
+	glslFloatType = glslType{glslFloat, 1}
+	glslVec4Type  = glslType{glslFloat, 4}
+)
+
+var glslKeywords = []string{
+	"if", "else", "for", "while", "do", "return", "break", "continue", "discard", "true", "false",
+	"const", "uniform", "in", "out", "inout", "struct", "precision", "highp", "mediump", "lowp", "layout",
+}
+
+func (t glslType) String() string {
+	for name, typ := range glslTypes {
+		if typ == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("type %d of size %d", t.kind, t.size)
+}
+
+// components is number of values of type, matrices are stored by columns
+func (t glslType) components() int {
+	if t.kind == glslMat {
+		return t.size * t.size
+	}
+	return t.size
+}
+
+func (t glslType) isNumeric() bool {
+	return t.kind == glslInt || t.kind == glslFloat || t.kind == glslMat
+}
+
+func (t glslType) isScalar() bool {
+	return t.kind != glslMat && t.size == 1
+}
+
+type glslValue [16]float32
+
+func glslBoolValue(b bool) glslValue {
+	if b {
+		return glslValue{1}
+	}
+	return glslValue{}
+}
+
+// glslRuntimeError is panicked by shader running on CPU, e.g. on index out of range, and recovered by cpuShader
+type glslRuntimeError string
+
+// glslMaxIterations limits loops, so shader with endless loop fails instead of hanging
+const glslMaxIterations = 1 << 20
+
+func glslErrorf(line int, format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+type glslTokenKind uint8
+
+const (
+	glslEOF glslTokenKind = iota
+	glslIdent
+	glslNumber
+	glslPunct
+)
+
+type glslToken struct {
+	kind glslTokenKind
+	text string
+	line int
+}
+
+// glslPuncts are operators and separators, longer ones go first
+var glslPuncts = []string{
+	"++", "--", "+=", "-=", "*=", "/=", "%=", "==", "!=", "<=", ">=", "&&", "||", "^^",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "?", ":", ";", ",", ".", "(", ")", "{", "}", "[", "]",
+}
+
+func isGLSLLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isGLSLDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// glslTokenize splits source into tokens, skipping comments and expanding macros
+func glslTokenize(source string, macros map[string][]glslToken, line int) ([]glslToken, error) {
+	tokens := []glslToken{}
+	lineStart := true
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+			lineStart = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end == -1 {
+				return nil, glslErrorf(line, "unterminated comment")
+			}
+			line += strings.Count(source[i:i+2+end], "\n")
+			i += end + 4
+			continue
+		case c == '#' && lineStart:
+			end := strings.IndexByte(source[i:], '\n')
+			if end == -1 {
+				end = len(source) - i
+			}
+			if err := glslDirective(source[i+1:i+end], macros, line); err != nil {
+				return nil, err
+			}
+			i += end
+			continue
+		case isGLSLLetter(c):
+			j := i
+			for j < len(source) && (isGLSLLetter(source[j]) || isGLSLDigit(source[j])) {
+				j++
+			}
+			word := source[i:j]
+			if body, ok := macros[word]; ok {
+				for _, token := range body {
+					token.line = line
+					tokens = append(tokens, token)
+				}
+			} else {
+				tokens = append(tokens, glslToken{glslIdent, word, line})
+			}
+			i = j
+		case isGLSLDigit(c) || c == '.' && i+1 < len(source) && isGLSLDigit(source[i+1]):
+			j := glslScanNumber(source, i)
+			tokens = append(tokens, glslToken{glslNumber, source[i:j], line})
+			i = j
+		default:
+			k := slices.IndexFunc(glslPuncts, func(punct string) bool { return strings.HasPrefix(source[i:], punct) })
+			if k == -1 {
+				return nil, glslErrorf(line, "unexpected character %q", c)
+			}
+			tokens = append(tokens, glslToken{glslPunct, glslPuncts[k], line})
+			i += len(glslPuncts[k])
+		}
+		lineStart = false
+	}
+	return tokens, nil
+}
+
+// glslScanNumber returns end of number starting at i, e.g. 1, 0x1F, 1., .5, 1.5e-3 or 1.0f
+func glslScanNumber(source string, i int) int {
+	if strings.HasPrefix(source[i:], "0x") || strings.HasPrefix(source[i:], "0X") {
+		i += 2
+		for i < len(source) && strings.IndexByte("0123456789abcdefABCDEF", source[i]) != -1 {
+			i++
+		}
+		return i
+	}
+	digits := func() {
+		for i < len(source) && isGLSLDigit(source[i]) {
+			i++
+		}
+	}
+	digits()
+	if i < len(source) && source[i] == '.' {
+		i++
+		digits()
+	}
+	if i < len(source) && (source[i] == 'e' || source[i] == 'E') {
+		j := i + 1
+		if j < len(source) && (source[j] == '+' || source[j] == '-') {
+			j++
+		}
+		if j < len(source) && isGLSLDigit(source[j]) {
+			i = j
+			digits()
+		}
+	}
+	if i < len(source) && (source[i] == 'f' || source[i] == 'F') {
+		i++
+	}
+	return i
+}
+
+// glslDirective handles preprocessor directive, only object-like macros are supported
+func glslDirective(directive string, macros map[string][]glslToken, line int) error {
+	name, rest, _ := strings.Cut(strings.TrimSpace(directive), " ")
+	switch name {
+	case "", "version", "extension", "pragma":
+		return nil
+	case "define":
+		rest = strings.TrimSpace(rest)
+		end := 0
+		for end < len(rest) && (isGLSLLetter(rest[end]) || isGLSLDigit(rest[end])) {
+			end++
+		}
+		if end == 0 {
+			return glslErrorf(line, "macro name expected")
+		}
+		if end < len(rest) && rest[end] == '(' {
+			return glslErrorf(line, "function-like macros are not supported")
+		}
+		body, err := glslTokenize(rest[end:], macros, line)
+		if err != nil {
+			return err
+		}
+		macros[rest[:end]] = body
+		return nil
+	case "undef":
+		delete(macros, strings.TrimSpace(rest))
+		return nil
+	default:
+		return glslErrorf(line, "directive #%s is not supported", name)
+	}
+}
+
+type glslCtrl uint8
+
+const (
+	glslNext glslCtrl = iota
+	glslBreak
+	glslContinue
+	glslReturn
+	glslDiscard
+)
+
+type glslStmt func(*glslState) glslCtrl
+
+type glslExpr struct {
+	typ  glslType
+	eval func(*glslState) glslValue
+	// set is not nil for expressions which can be assigned
+	set func(*glslState, glslValue)
+}
+
+type glslVar struct {
+	typ      glslType
+	global   bool
+	slot     int
+	readOnly bool
+	// used is set when variable is referenced, unused uniforms are not active like in GL
+	used bool
+}
+
+func (v *glslVar) expr() glslExpr {
+	slot := v.slot
+	e := glslExpr{typ: v.typ}
+	if v.global {
+		e.eval = func(s *glslState) glslValue { return s.globals[slot] }
+		e.set = func(s *glslState, x glslValue) { s.globals[slot] = x }
+	} else {
+		e.eval = func(s *glslState) glslValue { return s.stack[s.base+slot] }
+		e.set = func(s *glslState, x glslValue) { s.stack[s.base+slot] = x }
+	}
+	if v.readOnly {
+		e.set = nil
+	}
+	return e
+}
+
+// init returns statement setting variable to value of initializer or to zero if it is nil
+func (v *glslVar) init(initializer func(*glslState) glslValue) glslStmt {
+	slot := v.slot
+	global := v.global
+	return func(s *glslState) glslCtrl {
+		var x glslValue
+		if initializer != nil {
+			x = initializer(s)
+		}
+		if global {
+			s.globals[slot] = x
+		} else {
+			s.stack[s.base+slot] = x
+		}
+		return glslNext
+	}
+}
+
+type glslParam struct {
+	typ glslType
+	in  bool
+	out bool
+}
+
+type glslFunc struct {
+	name   string
+	ret    glslType
+	params []glslParam
+	// locals is number of stack slots used by function, params take first ones
+	locals int
+	body   glslStmt
+	// calls are functions called by this one, used to forbid recursion
+	calls []*glslFunc
+	used  bool
+}
+
+// glslUniform is uniform variable, its value is set before rendering
+type glslUniform struct {
+	typ  glslType
+	slot int
+}
+
+type glslProgram struct {
+	globals int
+	// init sets global variables before main is run
+	init      []glslStmt
+	main      *glslFunc
+	fragCoord int
+	output    int
+	// texCoord is slot of texture coordinates input or -1 if shader does not use them
+	texCoord int
+	// uniforms are active uniforms, i.e. ones used by shader
+	uniforms map[string]glslUniform
+}
+
+type glslCompiler struct {
+	tokens []glslToken
+	pos    int
+	scopes []map[string]*glslVar
+	funcs  map[string][]*glslFunc
+	// fn is function being compiled, nil for global declarations
+	fn *glslFunc
+	// loops is depth of loops, break and continue are allowed inside loops only
+	loops int
+	prog  *glslProgram
+}
+
+// compileGLSL compiles fragment shader source. Shader gets texture coordinates as "in vec2 outTexCoords"
+// and writes result into gl_FragColor or its own "out vec4" variable.
+func compileGLSL(source string) (*glslProgram, error) {
+	tokens, err := glslTokenize(source, map[string][]glslToken{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	c := &glslCompiler{
+		tokens: append(tokens, glslToken{glslEOF, "", strings.Count(source, "\n") + 1}),
+		scopes: []map[string]*glslVar{{}},
+		funcs:  map[string][]*glslFunc{},
+		prog:   &glslProgram{output: -1, texCoord: -1, uniforms: map[string]glslUniform{}},
+	}
+	fragCoord, _ := c.declare("gl_FragCoord", glslVec4Type, true)
+	c.prog.fragCoord = fragCoord.slot
+	fragColor, _ := c.declare("gl_FragColor", glslVec4Type, false)
+	for c.peek().kind != glslEOF {
+		if err := c.topLevel(); err != nil {
+			return nil, err
+		}
+	}
+	if c.prog.output == -1 {
+		c.prog.output = fragColor.slot
+	}
+	for _, overloads := range c.funcs {
+		for _, f := range overloads {
+			if f.used && f.body == nil {
+				return nil, fmt.Errorf("function %q is declared, but not defined", f.name)
+			}
+			if err := glslCheckRecursion(f, nil); err != nil {
+				return nil, err
+			}
+			if f.name == "main" && len(f.params) == 0 && f.body != nil {
+				c.prog.main = f
+			}
+		}
+	}
+	if c.prog.main == nil {
+		return nil, fmt.Errorf("function main is not defined")
+	}
+	for name := range c.prog.uniforms {
+		if !c.scopes[0][name].used {
+			delete(c.prog.uniforms, name)
+		}
+	}
+	return c.prog, nil
+}
+
+func glslCheckRecursion(f *glslFunc, stack []*glslFunc) error {
+	if slices.Contains(stack, f) {
+		return fmt.Errorf("function %q is recursive, recursion is not allowed", f.name)
+	}
+	for _, callee := range f.calls {
+		if err := glslCheckRecursion(callee, append(stack, f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *glslCompiler) peek() glslToken {
+	return c.tokens[c.pos]
+}
+
+func (c *glslCompiler) next() glslToken {
+	t := c.tokens[c.pos]
+	if t.kind != glslEOF {
+		c.pos++
+	}
+	return t
+}
+
+func (c *glslCompiler) is(text string) bool {
+	t := c.peek()
+	return (t.kind == glslIdent || t.kind == glslPunct) && t.text == text
+}
+
+func (c *glslCompiler) accept(text string) bool {
+	if c.is(text) {
+		c.pos++
+		return true
+	}
+	return false
+}
+
+func (c *glslCompiler) errorf(format string, args ...any) error {
+	return glslErrorf(c.peek().line, format, args...)
+}
+
+func (c *glslCompiler) unexpected() error {
+	if t := c.peek(); t.kind != glslEOF {
+		return c.errorf("unexpected %q", t.text)
+	}
+	return c.errorf("unexpected end of source")
+}
+
+func (c *glslCompiler) expect(text string) error {
+	if !c.accept(text) {
+		if t := c.peek(); t.kind != glslEOF {
+			return c.errorf("expected %q, got %q", text, t.text)
+		}
+		return c.errorf("expected %q, got end of source", text)
+	}
+	return nil
+}
+
+func (c *glslCompiler) ident() (string, error) {
+	t := c.peek()
+	if t.kind != glslIdent || slices.Contains(glslKeywords, t.text) {
+		return "", c.unexpected()
+	}
+	if _, ok := glslTypes[t.text]; ok {
+		return "", c.errorf("type %s can't be used as name", t.text)
+	}
+	c.next()
+	return t.text, nil
+}
+
+func (c *glslCompiler) isType() bool {
+	t := c.peek()
+	_, ok := glslTypes[t.text]
+	return t.kind == glslIdent && ok
+}
+
+func (c *glslCompiler) typeName() (glslType, error) {
+	if c.is("struct") {
+		return glslType{}, c.errorf("structs are not supported")
+	}
+	if !c.isType() {
+		return glslType{}, c.errorf("type expected, got %q", c.peek().text)
+	}
+	return glslTypes[c.next().text], nil
+}
+
+func (c *glslCompiler) skipPrecision() {
+	for c.accept("highp") || c.accept("mediump") || c.accept("lowp") {
+	}
+}
+
+func (c *glslCompiler) pushScope() {
+	c.scopes = append(c.scopes, map[string]*glslVar{})
+}
+
+func (c *glslCompiler) popScope() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *glslCompiler) lookup(name string) (*glslVar, bool) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if v, ok := c.scopes[i][name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (c *glslCompiler) declare(name string, typ glslType, readOnly bool) (*glslVar, error) {
+	scope := c.scopes[len(c.scopes)-1]
+	if _, ok := scope[name]; ok {
+		return nil, c.errorf("redefinition of %q", name)
+	}
+	v := &glslVar{typ: typ, readOnly: readOnly}
+	if c.fn == nil {
+		v.global = true
+		v.slot = c.prog.globals
+		c.prog.globals++
+	} else {
+		v.slot = c.fn.locals
+		c.fn.locals++
+	}
+	scope[name] = v
+	return v, nil
+}
+
+// convert checks that value of e can be stored in variable of type typ, ints are converted to floats
+func (c *glslCompiler) convert(e glslExpr, typ glslType, line int) (glslExpr, error) {
+	if e.typ == typ || typ.kind == glslFloat && e.typ.kind == glslInt && typ.size == e.typ.size {
+		e.typ = typ
+		return e, nil
+	}
+	return glslExpr{}, glslErrorf(line, "can't convert %s to %s", e.typ, typ)
+}
+
+func (c *glslCompiler) topLevel() error {
+	if c.accept(";") {
+		return nil
+	}
+	if c.accept("precision") {
+		for !c.accept(";") {
+			if c.next().kind == glslEOF {
+				return c.unexpected()
+			}
+		}
+		return nil
+	}
+	if c.accept("layout") {
+		if err := c.expect("("); err != nil {
+			return err
+		}
+		for !c.accept(")") {
+			if c.next().kind == glslEOF {
+				return c.unexpected()
+			}
+		}
+	}
+	qualifier := ""
+	for _, q := range []string{"uniform", "in", "out", "const"} {
+		if c.accept(q) {
+			qualifier = q
+			break
+		}
+	}
+	c.skipPrecision()
+	line := c.peek().line
+	typ, err := c.typeName()
+	if err != nil {
+		return err
+	}
+	name, err := c.ident()
+	if err != nil {
+		return err
+	}
+	if c.is("(") {
+		if qualifier != "" {
+			return c.errorf("function can't be %s", qualifier)
+		}
+		return c.function(typ, name)
+	}
+	if typ.kind == glslSampler && qualifier != "uniform" {
+		return glslErrorf(line, "sampler2D must be uniform")
+	}
+	switch qualifier {
+	case "uniform":
+		for {
+			v, err := c.declare(name, typ, true)
+			if err != nil {
+				return err
+			}
+			c.prog.uniforms[name] = glslUniform{typ, v.slot}
+			if !c.accept(",") {
+				break
+			}
+			if name, err = c.ident(); err != nil {
+				return err
+			}
+		}
+		return c.expect(";")
+	case "in":
+		if typ != (glslType{glslFloat, 2}) || name != "outTexCoords" {
+			return glslErrorf(line, "only input is vec2 outTexCoords, %s %s is not given by vertex shader", typ, name)
+		}
+		v, err := c.declare(name, typ, true)
+		if err != nil {
+			return err
+		}
+		c.prog.texCoord = v.slot
+		return c.expect(";")
+	case "out":
+		if typ != glslVec4Type {
+			return glslErrorf(line, "output must be vec4, not %s", typ)
+		}
+		v, err := c.declare(name, typ, false)
+		if err != nil {
+			return err
+		}
+		c.prog.output = v.slot
+		return c.expect(";")
+	default:
+		init, err := c.declarations(typ, name, qualifier == "const", line)
+		if err != nil {
+			return err
+		}
+		c.prog.init = append(c.prog.init, init)
+		return nil
+	}
+}
+
+// declarations compiles declarators of variables after first name, e.g. "= 1., b;" of "float a = 1., b;"
+func (c *glslCompiler) declarations(typ glslType, name string, readOnly bool, line int) (glslStmt, error) {
+	if typ.kind == glslVoid || typ.kind == glslSampler {
+		return nil, glslErrorf(line, "variable can't be %s", typ)
+	}
+	stmts := []glslStmt{}
+	for {
+		if c.is("[") {
+			return nil, c.errorf("arrays are not supported")
+		}
+		var initializer func(*glslState) glslValue
+		if c.accept("=") {
+			line := c.peek().line
+			e, err := c.assignment()
+			if err != nil {
+				return nil, err
+			}
+			if e, err = c.convert(e, typ, line); err != nil {
+				return nil, err
+			}
+			initializer = e.eval
+		} else if readOnly {
+			return nil, c.errorf("const %q must be initialized", name)
+		}
+		// variable is declared after initializer, so it can't refer to itself
+		v, err := c.declare(name, typ, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, v.init(initializer))
+		if !c.accept(",") {
+			break
+		}
+		if name, err = c.ident(); err != nil {
+			return nil, err
+		}
+	}
+	return glslBlock(stmts), c.expect(";")
+}
+
+func (c *glslCompiler) function(ret glslType, name string) error {
+	line := c.peek().line
+	if _, ok := glslBuiltins[name]; ok {
+		return glslErrorf(line, "redefinition of built-in function %q", name)
+	}
+	if err := c.expect("("); err != nil {
+		return err
+	}
+	params := []glslParam{}
+	names := []string{}
+	if c.is("void") && c.tokens[c.pos+1].text == ")" {
+		c.next()
+	}
+	for !c.accept(")") {
+		if len(params) > 0 {
+			if err := c.expect(","); err != nil {
+				return err
+			}
+		}
+		c.accept("const")
+		param := glslParam{in: true}
+		if c.accept("out") {
+			param = glslParam{out: true}
+		} else if c.accept("inout") {
+			param = glslParam{in: true, out: true}
+		} else {
+			c.accept("in")
+		}
+		c.skipPrecision()
+		typ, err := c.typeName()
+		if err != nil {
+			return err
+		}
+		if typ.kind == glslVoid {
+			return c.errorf("param can't be void")
+		}
+		param.typ = typ
+		paramName := ""
+		if c.peek().kind == glslIdent {
+			if paramName, err = c.ident(); err != nil {
+				return err
+			}
+		}
+		if c.is("[") {
+			return c.errorf("arrays are not supported")
+		}
+		params = append(params, param)
+		names = append(names, paramName)
+	}
+
+	var f *glslFunc
+	for _, overload := range c.funcs[name] {
+		if slices.Equal(overload.params, params) {
+			f = overload
+		}
+	}
+	switch {
+	case f == nil:
+		f = &glslFunc{name: name, ret: ret, params: params}
+		c.funcs[name] = append(c.funcs[name], f)
+	case f.ret != ret:
+		return glslErrorf(line, "function %q is declared with other return type", name)
+	case f.body != nil && c.is("{"):
+		return glslErrorf(line, "redefinition of function %q", name)
+	}
+	if name == "main" && (ret.kind != glslVoid || len(params) != 0) {
+		return glslErrorf(line, "main must be void main()")
+	}
+	if c.accept(";") {
+		return nil
+	}
+
+	c.fn = f
+	defer func() { c.fn = nil }()
+	c.pushScope()
+	defer c.popScope()
+	for i, paramName := range names {
+		if paramName == "" {
+			f.locals++
+			continue
+		}
+		if _, err := c.declare(paramName, params[i].typ, false); err != nil {
+			return err
+		}
+	}
+	body, err := c.block()
+	if err != nil {
+		return err
+	}
+	f.body = body
+	return nil
+}
+
+func glslBlock(stmts []glslStmt) glslStmt {
+	if len(stmts) == 1 {
+		return stmts[0]
+	}
+	return func(s *glslState) glslCtrl {
+		for _, stmt := range stmts {
+			if ctrl := stmt(s); ctrl != glslNext {
+				return ctrl
+			}
+		}
+		return glslNext
+	}
+}
+
+func (c *glslCompiler) block() (glslStmt, error) {
+	if err := c.expect("{"); err != nil {
+		return nil, err
+	}
+	c.pushScope()
+	defer c.popScope()
+	stmts := []glslStmt{}
+	for !c.accept("}") {
+		if c.peek().kind == glslEOF {
+			return nil, c.unexpected()
+		}
+		stmt, err := c.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	return glslBlock(stmts), nil
+}
+
+// scopedStatement compiles statement in its own scope, e.g. body of if or loop
+func (c *glslCompiler) scopedStatement() (glslStmt, error) {
+	c.pushScope()
+	defer c.popScope()
+	return c.statement()
+}
+
+func (c *glslCompiler) condition() (func(*glslState) glslValue, error) {
+	line := c.peek().line
+	cond, err := c.expression()
+	if err != nil {
+		return nil, err
+	}
+	if cond.typ != glslBoolType {
+		return nil, glslErrorf(line, "condition must be bool, not %s", cond.typ)
+	}
+	return cond.eval, nil
+}
+
+func (c *glslCompiler) isDeclaration() bool {
+	if c.is("const") || c.is("highp") || c.is("mediump") || c.is("lowp") || c.is("struct") {
+		return true
+	}
+	return c.isType() && c.tokens[c.pos+1].kind == glslIdent
+}
+
+func (c *glslCompiler) declaration() (glslStmt, error) {
+	readOnly := c.accept("const")
+	c.skipPrecision()
+	line := c.peek().line
+	typ, err := c.typeName()
+	if err != nil {
+		return nil, err
+	}
+	name, err := c.ident()
+	if err != nil {
+		return nil, err
+	}
+	return c.declarations(typ, name, readOnly, line)
+}
+
+func (c *glslCompiler) statement() (glslStmt, error) {
+	line := c.peek().line
+	switch {
+	case c.is("{"):
+		return c.block()
+	case c.accept(";"):
+		return func(*glslState) glslCtrl { return glslNext }, nil
+	case c.accept("if"):
+		if err := c.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := c.condition()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.expect(")"); err != nil {
+			return nil, err
+		}
+		then, err := c.scopedStatement()
+		if err != nil {
+			return nil, err
+		}
+		otherwise := func(*glslState) glslCtrl { return glslNext }
+		if c.accept("else") {
+			if otherwise, err = c.scopedStatement(); err != nil {
+				return nil, err
+			}
+		}
+		return func(s *glslState) glslCtrl {
+			if cond(s)[0] != 0 {
+				return then(s)
+			}
+			return otherwise(s)
+		}, nil
+	case c.accept("for"):
+		return c.forLoop()
+	case c.accept("while"):
+		if err := c.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := c.condition()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := c.loopBody()
+		if err != nil {
+			return nil, err
+		}
+		return glslLoop(cond, nil, body, true), nil
+	case c.accept("do"):
+		body, err := c.loopBody()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.expect("while"); err != nil {
+			return nil, err
+		}
+		if err := c.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := c.condition()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.expect(")"); err != nil {
+			return nil, err
+		}
+		return glslLoop(cond, nil, body, false), c.expect(";")
+	case c.accept("return"):
+		if c.fn.ret.kind == glslVoid {
+			if !c.is(";") {
+				return nil, glslErrorf(line, "void function %q can't return value", c.fn.name)
+			}
+			return func(*glslState) glslCtrl { return glslReturn }, c.expect(";")
+		}
+		e, err := c.expression()
+		if err != nil {
+			return nil, err
+		}
+		if e, err = c.convert(e, c.fn.ret, line); err != nil {
+			return nil, err
+		}
+		eval := e.eval
+		return func(s *glslState) glslCtrl {
+			s.ret = eval(s)
+			return glslReturn
+		}, c.expect(";")
+	case c.accept("break"):
+		if c.loops == 0 {
+			return nil, glslErrorf(line, "break outside of loop")
+		}
+		return func(*glslState) glslCtrl { return glslBreak }, c.expect(";")
+	case c.accept("continue"):
+		if c.loops == 0 {
+			return nil, glslErrorf(line, "continue outside of loop")
+		}
+		return func(*glslState) glslCtrl { return glslContinue }, c.expect(";")
+	case c.accept("discard"):
+		return func(s *glslState) glslCtrl {
+			s.discarded = true
+			return glslDiscard
+		}, c.expect(";")
+	case c.isDeclaration():
+		return c.declaration()
+	default:
+		e, err := c.expression()
+		if err != nil {
+			return nil, err
+		}
+		eval := e.eval
+		return func(s *glslState) glslCtrl {
+			eval(s)
+			return glslNext
+		}, c.expect(";")
+	}
+}
+
+func (c *glslCompiler) loopBody() (glslStmt, error) {
+	c.loops++
+	defer func() { c.loops-- }()
+	return c.scopedStatement()
+}
+
+func (c *glslCompiler) forLoop() (glslStmt, error) {
+	if err := c.expect("("); err != nil {
+		return nil, err
+	}
+	c.pushScope()
+	defer c.popScope()
+	var init glslStmt
+	switch {
+	case c.accept(";"):
+	case c.isDeclaration():
+		stmt, err := c.declaration()
+		if err != nil {
+			return nil, err
+		}
+		init = stmt
+	default:
+		e, err := c.expression()
+		if err != nil {
+			return nil, err
+		}
+		eval := e.eval
+		init = func(s *glslState) glslCtrl {
+			eval(s)
+			return glslNext
+		}
+		if err := c.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+	var cond, step func(*glslState) glslValue
+	if !c.is(";") {
+		var err error
+		if cond, err = c.condition(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.expect(";"); err != nil {
+		return nil, err
+	}
+	if !c.is(")") {
+		e, err := c.expression()
+		if err != nil {
+			return nil, err
+		}
+		step = e.eval
+	}
+	if err := c.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := c.loopBody()
+	if err != nil {
+		return nil, err
+	}
+	loop := glslLoop(cond, step, body, true)
+	if init == nil {
+		return loop, nil
+	}
+	return func(s *glslState) glslCtrl {
+		init(s)
+		return loop(s)
+	}, nil
+}
+
+// glslLoop runs body while cond is true, cond is checked before first iteration if checkFirst is set
+func glslLoop(cond, step func(*glslState) glslValue, body glslStmt, checkFirst bool) glslStmt {
+	return func(s *glslState) glslCtrl {
+		for i := 0; ; i++ {
+			if i == glslMaxIterations {
+				panic(glslRuntimeError(fmt.Sprintf("loop has more than %d iterations", glslMaxIterations)))
+			}
+			if (checkFirst || i > 0) && cond != nil && cond(s)[0] == 0 {
+				return glslNext
+			}
+			switch body(s) {
+			case glslBreak:
+				return glslNext
+			case glslReturn:
+				return glslReturn
+			case glslDiscard:
+				return glslDiscard
+			}
+			if step != nil {
+				step(s)
+			}
+		}
+	}
+}
+
+func (c *glslCompiler) expression() (glslExpr, error) {
+	return c.assignment()
+}
+
+func (c *glslCompiler) assignment() (glslExpr, error) {
+	lhs, err := c.conditional()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	t := c.peek()
+	if t.kind != glslPunct || !slices.Contains([]string{"=", "+=", "-=", "*=", "/=", "%="}, t.text) {
+		return lhs, nil
+	}
+	c.next()
+	if lhs.set == nil {
+		return glslExpr{}, glslErrorf(t.line, "left side of %s can't be assigned", t.text)
+	}
+	rhs, err := c.assignment()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	if t.text != "=" {
+		if rhs, err = c.binary(t.text[:1], lhs, rhs, t.line); err != nil {
+			return glslExpr{}, err
+		}
+	}
+	if rhs, err = c.convert(rhs, lhs.typ, t.line); err != nil {
+		return glslExpr{}, err
+	}
+	eval, set := rhs.eval, lhs.set
+	return glslExpr{typ: lhs.typ, eval: func(s *glslState) glslValue {
+		x := eval(s)
+		set(s, x)
+		return x
+	}}, nil
+}
+
+// unify returns common type of a and b, ints are converted to floats
+func unify(a, b glslType) (glslType, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case a.size == b.size && (a.kind == glslInt && b.kind == glslFloat || a.kind == glslFloat && b.kind == glslInt):
+		return glslType{glslFloat, a.size}, true
+	}
+	return glslType{}, false
+}
+
+func (c *glslCompiler) conditional() (glslExpr, error) {
+	cond, err := c.binaryLevel(0)
+	if err != nil || !c.is("?") {
+		return cond, err
+	}
+	line := c.next().line
+	if cond.typ != glslBoolType {
+		return glslExpr{}, glslErrorf(line, "condition must be bool, not %s", cond.typ)
+	}
+	a, err := c.expression()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	if err := c.expect(":"); err != nil {
+		return glslExpr{}, err
+	}
+	b, err := c.assignment()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	typ, ok := unify(a.typ, b.typ)
+	if !ok {
+		return glslExpr{}, glslErrorf(line, "branches of ?: have different types %s and %s", a.typ, b.typ)
+	}
+	condEval, aEval, bEval := cond.eval, a.eval, b.eval
+	return glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+		if condEval(s)[0] != 0 {
+			return aEval(s)
+		}
+		return bEval(s)
+	}}, nil
+}
+
+// glslBinaryLevels are binary operators from lowest precedence to highest
+var glslBinaryLevels = [][]string{
+	{"||"}, {"^^"}, {"&&"}, {"==", "!="}, {"<", ">", "<=", ">="}, {"+", "-"}, {"*", "/", "%"},
+}
+
+func (c *glslCompiler) binaryLevel(level int) (glslExpr, error) {
+	if level == len(glslBinaryLevels) {
+		return c.unary()
+	}
+	lhs, err := c.binaryLevel(level + 1)
+	if err != nil {
+		return glslExpr{}, err
+	}
+	for {
+		t := c.peek()
+		if t.kind != glslPunct || !slices.Contains(glslBinaryLevels[level], t.text) {
+			return lhs, nil
+		}
+		c.next()
+		rhs, err := c.binaryLevel(level + 1)
+		if err != nil {
+			return glslExpr{}, err
+		}
+		if lhs, err = c.binary(t.text, lhs, rhs, t.line); err != nil {
+			return glslExpr{}, err
+		}
+	}
+}
+
+func (c *glslCompiler) binary(op string, a, b glslExpr, line int) (glslExpr, error) {
+	ae, be := a.eval, b.eval
+	switch op {
+	case "||", "&&", "^^":
+		if a.typ != glslBoolType || b.typ != glslBoolType {
+			return glslExpr{}, glslErrorf(line, "%s needs bool operands, not %s and %s", op, a.typ, b.typ)
+		}
+		var eval func(*glslState) glslValue
+		switch op {
+		case "||":
+			eval = func(s *glslState) glslValue {
+				if ae(s)[0] != 0 {
+					return glslBoolValue(true)
+				}
+				return be(s)
+			}
+		case "&&":
+			eval = func(s *glslState) glslValue {
+				if ae(s)[0] == 0 {
+					return glslBoolValue(false)
+				}
+				return be(s)
+			}
+		default:
+			eval = func(s *glslState) glslValue { return glslBoolValue(ae(s)[0] != be(s)[0]) }
+		}
+		return glslExpr{typ: glslBoolType, eval: eval}, nil
+	case "==", "!=":
+		typ, ok := unify(a.typ, b.typ)
+		if !ok || typ.kind == glslSampler || typ.kind == glslVoid {
+			return glslExpr{}, glslErrorf(line, "can't compare %s and %s", a.typ, b.typ)
+		}
+		n, equal := typ.components(), op == "=="
+		return glslExpr{typ: glslBoolType, eval: func(s *glslState) glslValue {
+			x, y := ae(s), be(s)
+			return glslBoolValue(slices.Equal(x[:n], y[:n]) == equal)
+		}}, nil
+	case "<", ">", "<=", ">=":
+		if !a.typ.isScalar() || !b.typ.isScalar() || !a.typ.isNumeric() || !b.typ.isNumeric() {
+			return glslExpr{}, glslErrorf(line, "%s needs scalar operands, not %s and %s", op, a.typ, b.typ)
+		}
+		var less func(x, y float32) bool
+		switch op {
+		case "<":
+			less = func(x, y float32) bool { return x < y }
+		case ">":
+			less = func(x, y float32) bool { return x > y }
+		case "<=":
+			less = func(x, y float32) bool { return x <= y }
+		default:
+			less = func(x, y float32) bool { return x >= y }
+		}
+		return glslExpr{typ: glslBoolType, eval: func(s *glslState) glslValue { return glslBoolValue(less(ae(s)[0], be(s)[0])) }}, nil
+	default:
+		e, err := glslArith(op, a, b)
+		if err != nil {
+			return glslExpr{}, glslErrorf(line, "%s", err)
+		}
+		return e, nil
+	}
+}
+
+// glslArith compiles arithmetic operator, it is componentwise except of matrix products
+func glslArith(op string, a, b glslExpr) (glslExpr, error) {
+	ta, tb := a.typ, b.typ
+	if !ta.isNumeric() || !tb.isNumeric() {
+		return glslExpr{}, fmt.Errorf("%s needs numeric operands, not %s and %s", op, ta, tb)
+	}
+	if op == "%" && (ta.kind != glslInt || tb.kind != glslInt) {
+		return glslExpr{}, fmt.Errorf("%% needs int operands, not %s and %s", ta, tb)
+	}
+	kind := glslInt
+	if ta.kind != glslInt || tb.kind != glslInt {
+		kind = glslFloat
+	}
+	ae, be := a.eval, b.eval
+	if op == "*" && (ta.kind == glslMat || tb.kind == glslMat) && !ta.isScalar() && !tb.isScalar() {
+		n := max(ta.size, tb.size)
+		switch {
+		case ta == tb:
+			return glslExpr{typ: ta, eval: func(s *glslState) glslValue {
+				x, y := ae(s), be(s)
+				var r glslValue
+				for col := 0; col < n; col++ {
+					for row := 0; row < n; row++ {
+						var sum float32
+						for k := 0; k < n; k++ {
+							sum += x[k*n+row] * y[col*n+k]
+						}
+						r[col*n+row] = sum
+					}
+				}
+				return r
+			}}, nil
+		case ta.kind == glslMat && tb.kind != glslMat && tb.size == n:
+			return glslExpr{typ: glslType{glslFloat, n}, eval: func(s *glslState) glslValue {
+				m, v := ae(s), be(s)
+				var r glslValue
+				for row := 0; row < n; row++ {
+					for k := 0; k < n; k++ {
+						r[row] += m[k*n+row] * v[k]
+					}
+				}
+				return r
+			}}, nil
+		case tb.kind == glslMat && ta.kind != glslMat && ta.size == n:
+			return glslExpr{typ: glslType{glslFloat, n}, eval: func(s *glslState) glslValue {
+				v, m := ae(s), be(s)
+				var r glslValue
+				for col := 0; col < n; col++ {
+					for k := 0; k < n; k++ {
+						r[col] += v[k] * m[col*n+k]
+					}
+				}
+				return r
+			}}, nil
+		}
+		return glslExpr{}, fmt.Errorf("can't multiply %s by %s", ta, tb)
+	}
+
+	var typ glslType
+	switch {
+	case ta.isScalar():
+		typ = tb
+	case tb.isScalar():
+		typ = ta
+	case ta.kind == glslMat || tb.kind == glslMat:
+		if ta != tb {
+			return glslExpr{}, fmt.Errorf("%s needs operands of the same type, not %s and %s", op, ta, tb)
+		}
+		typ = ta
+	case ta.size == tb.size:
+		typ = ta
+	default:
+		return glslExpr{}, fmt.Errorf("%s needs operands of the same size, not %s and %s", op, ta, tb)
+	}
+	if typ.kind != glslMat {
+		typ.kind = kind
+	}
+	var f func(x, y float32) float32
+	switch {
+	case op == "+":
+		f = func(x, y float32) float32 { return x + y }
+	case op == "-":
+		f = func(x, y float32) float32 { return x - y }
+	case op == "*":
+		f = func(x, y float32) float32 { return x * y }
+	case op == "/" && kind == glslFloat:
+		f = func(x, y float32) float32 { return x / y }
+	default:
+		f = func(x, y float32) float32 {
+			if y == 0 {
+				return 0 // undefined in GLSL
+			}
+			if op == "%" {
+				return float32(int64(x) % int64(y))
+			}
+			return float32(int64(x) / int64(y))
+		}
+	}
+	n := typ.components()
+	scalarA, scalarB := ta.isScalar(), tb.isScalar()
+	return glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+		x, y := ae(s), be(s)
+		var r glslValue
+		for i := 0; i < n; i++ {
+			xi, yi := x[i], y[i]
+			if scalarA {
+				xi = x[0]
+			}
+			if scalarB {
+				yi = y[0]
+			}
+			r[i] = f(xi, yi)
+		}
+		return r
+	}}, nil
+}
+
+func (c *glslCompiler) unary() (glslExpr, error) {
+	t := c.peek()
+	if t.kind != glslPunct || !slices.Contains([]string{"-", "+", "!", "++", "--"}, t.text) {
+		return c.postfix()
+	}
+	c.next()
+	e, err := c.unary()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	eval := e.eval
+	switch t.text {
+	case "!":
+		if e.typ != glslBoolType {
+			return glslExpr{}, glslErrorf(t.line, "! needs bool operand, not %s", e.typ)
+		}
+		return glslExpr{typ: e.typ, eval: func(s *glslState) glslValue { return glslBoolValue(eval(s)[0] == 0) }}, nil
+	case "+":
+		if !e.typ.isNumeric() {
+			return glslExpr{}, glslErrorf(t.line, "+ needs numeric operand, not %s", e.typ)
+		}
+		return glslExpr{typ: e.typ, eval: eval}, nil
+	case "-":
+		if !e.typ.isNumeric() {
+			return glslExpr{}, glslErrorf(t.line, "- needs numeric operand, not %s", e.typ)
+		}
+		n := e.typ.components()
+		return glslExpr{typ: e.typ, eval: func(s *glslState) glslValue {
+			x := eval(s)
+			for i := 0; i < n; i++ {
+				x[i] = -x[i]
+			}
+			return x
+		}}, nil
+	default:
+		return glslIncrement(e, t.text, true, t.line)
+	}
+}
+
+// glslIncrement compiles ++ and --, prefix ones return new value and postfix ones return old value
+func glslIncrement(e glslExpr, op string, prefix bool, line int) (glslExpr, error) {
+	if !e.typ.isNumeric() || e.set == nil {
+		return glslExpr{}, glslErrorf(line, "%s needs numeric variable", op)
+	}
+	var delta float32 = 1
+	if op == "--" {
+		delta = -1
+	}
+	eval, set, n := e.eval, e.set, e.typ.components()
+	return glslExpr{typ: e.typ, eval: func(s *glslState) glslValue {
+		old := eval(s)
+		x := old
+		for i := 0; i < n; i++ {
+			x[i] += delta
+		}
+		set(s, x)
+		if prefix {
+			return x
+		}
+		return old
+	}}, nil
+}
+
+func (c *glslCompiler) postfix() (glslExpr, error) {
+	e, err := c.primary()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	for {
+		t := c.peek()
+		switch {
+		case c.accept("."):
+			name := c.peek()
+			if name.kind != glslIdent {
+				return glslExpr{}, c.unexpected()
+			}
+			c.next()
+			if e, err = glslSwizzle(e, name.text, name.line); err != nil {
+				return glslExpr{}, err
+			}
+		case c.accept("["):
+			index, err := c.expression()
+			if err != nil {
+				return glslExpr{}, err
+			}
+			if err := c.expect("]"); err != nil {
+				return glslExpr{}, err
+			}
+			if e, err = glslIndex(e, index, t.line); err != nil {
+				return glslExpr{}, err
+			}
+		case c.is("++") || c.is("--"):
+			c.next()
+			if e, err = glslIncrement(e, t.text, false, t.line); err != nil {
+				return glslExpr{}, err
+			}
+		default:
+			return e, nil
+		}
+	}
+}
+
+var glslSwizzleSets = []string{"xyzw", "rgba", "stpq"}
+
+func glslSwizzle(e glslExpr, name string, line int) (glslExpr, error) {
+	if e.typ.kind == glslMat || e.typ.kind == glslSampler || e.typ.kind == glslVoid || e.typ.size == 1 {
+		return glslExpr{}, glslErrorf(line, "%s has no field %q", e.typ, name)
+	}
+	if len(name) > 4 {
+		return glslExpr{}, glslErrorf(line, "swizzle %q is too long", name)
+	}
+	var index [4]int
+	n := len(name)
+	for _, set := range glslSwizzleSets {
+		if strings.IndexByte(set, name[0]) == -1 {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			index[i] = strings.IndexByte(set, name[i])
+			if index[i] == -1 || index[i] >= e.typ.size {
+				return glslExpr{}, glslErrorf(line, "%s has no field %q", e.typ, name)
+			}
+		}
+	}
+	if strings.IndexByte("xyzwrgbastpq", name[0]) == -1 {
+		return glslExpr{}, glslErrorf(line, "%s has no field %q", e.typ, name)
+	}
+	eval, set := e.eval, e.set
+	res := glslExpr{typ: glslType{e.typ.kind, n}, eval: func(s *glslState) glslValue {
+		x := eval(s)
+		var r glslValue
+		for i := 0; i < n; i++ {
+			r[i] = x[index[i]]
+		}
+		return r
+	}}
+	repeated := false
+	for i := 0; i < n; i++ {
+		repeated = repeated || slices.Contains(index[:i], index[i])
+	}
+	if set != nil && !repeated {
+		res.set = func(s *glslState, v glslValue) {
+			x := eval(s)
+			for i := 0; i < n; i++ {
+				x[index[i]] = v[i]
+			}
+			set(s, x)
+		}
+	}
+	return res, nil
+}
+
+func glslIndex(e, index glslExpr, line int) (glslExpr, error) {
+	if index.typ != glslIntType {
+		return glslExpr{}, glslErrorf(line, "index must be int, not %s", index.typ)
+	}
+	if e.typ.kind == glslSampler || e.typ.kind == glslVoid || e.typ.size == 1 {
+		return glslExpr{}, glslErrorf(line, "%s can't be indexed", e.typ)
+	}
+	// columns of matrices are indexed, n is number of components in one
+	size, n, typ := e.typ.size, 1, glslType{e.typ.kind, 1}
+	if e.typ.kind == glslMat {
+		n, typ = size, glslType{glslFloat, size}
+	}
+	eval, set, indexEval := e.eval, e.set, index.eval
+	at := func(s *glslState) int {
+		i := int(indexEval(s)[0])
+		if i < 0 || i >= size {
+			panic(glslRuntimeError(fmt.Sprintf("line %d: index %d is out of range of %s", line, i, e.typ)))
+		}
+		return i * n
+	}
+	res := glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+		k := at(s)
+		x := eval(s)
+		var r glslValue
+		copy(r[:n], x[k:k+n])
+		return r
+	}}
+	if set != nil {
+		res.set = func(s *glslState, v glslValue) {
+			k := at(s)
+			x := eval(s)
+			copy(x[k:k+n], v[:n])
+			set(s, x)
+		}
+	}
+	return res, nil
+}
+
+func glslConst(typ glslType, x glslValue) glslExpr {
+	return glslExpr{typ: typ, eval: func(*glslState) glslValue { return x }}
+}
+
+func (c *glslCompiler) primary() (glslExpr, error) {
+	t := c.peek()
+	switch {
+	case t.kind == glslNumber:
+		c.next()
+		text := strings.TrimRight(t.text, "fF")
+		isHex := strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X")
+		if !isHex && (strings.ContainsAny(text, ".eE") || text != t.text) {
+			x, err := strconv.ParseFloat(text, 32)
+			if err != nil {
+				return glslExpr{}, glslErrorf(t.line, "invalid number %q", t.text)
+			}
+			return glslConst(glslFloatType, glslValue{float32(x)}), nil
+		}
+		x, err := strconv.ParseInt(text, 0, 32)
+		if err != nil {
+			return glslExpr{}, glslErrorf(t.line, "invalid number %q", t.text)
+		}
+		return glslConst(glslIntType, glslValue{float32(x)}), nil
+	case c.accept("("):
+		e, err := c.expression()
+		if err != nil {
+			return glslExpr{}, err
+		}
+		return e, c.expect(")")
+	case c.accept("true"):
+		return glslConst(glslBoolType, glslBoolValue(true)), nil
+	case c.accept("false"):
+		return glslConst(glslBoolType, glslBoolValue(false)), nil
+	case c.isType():
+		typ, _ := c.typeName()
+		args, err := c.arguments()
+		if err != nil {
+			return glslExpr{}, err
+		}
+		e, err := glslConstruct(typ, args)
+		if err != nil {
+			return glslExpr{}, glslErrorf(t.line, "%s", err)
+		}
+		return e, nil
+	case t.kind == glslIdent:
+		name, err := c.ident()
+		if err != nil {
+			return glslExpr{}, err
+		}
+		if c.is("(") {
+			return c.call(name, t.line)
+		}
+		v, ok := c.lookup(name)
+		if !ok {
+			return glslExpr{}, glslErrorf(t.line, "%q is not declared", name)
+		}
+		v.used = true
+		return v.expr(), nil
+	}
+	return glslExpr{}, c.unexpected()
+}
+
+func (c *glslCompiler) arguments() ([]glslExpr, error) {
+	if err := c.expect("("); err != nil {
+		return nil, err
+	}
+	args := []glslExpr{}
+	for !c.accept(")") {
+		if len(args) > 0 {
+			if err := c.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := c.assignment()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// glslConstruct compiles constructor like vec4(color, 1.), scalars are converted to type of constructor
+func glslConstruct(typ glslType, args []glslExpr) (glslExpr, error) {
+	if typ.kind == glslVoid || typ.kind == glslSampler {
+		return glslExpr{}, fmt.Errorf("%s can't be constructed", typ)
+	}
+	if len(args) == 0 {
+		return glslExpr{}, fmt.Errorf("%s constructor needs arguments", typ)
+	}
+	for _, arg := range args {
+		if arg.typ.kind == glslVoid || arg.typ.kind == glslSampler {
+			return glslExpr{}, fmt.Errorf("%s can't be constructed from %s", typ, arg.typ)
+		}
+	}
+	var conv func(float32) float32
+	switch typ.kind {
+	case glslBool:
+		conv = func(x float32) float32 {
+			if x != 0 {
+				return 1
+			}
+			return 0
+		}
+	case glslInt:
+		conv = func(x float32) float32 { return float32(int64(x)) }
+	default:
+		conv = func(x float32) float32 { return x }
+	}
+	n := typ.components()
+	if len(args) == 1 && args[0].typ.isScalar() {
+		eval := args[0].eval
+		diagonal := typ.kind == glslMat
+		return glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+			x := conv(eval(s)[0])
+			var r glslValue
+			for i := 0; i < n; i++ {
+				if !diagonal || i%(typ.size+1) == 0 {
+					r[i] = x
+				}
+			}
+			return r
+		}}, nil
+	}
+	if len(args) == 1 && typ.kind == glslMat && args[0].typ.kind == glslMat {
+		// columns and rows out of source matrix are taken from identity matrix
+		eval, m, size := args[0].eval, args[0].typ.size, typ.size
+		return glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+			x := eval(s)
+			var r glslValue
+			for col := 0; col < size; col++ {
+				for row := 0; row < size; row++ {
+					switch {
+					case col < m && row < m:
+						r[col*size+row] = x[col*m+row]
+					case col == row:
+						r[col*size+row] = 1
+					}
+				}
+			}
+			return r
+		}}, nil
+	}
+	total := 0
+	for i, arg := range args {
+		if i > 0 && total >= n {
+			return glslExpr{}, fmt.Errorf("too many arguments for %s constructor", typ)
+		}
+		total += arg.typ.components()
+	}
+	if total < n || typ.isScalar() && len(args) > 1 {
+		return glslExpr{}, fmt.Errorf("wrong number of components for %s constructor", typ)
+	}
+	evals := make([]func(*glslState) glslValue, len(args))
+	sizes := make([]int, len(args))
+	for i, arg := range args {
+		evals[i], sizes[i] = arg.eval, arg.typ.components()
+	}
+	return glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+		var r glslValue
+		k := 0
+		for i, eval := range evals {
+			x := eval(s)
+			for j := 0; j < sizes[i] && k < n; j++ {
+				r[k] = conv(x[j])
+				k++
+			}
+		}
+		return r
+	}}, nil
+}
+
+func (c *glslCompiler) call(name string, line int) (glslExpr, error) {
+	args, err := c.arguments()
+	if err != nil {
+		return glslExpr{}, err
+	}
+	if overloads, ok := c.funcs[name]; ok {
+		return c.callUser(name, overloads, args, line)
+	}
+	builtin, ok := glslBuiltins[name]
+	if !ok {
+		return glslExpr{}, glslErrorf(line, "function %q is not declared", name)
+	}
+	e, err := builtin(args)
+	if err != nil {
+		return glslExpr{}, glslErrorf(line, "%s: %s", name, err)
+	}
+	return e, nil
+}
+
+func (c *glslCompiler) callUser(name string, overloads []*glslFunc, args []glslExpr, line int) (glslExpr, error) {
+	matches := func(f *glslFunc, exact bool) bool {
+		if len(f.params) != len(args) {
+			return false
+		}
+		for i, param := range f.params {
+			if args[i].typ == param.typ {
+				continue
+			}
+			if exact || param.out {
+				return false
+			}
+			if _, err := c.convert(args[i], param.typ, line); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	var f *glslFunc
+	for _, exact := range []bool{true, false} {
+		for _, overload := range overloads {
+			if f == nil && matches(overload, exact) {
+				f = overload
+			}
+		}
+	}
+	if f == nil {
+		types := make([]string, len(args))
+		for i, arg := range args {
+			types[i] = arg.typ.String()
+		}
+		return glslExpr{}, glslErrorf(line, "no function %s(%s)", name, strings.Join(types, ", "))
+	}
+	f.used = true
+	if c.fn != nil && !slices.Contains(c.fn.calls, f) {
+		c.fn.calls = append(c.fn.calls, f)
+	}
+	evals := make([]func(*glslState) glslValue, len(args))
+	outs := make([]func(*glslState, glslValue), len(args))
+	for i, param := range f.params {
+		if param.in {
+			evals[i] = args[i].eval
+		}
+		if param.out {
+			if args[i].set == nil {
+				return glslExpr{}, glslErrorf(line, "argument %d of %s must be variable, it is out param", i+1, name)
+			}
+			outs[i] = args[i].set
+		}
+	}
+	return glslExpr{typ: f.ret, eval: func(s *glslState) glslValue { return s.call(f, evals, outs) }}, nil
+}
+
+// glslState is state of shader run for one pixel, locals of called functions are on stack
+type glslState struct {
+	globals   []glslValue
+	stack     []glslValue
+	base      int
+	top       int
+	ret       glslValue
+	discarded bool
+	texture   *image.RGBA
+	// uniforms are values of uniforms by global slots
+	uniforms map[int]glslValue
+}
+
+// call runs function, args are nil for out params and outs are nil for in ones
+func (s *glslState) call(f *glslFunc, args []func(*glslState) glslValue, outs []func(*glslState, glslValue)) glslValue {
+	base := s.top
+	for len(s.stack) < base+f.locals {
+		s.stack = append(s.stack, glslValue{})
+	}
+	// args are computed in frame of caller, but calls in them must not overwrite frame of callee
+	s.top = base + f.locals
+	for i, arg := range args {
+		var x glslValue
+		if arg != nil {
+			x = arg(s)
+		}
+		s.stack[base+i] = x
+	}
+	callerBase := s.base
+	s.base = base
+	f.body(s)
+	s.base = callerBase
+	for i, out := range outs {
+		if out != nil {
+			out(s, s.stack[base+i])
+		}
+	}
+	s.top = base
+	return s.ret
+}
@@ -0,0 +1,273 @@
+package fimgs
+
+import (
+	"fmt"
+	"math"
+)
+
+// glslBuiltin compiles call of built-in function with given arguments
+type glslBuiltin func(args []glslExpr) (glslExpr, error)
+
+func glslArity(args []glslExpr, arity int) error {
+	if len(args) != arity {
+		return fmt.Errorf("expected %d arguments, got %d", arity, len(args))
+	}
+	return nil
+}
+
+// glslComponentwise makes built-in function applying f to components of arguments, scalar arguments
+// are used for every component of vector ones. Result is int if all arguments are ints and keepInt is set.
+func glslComponentwise(arity int, keepInt bool, f func(x [3]float64) float64) glslBuiltin {
+	return func(args []glslExpr) (glslExpr, error) {
+		if err := glslArity(args, arity); err != nil {
+			return glslExpr{}, err
+		}
+		typ := glslIntType
+		var evals [3]func(*glslState) glslValue
+		var scalar [3]bool
+		for i, arg := range args {
+			if arg.typ.kind != glslInt && arg.typ.kind != glslFloat {
+				return glslExpr{}, fmt.Errorf("expected float or vector argument, got %s", arg.typ)
+			}
+			if arg.typ.kind == glslFloat || !keepInt {
+				typ.kind = glslFloat
+			}
+			if arg.typ.size != 1 {
+				if typ.size != 1 && typ.size != arg.typ.size {
+					return glslExpr{}, fmt.Errorf("arguments have different sizes")
+				}
+				typ.size = arg.typ.size
+			}
+			evals[i], scalar[i] = arg.eval, arg.typ.size == 1
+		}
+		n := typ.size
+		return glslExpr{typ: typ, eval: func(s *glslState) glslValue {
+			var vals [3]glslValue
+			for i := 0; i < arity; i++ {
+				vals[i] = evals[i](s)
+			}
+			var x [3]float64
+			var r glslValue
+			for k := 0; k < n; k++ {
+				for i := 0; i < arity; i++ {
+					if scalar[i] {
+						x[i] = float64(vals[i][0])
+					} else {
+						x[i] = float64(vals[i][k])
+					}
+				}
+				r[k] = float32(f(x))
+			}
+			return r
+		}}, nil
+	}
+}
+
+// glslVectors checks that arguments are float vectors of the same size and returns the size
+func glslVectors(args []glslExpr, arity int) (int, error) {
+	if err := glslArity(args, arity); err != nil {
+		return 0, err
+	}
+	for _, arg := range args {
+		if arg.typ.kind != glslInt && arg.typ.kind != glslFloat || arg.typ.size != args[0].typ.size {
+			return 0, fmt.Errorf("expected float vectors of the same size, got %s", arg.typ)
+		}
+	}
+	return args[0].typ.size, nil
+}
+
+func glslDot(x, y glslValue, n int) float32 {
+	var sum float32
+	for i := 0; i < n; i++ {
+		sum += x[i] * y[i]
+	}
+	return sum
+}
+
+// glslVectorFunc makes built-in function of float vectors of the same size, ret is type of result by their size
+func glslVectorFunc(arity int, ret func(n int) glslType, f func(x [2]glslValue, n int) glslValue) glslBuiltin {
+	return func(args []glslExpr) (glslExpr, error) {
+		n, err := glslVectors(args, arity)
+		if err != nil {
+			return glslExpr{}, err
+		}
+		var evals [2]func(*glslState) glslValue
+		for i, arg := range args {
+			evals[i] = arg.eval
+		}
+		return glslExpr{typ: ret(n), eval: func(s *glslState) glslValue {
+			var x [2]glslValue
+			for i := 0; i < arity; i++ {
+				x[i] = evals[i](s)
+			}
+			return f(x, n)
+		}}, nil
+	}
+}
+
+func glslFloatResult(int) glslType    { return glslFloatType }
+func glslVectorResult(n int) glslType { return glslType{glslFloat, n} }
+
+// glslTexture checks number of arguments and that first one is sampler and second one has type typ
+func glslTexture(args []glslExpr, minArity, maxArity int, typ glslType) error {
+	if len(args) < minArity || len(args) > maxArity {
+		return fmt.Errorf("expected %d arguments, got %d", maxArity, len(args))
+	}
+	if args[0].typ.kind != glslSampler {
+		return fmt.Errorf("first argument must be sampler2D, not %s", args[0].typ)
+	}
+	if args[1].typ != typ {
+		return fmt.Errorf("second argument must be %s, not %s", typ, args[1].typ)
+	}
+	return nil
+}
+
+var (
+	glslAtan1 = glslComponentwise(1, false, func(x [3]float64) float64 { return math.Atan(x[0]) })
+	glslAtan2 = glslComponentwise(2, false, func(x [3]float64) float64 { return math.Atan2(x[0], x[1]) })
+)
+
+var glslBuiltins = map[string]glslBuiltin{
+	"radians": glslComponentwise(1, false, func(x [3]float64) float64 { return x[0] * math.Pi / 180 }),
+	"degrees": glslComponentwise(1, false, func(x [3]float64) float64 { return x[0] * 180 / math.Pi }),
+	"sin":     glslComponentwise(1, false, func(x [3]float64) float64 { return math.Sin(x[0]) }),
+	"cos":     glslComponentwise(1, false, func(x [3]float64) float64 { return math.Cos(x[0]) }),
+	"tan":     glslComponentwise(1, false, func(x [3]float64) float64 { return math.Tan(x[0]) }),
+	"asin":    glslComponentwise(1, false, func(x [3]float64) float64 { return math.Asin(x[0]) }),
+	"acos":    glslComponentwise(1, false, func(x [3]float64) float64 { return math.Acos(x[0]) }),
+	"atan": func(args []glslExpr) (glslExpr, error) {
+		if len(args) == 2 {
+			return glslAtan2(args)
+		}
+		return glslAtan1(args)
+	},
+	"pow":         glslComponentwise(2, false, func(x [3]float64) float64 { return math.Pow(x[0], x[1]) }),
+	"exp":         glslComponentwise(1, false, func(x [3]float64) float64 { return math.Exp(x[0]) }),
+	"log":         glslComponentwise(1, false, func(x [3]float64) float64 { return math.Log(x[0]) }),
+	"exp2":        glslComponentwise(1, false, func(x [3]float64) float64 { return math.Exp2(x[0]) }),
+	"log2":        glslComponentwise(1, false, func(x [3]float64) float64 { return math.Log2(x[0]) }),
+	"sqrt":        glslComponentwise(1, false, func(x [3]float64) float64 { return math.Sqrt(x[0]) }),
+	"inversesqrt": glslComponentwise(1, false, func(x [3]float64) float64 { return 1 / math.Sqrt(x[0]) }),
+	"abs":         glslComponentwise(1, true, func(x [3]float64) float64 { return math.Abs(x[0]) }),
+	"sign": glslComponentwise(1, true, func(x [3]float64) float64 {
+		switch {
+		case x[0] > 0:
+			return 1
+		case x[0] < 0:
+			return -1
+		}
+		return 0
+	}),
+	"floor":     glslComponentwise(1, false, func(x [3]float64) float64 { return math.Floor(x[0]) }),
+	"ceil":      glslComponentwise(1, false, func(x [3]float64) float64 { return math.Ceil(x[0]) }),
+	"trunc":     glslComponentwise(1, false, func(x [3]float64) float64 { return math.Trunc(x[0]) }),
+	"round":     glslComponentwise(1, false, func(x [3]float64) float64 { return math.RoundToEven(x[0]) }),
+	"roundEven": glslComponentwise(1, false, func(x [3]float64) float64 { return math.RoundToEven(x[0]) }),
+	"fract":     glslComponentwise(1, false, func(x [3]float64) float64 { return x[0] - math.Floor(x[0]) }),
+	"mod":       glslComponentwise(2, false, func(x [3]float64) float64 { return x[0] - x[1]*math.Floor(x[0]/x[1]) }),
+	"min":       glslComponentwise(2, true, func(x [3]float64) float64 { return math.Min(x[0], x[1]) }),
+	"max":       glslComponentwise(2, true, func(x [3]float64) float64 { return math.Max(x[0], x[1]) }),
+	"clamp":     glslComponentwise(3, true, func(x [3]float64) float64 { return math.Min(math.Max(x[0], x[1]), x[2]) }),
+	"mix":       glslComponentwise(3, false, func(x [3]float64) float64 { return x[0]*(1-x[2]) + x[1]*x[2] }),
+	"step": glslComponentwise(2, false, func(x [3]float64) float64 {
+		if x[1] < x[0] {
+			return 0
+		}
+		return 1
+	}),
+	"smoothstep": glslComponentwise(3, false, func(x [3]float64) float64 {
+		t := math.Min(math.Max((x[2]-x[0])/(x[1]-x[0]), 0), 1)
+		return t * t * (3 - 2*t)
+	}),
+
+	"length": glslVectorFunc(1, glslFloatResult, func(x [2]glslValue, n int) glslValue {
+		return glslValue{float32(math.Sqrt(float64(glslDot(x[0], x[0], n))))}
+	}),
+	"distance": glslVectorFunc(2, glslFloatResult, func(x [2]glslValue, n int) glslValue {
+		var d glslValue
+		for i := 0; i < n; i++ {
+			d[i] = x[0][i] - x[1][i]
+		}
+		return glslValue{float32(math.Sqrt(float64(glslDot(d, d, n))))}
+	}),
+	"dot": glslVectorFunc(2, glslFloatResult, func(x [2]glslValue, n int) glslValue {
+		return glslValue{glslDot(x[0], x[1], n)}
+	}),
+	"normalize": glslVectorFunc(1, glslVectorResult, func(x [2]glslValue, n int) glslValue {
+		length := float32(math.Sqrt(float64(glslDot(x[0], x[0], n))))
+		var r glslValue
+		for i := 0; i < n; i++ {
+			r[i] = x[0][i] / length
+		}
+		return r
+	}),
+	"reflect": glslVectorFunc(2, glslVectorResult, func(x [2]glslValue, n int) glslValue {
+		d := 2 * glslDot(x[1], x[0], n)
+		var r glslValue
+		for i := 0; i < n; i++ {
+			r[i] = x[0][i] - d*x[1][i]
+		}
+		return r
+	}),
+	"cross": func(args []glslExpr) (glslExpr, error) {
+		if len(args) > 0 && args[0].typ.size != 3 {
+			return glslExpr{}, fmt.Errorf("expected vec3 arguments, got %s", args[0].typ)
+		}
+		return glslVectorFunc(2, glslVectorResult, func(x [2]glslValue, n int) glslValue {
+			a, b := x[0], x[1]
+			return glslValue{a[1]*b[2] - b[1]*a[2], a[2]*b[0] - b[2]*a[0], a[0]*b[1] - b[0]*a[1]}
+		})(args)
+	},
+	"transpose": func(args []glslExpr) (glslExpr, error) {
+		if err := glslArity(args, 1); err != nil {
+			return glslExpr{}, err
+		}
+		if args[0].typ.kind != glslMat {
+			return glslExpr{}, fmt.Errorf("expected matrix, got %s", args[0].typ)
+		}
+		eval, n := args[0].eval, args[0].typ.size
+		return glslExpr{typ: args[0].typ, eval: func(s *glslState) glslValue {
+			m := eval(s)
+			var r glslValue
+			for col := 0; col < n; col++ {
+				for row := 0; row < n; row++ {
+					r[col*n+row] = m[row*n+col]
+				}
+			}
+			return r
+		}}, nil
+	},
+
+	"texture":   glslSample,
+	"texture2D": glslSample,
+	"textureSize": func(args []glslExpr) (glslExpr, error) {
+		if err := glslTexture(args, 2, 2, glslIntType); err != nil {
+			return glslExpr{}, err
+		}
+		return glslExpr{typ: glslType{glslInt, 2}, eval: func(s *glslState) glslValue {
+			return glslValue{float32(s.texture.Rect.Dx()), float32(s.texture.Rect.Dy())}
+		}}, nil
+	},
+	"texelFetch": func(args []glslExpr) (glslExpr, error) {
+		if err := glslTexture(args, 3, 3, glslType{glslInt, 2}); err != nil {
+			return glslExpr{}, err
+		}
+		eval := args[1].eval
+		return glslExpr{typ: glslVec4Type, eval: func(s *glslState) glslValue {
+			p := eval(s)
+			return s.texel(int(p[0]), int(p[1]))
+		}}, nil
+	},
+}
+
+// glslSample is texture(sampler, coords) and texture2D, optional bias is ignored, there are no mipmaps
+func glslSample(args []glslExpr) (glslExpr, error) {
+	if err := glslTexture(args, 2, 3, glslType{glslFloat, 2}); err != nil {
+		return glslExpr{}, err
+	}
+	eval := args[1].eval
+	return glslExpr{typ: glslVec4Type, eval: func(s *glslState) glslValue {
+		uv := eval(s)
+		return s.sample(uv[0], uv[1])
+	}}, nil
+}
@@ -0,0 +1,106 @@
+package fimgs
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+// runGLSL runs shader for pixel (0, 0) of 2x2 texture and returns its color
+func runGLSL(t *testing.T, source string) (glslValue, bool) {
+	t.Helper()
+	prog, err := compileGLSL(source)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, source)
+	}
+	s := &glslState{globals: make([]glslValue, prog.globals), texture: image.NewRGBA(image.Rect(0, 0, 2, 2))}
+	return s.run(prog, 0.5, 0.5)
+}
+
+func TestGLSL(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		want   [4]float32
+	}{
+		{`void main() {
+			vec4 v = vec4(1., 2., 3., 4.);
+			v.xy = v.yx;
+			gl_FragColor = v * 2.;
+		}`, [4]float32{4, 2, 6, 8}},
+		{`void main() {
+			int a = 7 / 2;
+			gl_FragColor = vec4(a, -7 / 2, 7 % 3, float(a) / 2.);
+		}`, [4]float32{3, -3, 1, 1.5}},
+		{`void main() {
+			mat2 m = mat2(1., 2., 3., 4.);
+			gl_FragColor = vec4(m * vec2(1.), vec2(1., 0.) * m);
+			gl_FragColor.w += m[1].x;
+		}`, [4]float32{4, 6, 1, 6}},
+		{`float sum(int n);
+		void split(float x, out float i, inout float f) {
+			i = floor(x);
+			f += fract(x);
+		}
+		void main() {
+			float i, f = 1.;
+			split(2.25, i, f);
+			gl_FragColor = vec4(i, f, sum(10), 0.);
+		}
+		float sum(int n) {
+			float s = 0.;
+			for (int k = 0; k < 100; k++) {
+				if (k == n) break;
+				if (k % 2 == 1) continue;
+				s += float(k);
+			}
+			return s;
+		}`, [4]float32{2, 1.25, 20, 0}},
+		{`#version 330
+		#define N 3
+		const float HALF = .5;
+		void main() {
+			int n = 0;
+			while (n < N) n++;
+			gl_FragColor = vec4(n == N ? 1. : 0., clamp(5, 0, 2), mix(0., 10., .25), step(HALF, .4));
+		}`, [4]float32{1, 2, 2.5, 0}},
+		{`out vec4 color;
+		void main() {
+			color = vec4(gl_FragCoord.xy, length(vec2(3., 4.)), dot(vec3(1.), vec3(1., 2., 3.)));
+		}`, [4]float32{0.5, 0.5, 5, 6}},
+	} {
+		got, ok := runGLSL(t, test.source)
+		if !ok || [4]float32(got[:4]) != test.want {
+			t.Errorf("got %v, want %v\n%s", got[:4], test.want, test.source)
+		}
+	}
+
+	if _, ok := runGLSL(t, `void main() { gl_FragColor = vec4(1.); discard; }`); ok {
+		t.Errorf("pixel must be discarded")
+	}
+}
+
+func TestGLSLErrors(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		want   string
+	}{
+		{"void main() {\n\tgl_FragColor = vec3(1.);\n}", "line 2: can't convert vec3 to vec4"},
+		{"void main() { x = 1.; }", `"x" is not declared`},
+		{"void main() { gl_FragColor = vec4(1.) }", `expected ";", got "}"`},
+		{"void main() { float a[2]; }", "arrays are not supported"},
+		{"void main() { break; }", "break outside of loop"},
+		{"float f(float x) { return f(x); }\nvoid main() { gl_FragColor = vec4(f(1.)); }", "recursion is not allowed"},
+		{"uniform sampler2D s;\nvoid main() { gl_FragColor = texture(s, 1.); }", "second argument must be vec2"},
+		{"in vec2 uv;\nvoid main() {}", "only input is vec2 outTexCoords"},
+		{"void f() {}", "main is not defined"},
+	} {
+		if _, err := compileGLSL(test.source); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got error %v, want %q\n%s", err, test.want, test.source)
+		}
+	}
+
+	_, err := cpuShader(image.NewRGBA(image.Rect(0, 0, 1, 1)), "void main() { while (true) {} }", nil)
+	if err == nil || !strings.Contains(err.Error(), "loop has more than") {
+		t.Errorf("endless loop must fail, got error %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Limits of generated kernels, larger ones take too much time and memory to be useful
+const (
+	maxSigma        = 100.0
+	maxBoxRadius    = 300
+	maxMotionLength = 300
+)
+
+// GaussianKernel returns Gaussian kernel of size 2*ceil(3*sigma)+1, its sum is 1
+func GaussianKernel(sigma float64) SeparableKernel {
+	radius := int(math.Ceil(3 * sigma))
+	g := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range g {
+		x := float64(i - radius)
+		g[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += g[i]
+	}
+	for i := range g {
+		g[i] /= sum
+	}
+	return SeparableKernel{g, g}
+}
+
+// BoxKernel returns (2*radius+1)x(2*radius+1) kernel of ones
+func BoxKernel(radius int) SeparableKernel {
+	ones := make([]float64, 2*radius+1)
+	for i := range ones {
+		ones[i] = 1
+	}
+	return SeparableKernel{ones, ones}
+}
+
+// MotionBlurKernel returns kernel with antialiased line of given length through its center,
+// angle is in degrees counterclockwise from x axis
+func MotionBlurKernel(angle float64, length int) Kernel {
+	size := length | 1 // make odd so line is centered
+	kernel := make(Kernel, size)
+	for i := range kernel {
+		kernel[i] = make([]float64, size)
+	}
+	center := float64(size / 2)
+	dx, dy := math.Cos(angle*math.Pi/180), -math.Sin(angle*math.Pi/180)
+	half := float64(length-1) / 2
+	const step = 0.25
+	for t := -half; t <= half+1e-9; t += step {
+		x, y := center+t*dx, center+t*dy
+		x0, y0 := math.Floor(x), math.Floor(y)
+		fx, fy := x-x0, y-y0
+		for _, p := range []struct {
+			i, j int
+			w    float64
+		}{
+			{int(y0), int(x0), (1 - fx) * (1 - fy)},
+			{int(y0), int(x0) + 1, fx * (1 - fy)},
+			{int(y0) + 1, int(x0), (1 - fx) * fy},
+			{int(y0) + 1, int(x0) + 1, fx * fy},
+		} {
+			if p.w > 0 && p.i >= 0 && p.i < size && p.j >= 0 && p.j < size {
+				kernel[p.i][p.j] += p.w
+			}
+		}
+	}
+	return kernel
+}
+
+// composeKernels returns kernel equivalent to applying a and then b, both must have odd sizes
+func composeKernels(a, b Kernel) Kernel {
+	kernel := make(Kernel, len(a)+len(b)-1)
+	for i := range kernel {
+		kernel[i] = make([]float64, len(a[0])+len(b[0])-1)
+	}
+	for ai, aRow := range a {
+		for aj, x := range aRow {
+			for bi, bRow := range b {
+				for bj, y := range bRow {
+					kernel[ai+bi][aj+bj] += x * y
+				}
+			}
+		}
+	}
+	return kernel
+}
+
+func init() {
+	Register(&filter{
+		name:        "gaussian",
+		title:       "Gaussian blur",
+		description: "Blur image with Gaussian kernel.",
+		params: append([]Param{{
+			Name:    "sigma",
+			Alias:   "s",
+			Type:    ParamFloat,
+			Usage:   fmt.Sprintf("standard deviation in pixels, in (0, %v]", maxSigma),
+			Default: 2.0,
+		}}, blurParams()...),
+		validate: func(params Params) error {
+			if sigma := params.Float("sigma"); sigma <= 0 || sigma > maxSigma {
+				return fmt.Errorf("sigma must be in (0, %v], you gave %v", maxSigma, sigma)
+			}
+			return validateBlur(params)
+		},
+		filtersAlpha: filtersAlphaParam,
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			return applyConvolutionParams(im, GaussianKernel(params.Float("sigma")).newConvolver, params, ConvolutionOptions{})
+		},
+	})
+	Register(&filter{
+		name:        "box",
+		title:       "Box blur",
+		description: "Replace each pixel with average of square around it.",
+		params: append([]Param{{
+			Name:    "radius",
+			Alias:   "r",
+			Type:    ParamInt,
+			Usage:   fmt.Sprintf("square is 2*radius+1 pixels wide, in 1..%d", maxBoxRadius),
+			Default: 5,
+		}}, blurParams()...),
+		validate: func(params Params) error {
+			if radius := params.Int("radius"); radius <= 0 || radius > maxBoxRadius {
+				return fmt.Errorf("radius must be in 1..%d, you gave %d", maxBoxRadius, radius)
+			}
+			return validateBlur(params)
+		},
+		filtersAlpha: filtersAlphaParam,
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			return applyConvolutionParams(im, BoxKernel(params.Int("radius")).newConvolver, params, ConvolutionOptions{})
+		},
+	})
+	Register(&filter{
+		name:        "motionblur",
+		title:       "Motion blur",
+		description: "Blur image along line, like it was moving while shot.",
+		params: append([]Param{
+			{
+				Name:    "angle",
+				Alias:   "a",
+				Type:    ParamFloat,
+				Usage:   "direction of motion in degrees counterclockwise from horizontal",
+				Default: 0.0,
+			},
+			{
+				Name:    "len",
+				Alias:   "l",
+				Type:    ParamInt,
+				Usage:   fmt.Sprintf("length of motion in pixels, in 1..%d", maxMotionLength),
+				Default: 15,
+			},
+		}, blurParams()...),
+		validate: func(params Params) error {
+			if length := params.Int("len"); length <= 0 || length > maxMotionLength {
+				return fmt.Errorf("len must be in 1..%d, you gave %d", maxMotionLength, length)
+			}
+			return validateBlur(params)
+		},
+		filtersAlpha: filtersAlphaParam,
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			return applyConvolutionParams(im, matrixConvolvers(MotionBlurKernel(params.Float("angle"), params.Int("len"))), params, ConvolutionOptions{})
+		},
+	})
+}
@@ -6,32 +6,108 @@ import (
 	"image/color"
 	"math"
 	"math/rand"
+	"sort"
+	"strconv"
 )
 
-func makeColorArray(len int) [][3]int64 {
-	return make([][3]int64, len)
+func makeColorArray(len int) [][3]float64 {
+	return make([][3]float64, len)
 }
 
-func abs64(x int64) int64 {
-	mask := x >> 63
-	return (x + mask) ^ mask
+// KMeansOptions set color space where colors are clustered and metric comparing them,
+// zero value means RGB and L1
+type KMeansOptions struct {
+	ColorSpace ColorSpace
+	Metric     ColorMetric
+	// Seed of random generator, clustering with the same seed gives the same result
+	Seed int64
 }
 
-func minkowskiiDist(a, b [3]int64) int64 {
-	return abs64(a[0]-b[0]) + abs64(a[1]-b[1]) + abs64(a[2]-b[2])
+func (opts KMeansOptions) spaceAndMetric() (colorSpace, func(a, b [3]float64) float64) {
+	space, ok := colorSpaces[opts.ColorSpace]
+	if !ok {
+		space = colorSpaces[ColorSpaceRGB]
+	}
+	dist, ok := colorMetrics[opts.Metric]
+	if !ok {
+		dist = colorMetrics[MetricL1]
+	}
+	return space, dist
 }
 
-func initClusterCenters(pixelColors [][3]int64, clustersCount int) [][3]int64 {
+// kmeansParams are params of color space and metric used to compare colors
+func kmeansParams() []Param {
+	return []Param{
+		{
+			Name:    "space",
+			Alias:   "s",
+			Type:    ParamString,
+			Usage:   "color space where colors are compared",
+			Default: ColorSpaceRGB,
+			Choices: ColorSpaces,
+		},
+		{
+			Name:    "metric",
+			Alias:   "m",
+			Type:    ParamString,
+			Usage:   "distance between colors, ciede2000 requires lab space",
+			Default: MetricL1,
+			Choices: ColorMetrics,
+		},
+		{
+			Name:    "seed",
+			Type:    ParamInt,
+			Usage:   "seed of random generator, the same seed gives the same result",
+			Default: 0,
+		},
+	}
+}
+
+func kmeansOptionsFromParams(params Params) KMeansOptions {
+	return KMeansOptions{
+		ColorSpace: params.String("space"),
+		Metric:     params.String("metric"),
+		Seed:       int64(params.Int("seed")),
+	}
+}
+
+// Metadata returns seed of options, so clustering can be reproduced
+func (opts KMeansOptions) Metadata() Metadata {
+	return Metadata{"seed": strconv.FormatInt(opts.Seed, 10)}
+}
+
+func validateKMeansOptions(params Params) error {
+	if params.String("metric") == MetricCIEDE2000 && params.String("space") != ColorSpaceLab {
+		return fmt.Errorf("ciede2000 metric works in lab space only, you gave space=%s", params.String("space"))
+	}
+	return nil
+}
+
+// nearestCluster returns index of nearest cluster center and distance to it
+func nearestCluster(pixelColor [3]float64, clustersCenters [][3]float64, dist func(a, b [3]float64) float64) (int, float64) {
+	minCluster := 0
+	minDist := dist(pixelColor, clustersCenters[0])
+	for k := 1; k < len(clustersCenters); k++ {
+		if newDist := dist(pixelColor, clustersCenters[k]); newDist < minDist {
+			minCluster = k
+			minDist = newDist
+		}
+	}
+	return minCluster, minDist
+}
+
+func initClusterCenters(pixelColors [][3]float64, clustersCount int, dist func(a, b [3]float64) float64, rng *rand.Rand) [][3]float64 {
 	clustersCenters := makeColorArray(clustersCount)
-	clustersCenters[clustersCount-1] = pixelColors[rand.Intn(len(pixelColors))]
-	minClusterDistance := make([]int64, len(pixelColors))
-	minClusterDistanceSum := int64(0)
+	clustersCenters[0] = pixelColors[rng.Intn(len(pixelColors))]
+	minClusterDistance := make([]float64, len(pixelColors))
+	minClusterDistanceSum := 0.0
 	for i, pixelColor := range pixelColors {
-		minClusterDistance[i] = minkowskiiDist(pixelColor, clustersCenters[clustersCount-1])
+		minClusterDistance[i] = dist(pixelColor, clustersCenters[0])
 		minClusterDistanceSum += minClusterDistance[i]
 	}
-	for k := 0; k < clustersCount-1; k++ {
-		x := rand.Int63n(minClusterDistanceSum)
+	for k := 1; k < clustersCount; k++ {
+		x := rng.Float64() * minClusterDistanceSum
+		clustersCenters[k] = pixelColors[len(pixelColors)-1]
 		for i, pixelColor := range pixelColors {
 			x -= minClusterDistance[i]
 			if x < 0 {
@@ -39,11 +115,8 @@ func initClusterCenters(pixelColors [][3]int64, clustersCount int) [][3]int64 {
 				break
 			}
 		}
-		if k == clustersCount-1 {
-			break
-		}
 		for i, pixelColor := range pixelColors {
-			if newDistance := minkowskiiDist(pixelColor, clustersCenters[0]); newDistance < minClusterDistance[i] {
+			if newDistance := dist(pixelColor, clustersCenters[k]); newDistance < minClusterDistance[i] {
 				minClusterDistanceSum += newDistance - minClusterDistance[i]
 				minClusterDistance[i] = newDistance
 			}
@@ -52,105 +125,184 @@ func initClusterCenters(pixelColors [][3]int64, clustersCount int) [][3]int64 {
 	return clustersCenters
 }
 
-func kmeansIters(clustersCenters, pixelColors [][3]int64, clustersCount int) {
+func kmeansIters(clustersCenters, pixelColors [][3]float64, dist func(a, b [3]float64) float64, minMovement float64, rng *rand.Rand) {
+	clustersCount := len(clustersCenters)
 	batchMaxSize := int(math.Sqrt(float64(len(pixelColors))))
-	sumAndCount := make([]int64, clustersCount*4) // count and sum of Rs, Gs, Bs
+	sumAndCount := make([]float64, clustersCount*4) // count and sum of channels
 	for epoch := 0; epoch < 300; epoch++ {
-		k := rand.Intn(batchMaxSize) + 1
-		sumAndCount[0] = 0
-		for i := 1; i < len(sumAndCount); i *= 2 {
-			copy(sumAndCount[i:], sumAndCount[:i])
-		}
+		k := rng.Intn(batchMaxSize) + 1
+		clear(sumAndCount)
 		for i := k; i < len(pixelColors); i += k {
 			pixelColor := pixelColors[i]
-			minCluster := 0
-			minDist := minkowskiiDist(pixelColor, clustersCenters[0])
-			for k := 1; k < clustersCount; k++ {
-				newDist := minkowskiiDist(pixelColor, clustersCenters[k])
-				if newDist < minDist {
-					minCluster = k
-					minDist = newDist
-				}
-			}
+			minCluster, _ := nearestCluster(pixelColor, clustersCenters, dist)
 			sumAndCount[minCluster*4+0]++
 			sumAndCount[minCluster*4+1] += pixelColor[0]
 			sumAndCount[minCluster*4+2] += pixelColor[1]
 			sumAndCount[minCluster*4+3] += pixelColor[2]
 		}
-		movement := int64(0)
+		movement := 0.0
 		for i := 0; i < clustersCount; i++ {
 			count := sumAndCount[i*4+0]
 			if count == 0 {
 				continue
 			}
-			v := [3]int64{
+			v := [3]float64{
 				sumAndCount[i*4+1] / count,
 				sumAndCount[i*4+2] / count,
 				sumAndCount[i*4+3] / count,
 			}
-			movement += minkowskiiDist(clustersCenters[i], v)
+			movement += dist(clustersCenters[i], v)
 			clustersCenters[i] = v
 		}
-		if movement < 100 {
+		if movement < minMovement {
 			break
 		}
 	}
 }
 
-func ApplyKMeans(im image.Image, clustersCount int) image.RGBA {
+// imageColors returns non-premultiplied colors of image pixels row by row converted to color space
+// and whether pixels are visible, i.e. not fully transparent
+func imageColors(im image.Image, space colorSpace) ([][3]float64, []bool) {
 	imageWidth := im.Bounds().Dx()
 	pixelColors := makeColorArray(imageWidth * im.Bounds().Dy())
+	visible := make([]bool, len(pixelColors))
 	for j := 0; j < im.Bounds().Dy(); j++ {
 		for i := 0; i < im.Bounds().Dx(); i++ {
 			k := i + j*imageWidth
-			r, g, b, _ := im.At(i, j).RGBA()
-			pixelColors[k] = [3]int64{int64(r), int64(g), int64(b)}
+			c := color.NRGBA64Model.Convert(im.At(im.Bounds().Min.X+i, im.Bounds().Min.Y+j)).(color.NRGBA64)
+			pixelColors[k] = space.from([3]float64{float64(c.R) / 0xFFFF, float64(c.G) / 0xFFFF, float64(c.B) / 0xFFFF})
+			visible[k] = c.A != 0
 		}
 	}
-	rand.Seed(0)
-	clustersCenters := initClusterCenters(pixelColors, clustersCount)
-	// TODO: try to sample mini-batches (random subdatasets)
-	kmeansIters(clustersCenters, pixelColors, clustersCount)
-	filtered_im := image.NewRGBA(im.Bounds())
-	for j := 0; j < im.Bounds().Dy(); j++ {
-		for i := 0; i < im.Bounds().Dx(); i++ {
-			pixel := pixelColors[i+j*imageWidth]
-			minCluster := 0
-			minDist := minkowskiiDist(pixel, clustersCenters[0])
-			for k := 1; k < clustersCount; k++ {
-				dist := minkowskiiDist(pixel, clustersCenters[k])
-				if dist < minDist {
-					minCluster = k
-					minDist = dist
-				}
-			}
-			filtered_im.Set(i, j, color.RGBA{
-				uint8((clustersCenters[minCluster][0] & 0xFF00) >> 8),
-				uint8((clustersCenters[minCluster][1] & 0xFF00) >> 8),
-				uint8((clustersCenters[minCluster][2] & 0xFF00) >> 8),
-				255,
-			})
-		}
-	}
-	return *filtered_im
+	return pixelColors, visible
 }
 
-// TODO: filter init is also validation?
-func ApplyKMeansFilter(sourceImageFilename string, resultImageFilename string, clustersCount int) error {
-	if clustersCount < 2 {
-		return fmt.Errorf("'n' must be at least 2, you gave n=%d", clustersCount)
+// visibleColors returns colors of visible pixels, or all colors if no pixel is visible
+func visibleColors(pixelColors [][3]float64, visible []bool) [][3]float64 {
+	res := makeColorArray(0)
+	for k, pixelColor := range pixelColors {
+		if visible[k] {
+			res = append(res, pixelColor)
+		}
 	}
-
-	im, err := LoadImageFile(sourceImageFilename)
-	if err != nil {
-		return fmt.Errorf("error occured while loading image: %q", err)
+	if len(res) == 0 {
+		return pixelColors
 	}
+	return res
+}
 
-	filtered_im := ApplyKMeans(im, clustersCount)
+// clusterColors returns centers of clusters of colors
+func clusterColors(pixelColors [][3]float64, clustersCount int, dist func(a, b [3]float64) float64, space colorSpace, rng *rand.Rand) [][3]float64 {
+	clustersCenters := initClusterCenters(pixelColors, clustersCount, dist, rng)
+	// TODO: try to sample mini-batches (random subdatasets)
+	kmeansIters(clustersCenters, pixelColors, dist, space.scale*1e-3, rng)
+	return clustersCenters
+}
 
-	if err := saveImage(filtered_im, resultImageFilename); err != nil {
-		return err
+// ApplyKMeans replaces colors of image with centers of their clusters, palette of result is sorted by share
+// of pixels in cluster, clustersCount must not exceed 256. Fully transparent pixels are not clustered,
+// result is opaque.
+func ApplyKMeans(im image.Image, clustersCount int, opts KMeansOptions) *image.Paletted {
+	space, dist := opts.spaceAndMetric()
+	imageWidth := im.Bounds().Dx()
+	pixelColors, visible := imageColors(im, space)
+	clustersCenters := clusterColors(visibleColors(pixelColors, visible), clustersCount, dist, space, rand.New(rand.NewSource(opts.Seed)))
+	assignment := make([]int, len(pixelColors))
+	counts := make([]int, clustersCount)
+	for k, pixelColor := range pixelColors {
+		assignment[k], _ = nearestCluster(pixelColor, clustersCenters, dist)
+		if visible[k] {
+			counts[assignment[k]]++
+		}
+	}
+	// palette is sorted by share of pixels
+	order := make([]int, clustersCount)
+	for k := range order {
+		order[k] = k
 	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+	paletteIndex := make([]uint8, clustersCount)
+	palette := make(color.Palette, clustersCount)
+	for k, cluster := range order {
+		c := space.to(clustersCenters[cluster])
+		palette[k] = color.NRGBA64{clamp16(c[0] * 0xFFFF), clamp16(c[1] * 0xFFFF), clamp16(c[2] * 0xFFFF), 0xFFFF}
+		paletteIndex[cluster] = uint8(k)
+	}
+	filtered_im := image.NewPaletted(im.Bounds(), palette)
+	for j := 0; j < im.Bounds().Dy(); j++ {
+		for i := 0; i < im.Bounds().Dx(); i++ {
+			filtered_im.Pix[j*filtered_im.Stride+i] = paletteIndex[assignment[i+j*imageWidth]]
+		}
+	}
+	return filtered_im
+}
 
-	return nil
+func init() {
+	Register(&filter{
+		name:        "cluster",
+		title:       "Cluster",
+		description: "Cluster colors using KMeans algorithm, number of clusters might be chosen automatically.",
+		params: append([]Param{
+			{
+				Name:  "nclusters",
+				Alias: "n",
+				Type:  ParamString,
+				Usage: "number of clusters, from 2 to 256, or auto to choose it by criterion",
+			},
+			{
+				Name:    "criterion",
+				Alias:   "c",
+				Type:    ParamString,
+				Usage:   "how clusterings are scored to choose number of clusters automatically",
+				Default: CriterionSilhouette,
+				Choices: ClusterCriteria,
+			},
+			{
+				Name:    "maxclusters",
+				Alias:   "M",
+				Type:    ParamInt,
+				Usage:   "maximal number of clusters tried automatically, from 2 to 256",
+				Default: 10,
+			},
+			{
+				Name:    "sample",
+				Type:    ParamInt,
+				Usage:   "number of random pixels clustered to choose number of clusters automatically, from 2 to 5000",
+				Default: 1000,
+			},
+		}, kmeansParams()...),
+		validate: func(params Params) error {
+			if _, err := clustersCountParam(params); err != nil {
+				return err
+			}
+			if maxClustersCount := params.Int("maxclusters"); maxClustersCount < 2 || maxClustersCount > 256 {
+				return fmt.Errorf("maxclusters must be in 2..256, you gave %d", maxClustersCount)
+			}
+			if sampleSize := params.Int("sample"); sampleSize < 2 || sampleSize > maxSampleSize {
+				return fmt.Errorf("sample must be in 2..%d, you gave %d", maxSampleSize, sampleSize)
+			}
+			return validateKMeansOptions(params)
+		},
+		// colors of transparent pixels must not be clustered, so filter gets image as is
+		filtersAlpha: func(Params) bool { return true },
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			opts := kmeansOptionsFromParams(params)
+			clustersCount, err := clustersCountParam(params)
+			if err != nil {
+				return nil, err
+			}
+			if clustersCount != 0 {
+				return WithMetadata(keepAlpha(im, ApplyKMeans(im, clustersCount, opts)), opts.Metadata()), nil
+			}
+			criterion := params.String("criterion")
+			clustersCount, scores := ChooseClustersCount(im, params.Int("maxclusters"), criterion, params.Int("sample"), opts)
+			res := WithMetadata(keepAlpha(im, ApplyKMeans(im, clustersCount, opts)), opts.Metadata())
+			return WithMetadata(res, Metadata{
+				"nclusters": strconv.Itoa(clustersCount),
+				"scores":    formatScores(criterion, scores),
+			}), nil
+		},
+	})
 }
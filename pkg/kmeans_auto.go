@@ -0,0 +1,219 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ClusterCriterion scores clustering to choose number of clusters
+type ClusterCriterion = string
+
+const (
+	// CriterionElbow takes the point of maximal curvature of sum of squared distances to cluster centers
+	CriterionElbow ClusterCriterion = "elbow"
+	// CriterionSilhouette takes maximal mean silhouette, how much closer points are to own cluster than to the nearest other one
+	CriterionSilhouette ClusterCriterion = "silhouette"
+	// CriterionDaviesBouldin takes minimal mean ratio of clusters sizes to distance between them
+	CriterionDaviesBouldin ClusterCriterion = "daviesbouldin"
+)
+
+var ClusterCriteria = []string{CriterionElbow, CriterionSilhouette, CriterionDaviesBouldin}
+
+// assignClusters returns index of the nearest center for every point
+func assignClusters(points, centers [][3]float64, dist func(a, b [3]float64) float64) []int {
+	assignment := make([]int, len(points))
+	for k, point := range points {
+		assignment[k], _ = nearestCluster(point, centers, dist)
+	}
+	return assignment
+}
+
+func inertia(points, centers [][3]float64, assignment []int, dist func(a, b [3]float64) float64) float64 {
+	sum := 0.0
+	for k, point := range points {
+		d := dist(point, centers[assignment[k]])
+		sum += d * d
+	}
+	return sum
+}
+
+// silhouettes returns mean silhouette of points for every assignment of points to clusters.
+// Distances from point to all points are computed once for all assignments and are not stored, so memory is linear.
+func silhouettes(points [][3]float64, assignments [][]int, dist func(a, b [3]float64) float64) []float64 {
+	sizes := make([][]int, len(assignments))
+	sums := make([][]float64, len(assignments))
+	for k, assignment := range assignments {
+		sizes[k] = make([]int, slices.Max(assignment)+1)
+		for _, cluster := range assignment {
+			sizes[k][cluster]++
+		}
+		sums[k] = make([]float64, len(sizes[k]))
+	}
+	scores := make([]float64, len(assignments))
+	distances := make([]float64, len(points))
+	for i, point := range points {
+		for j, other := range points {
+			distances[j] = dist(point, other)
+		}
+		for k, assignment := range assignments {
+			scores[k] += pointSilhouette(i, distances, assignment, sizes[k], sums[k])
+		}
+	}
+	for k := range scores {
+		scores[k] /= float64(len(points))
+	}
+	return scores
+}
+
+// pointSilhouette returns silhouette of i-th point, distances are distances from it to all points,
+// sizes are sizes of clusters and sums is buffer for sums of distances to them
+func pointSilhouette(i int, distances []float64, assignment, sizes []int, sums []float64) float64 {
+	own := assignment[i]
+	if sizes[own] == 1 {
+		return 0 // silhouette of single point cluster is 0
+	}
+	clear(sums)
+	for j, cluster := range assignment {
+		sums[cluster] += distances[j]
+	}
+	a := sums[own] / float64(sizes[own]-1)
+	b := math.Inf(1)
+	for cluster, size := range sizes {
+		if cluster != own && size > 0 {
+			b = math.Min(b, sums[cluster]/float64(size))
+		}
+	}
+	if math.IsInf(b, 1) || math.Max(a, b) == 0 {
+		return 0
+	}
+	return (b - a) / math.Max(a, b)
+}
+
+func daviesBouldin(points, centers [][3]float64, assignment []int, dist func(a, b [3]float64) float64) float64 {
+	scatter := make([]float64, len(centers))
+	sizes := make([]int, len(centers))
+	for k, point := range points {
+		scatter[assignment[k]] += dist(point, centers[assignment[k]])
+		sizes[assignment[k]]++
+	}
+	sum, nonEmpty := 0.0, 0
+	for i := range centers {
+		if sizes[i] == 0 {
+			continue
+		}
+		scatter[i] /= float64(sizes[i])
+	}
+	for i := range centers {
+		if sizes[i] == 0 {
+			continue
+		}
+		worst := 0.0
+		for j := range centers {
+			if j == i || sizes[j] == 0 {
+				continue
+			}
+			if d := dist(centers[i], centers[j]); d > 0 {
+				worst = math.Max(worst, (scatter[i]+scatter[j])/d)
+			}
+		}
+		sum += worst
+		nonEmpty++
+	}
+	return sum / float64(nonEmpty)
+}
+
+// elbow returns index of point of decreasing curve farthest from chord connecting its ends
+func elbow(values []float64) int {
+	first, last := values[0], values[len(values)-1]
+	if len(values) < 3 || first == last {
+		return 0
+	}
+	best, bestGain := 0, math.Inf(-1)
+	for k, value := range values {
+		x := float64(k) / float64(len(values)-1)
+		y := (first - value) / (first - last)
+		if gain := y - x; gain > bestGain {
+			best, bestGain = k, gain
+		}
+	}
+	return best
+}
+
+// maxSampleSize limits sample of ChooseClustersCount, silhouette criterion computes distances between all sampled pixels
+const maxSampleSize = 5000
+
+// ChooseClustersCount clusters random sample of pixels into 2..maxClustersCount clusters and returns
+// count which is the best by criterion, scores[k] is score of k+2 clusters. Sample has at most maxSampleSize pixels.
+func ChooseClustersCount(im image.Image, maxClustersCount int, criterion ClusterCriterion, sampleSize int, opts KMeansOptions) (_ int, scores []float64) {
+	space, dist := opts.spaceAndMetric()
+	pixelColors := visibleColors(imageColors(im, space))
+	rng := rand.New(rand.NewSource(opts.Seed))
+	sample := makeColorArray(min(min(sampleSize, maxSampleSize), len(pixelColors)))
+	for k := range sample {
+		sample[k] = pixelColors[rng.Intn(len(pixelColors))]
+	}
+
+	scores = make([]float64, 0, maxClustersCount-1)
+	// silhouettes of all counts are computed at once, so distances between pixels are computed once too
+	var assignments [][]int
+	for clustersCount := 2; clustersCount <= maxClustersCount; clustersCount++ {
+		centers := clusterColors(sample, clustersCount, dist, space, rng)
+		assignment := assignClusters(sample, centers, dist)
+		switch criterion {
+		case CriterionSilhouette:
+			assignments = append(assignments, assignment)
+		case CriterionDaviesBouldin:
+			scores = append(scores, daviesBouldin(sample, centers, assignment, dist))
+		default:
+			scores = append(scores, inertia(sample, centers, assignment, dist))
+		}
+	}
+	if criterion == CriterionSilhouette {
+		scores = silhouettes(sample, assignments, dist)
+	}
+
+	best := 0
+	switch criterion {
+	case CriterionSilhouette:
+		for k, score := range scores {
+			if score > scores[best] {
+				best = k
+			}
+		}
+	case CriterionDaviesBouldin:
+		for k, score := range scores {
+			if score < scores[best] {
+				best = k
+			}
+		}
+	default:
+		best = elbow(scores)
+	}
+	return best + 2, scores
+}
+
+// clustersCountParam returns number of clusters given as number or "auto", zero means auto
+func clustersCountParam(params Params) (int, error) {
+	value := params.String("nclusters")
+	if value == "auto" {
+		return 0, nil
+	}
+	clustersCount, err := strconv.Atoi(value)
+	if err != nil || clustersCount < 2 || clustersCount > 256 {
+		return 0, fmt.Errorf("'n' must be auto or number in 2..256, you gave n=%s", value)
+	}
+	return clustersCount, nil
+}
+
+func formatScores(criterion ClusterCriterion, scores []float64) string {
+	formatted := make([]string, len(scores))
+	for k, score := range scores {
+		formatted[k] = fmt.Sprintf("%d: %.4g", k+2, score)
+	}
+	return fmt.Sprintf("%s %s", criterion, strings.Join(formatted, ", "))
+}
@@ -1,13 +1,18 @@
 package fimgs
 
 import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
 	"runtime"
 	"testing"
 )
 
-func makeColorArray0(len int) [][]int64 {
-	data := make([]int64, len*3)
-	res := make([][]int64, len)
+func makeColorArray0(len int) [][]float64 {
+	data := make([]float64, len*3)
+	res := make([][]float64, len)
 	for i := 0; i < len; i++ {
 		res[i] = data[i*3 : i*3+3]
 	}
@@ -15,16 +20,137 @@ func makeColorArray0(len int) [][]int64 {
 }
 
 func BenchmarkMakeColorArray(b *testing.B) {
-	b.Run("make [][]i64", func(b *testing.B) {
+	b.Run("make [][]f64", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			x := makeColorArray0(10000)
 			runtime.KeepAlive(x)
 		}
 	})
-	b.Run("make [][3]i64", func(b *testing.B) {
+	b.Run("make [][3]f64", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			x := makeColorArray(10000)
 			runtime.KeepAlive(x)
 		}
 	})
 }
+
+func TestChooseClustersCount(t *testing.T) {
+	colors := []color.RGBA{{200, 30, 40, 255}, {20, 120, 220, 255}, {240, 240, 200, 255}}
+	im := image.NewRGBA(image.Rect(0, 0, 30, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 30; x++ {
+			c := colors[(x/10+y/10)%3]
+			c.G += uint8((x * y) % 5) // noise inside of clusters
+			im.SetRGBA(x, y, c)
+		}
+	}
+	for _, criterion := range ClusterCriteria {
+		clustersCount, scores := ChooseClustersCount(im, 8, criterion, 500, KMeansOptions{ColorSpace: ColorSpaceOKLab, Metric: MetricL2})
+		if clustersCount != 3 || len(scores) != 7 {
+			t.Fatalf("%s: got %d clusters with scores %v, want 3", criterion, clustersCount, scores)
+		}
+	}
+}
+
+func TestSilhouettes(t *testing.T) {
+	points := [][3]float64{{0}, {1}, {10}, {11}}
+	dist := func(a, b [3]float64) float64 { return math.Abs(a[0] - b[0]) }
+	got := silhouettes(points, [][]int{{0, 0, 1, 1}, {0, 1, 1, 1}}, dist)
+	want := []float64{(9.5/10.5 + 8.5/9.5) / 2, (1 - 8.5/9.5) / 4}
+	for k := range want {
+		if math.Abs(got[k]-want[k]) > 1e-12 {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestElbow(t *testing.T) {
+	for _, test := range []struct {
+		values []float64
+		want   int
+	}{
+		{[]float64{100, 50, 20, 18, 17, 16}, 2},
+		{[]float64{100, 20, 18, 17, 16}, 1},
+		{[]float64{5, 5, 5}, 0},
+		{[]float64{100, 10}, 0},
+	} {
+		if got := elbow(test.values); got != test.want {
+			t.Fatalf("elbow(%v) = %d, want %d", test.values, got, test.want)
+		}
+	}
+}
+
+func TestKMeansSeed(t *testing.T) {
+	im := randomImage(image.Rect(0, 0, 40, 30))
+	opts := KMeansOptions{ColorSpace: ColorSpaceOKLab, Metric: MetricL2, Seed: 42}
+	want := ApplyKMeans(im, 6, opts)
+	// concurrent runs must not share random state
+	results := make(chan *image.Paletted)
+	for i := 0; i < 4; i++ {
+		go func() { results <- ApplyKMeans(im, 6, opts) }()
+	}
+	for i := 0; i < 4; i++ {
+		got := <-results
+		if !bytes.Equal(got.Pix, want.Pix) || fmt.Sprint(got.Palette) != fmt.Sprint(want.Palette) {
+			t.Fatal("clustering with the same seed must give the same result")
+		}
+	}
+
+	cluster, _ := LookupFilter("cluster")
+	params, err := ParseParams(cluster, func(name string) (string, bool) {
+		value, ok := map[string]string{"nclusters": "3", "seed": "7"}[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := cluster.Apply(im, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, metadata := SplitMetadata(res); metadata["seed"] != "7" {
+		t.Fatalf("seed must be in metadata, got %v", metadata)
+	}
+}
+
+func TestKMeans16Bit(t *testing.T) {
+	colors := []color.NRGBA64{{0x1234, 0x5678, 0x9ABC, 0xFFFF}, {0xFEDC, 0xBA98, 0x7654, 0xFFFF}}
+	im := image.NewNRGBA64(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			im.SetNRGBA64(x, y, colors[x%2])
+		}
+	}
+	res := ApplyKMeans(im, 2, KMeansOptions{ColorSpace: ColorSpaceRGB, Metric: MetricL2})
+	for x, want := range colors {
+		got := color.NRGBA64Model.Convert(res.At(x, 0)).(color.NRGBA64)
+		if d := max3(abs(int(got.R)-int(want.R)), abs(int(got.G)-int(want.G)), abs(int(got.B)-int(want.B))); d > 1 {
+			t.Fatalf("pixel %d is %v, want %v", x, got, want)
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := EncodeImage(&encoded, res, SaveOptions{Format: FormatPNG, Depth: 16}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeImage(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBA64Model.Convert(decoded.At(0, 0)).(color.NRGBA64); got != res.Palette[res.Pix[0]] {
+		t.Fatalf("16-bit png has color %v, want %v", got, res.Palette[res.Pix[0]])
+	}
+}
+
+func TestClusterSampleLimit(t *testing.T) {
+	cluster, _ := LookupFilter("cluster")
+	for sample, ok := range map[string]bool{"1": false, "2": true, "5000": true, "5001": false} {
+		_, err := ParseParams(cluster, func(name string) (string, bool) {
+			value, ok := map[string]string{"nclusters": "auto", "sample": sample}[name]
+			return value, ok
+		})
+		if (err == nil) != ok {
+			t.Errorf("sample %s: got error %v", sample, err)
+		}
+	}
+}
@@ -4,146 +4,113 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"math"
 	"math/rand"
 )
 
-func Hsv2Rgb(h, s, v int) (int, int, int) {
-	_h := float64(h) / 60
-	_s := float64(s) / 100
-	_v := float64(v) / 100
-	f := _h - math.Floor(_h)
-	_v *= 255
-	p := _v * (1 - _s)
-	q := _v * (1 - (_s * f))
-	t := _v * (1 - (_s * (1 - f)))
-	__v, __t, __p, __q := int(math.Floor(_v)), int(math.Floor(t)), int(math.Floor(p)), int(math.Floor(q))
-	switch math.Mod(math.Floor(_h), 6) {
-	case 0:
-		return __v, __t, __p
-	case 1:
-		return __q, __v, __p
-	case 2:
-		return __p, __v, __t
-	case 3:
-		return __p, __q, __v
-	case 4:
-		return __t, __p, __v
-	case 5:
-		return __v, __p, __q
-	}
-	return 0, 0, 0
-}
-
-func Rgb2Hsv(rgb Color) (int, int, int) {
-	var s float64
-	r := float64(rgb[0]) / 0xFFFF
-	g := float64(rgb[1]) / 0xFFFF
-	b := float64(rgb[2]) / 0xFFFF
-	min := math.Min(math.Min(r, g), b)
-	v := math.Max(math.Max(r, g), b)
-	diff := v - min
-	diffc := func(c float64) float64 {
-		return (v-c)/6.0/diff + 0.5
-	}
-	if diff == 0 {
-		return 0, 0, int(math.Round(v * 100))
-	} else {
-		s = diff / v
-		rdif := diffc(r)
-		gdif := diffc(g)
-		bdif := diffc(b)
-		var h float64
-		if r == v {
-			h = bdif - gdif
-		} else if g == v {
-			h = (1.0 / 3.0) + rdif - bdif
-		} else if b == v {
-			h = (2.0 / 3.0) + gdif - rdif
-		}
-		if h < 0 {
-			h += 1
-		} else if h > 1 {
-			h -= 1
-		}
-		return int(math.Round(h * 360)), int(math.Round(s * 100)), int(math.Round(v * 100))
-	}
-}
-
-func randomPartition(arr []int, l, r int) int {
-	n := r - l
-	pivot := rand.Intn(n)
-	arr[l+pivot], arr[l] = arr[l], arr[l+pivot]
-	x := arr[l]
-	i := l + 1
-	for j := l + 2; j < r; j++ {
+// randomPartition moves random pivot of arr[l:r] to its sorted position and returns the position,
+// elements not greater than pivot go before it and greater ones after it
+func randomPartition(arr []int, l, r int, rng *rand.Rand) int {
+	pivot := l + rng.Intn(r-l)
+	arr[pivot], arr[r-1] = arr[r-1], arr[pivot]
+	x := arr[r-1]
+	i := l
+	for j := l; j < r-1; j++ {
 		if arr[j] <= x {
 			arr[i], arr[j] = arr[j], arr[i]
 			i++
 		}
 	}
-	arr[i], arr[l] = arr[l], arr[i]
+	arr[i], arr[r-1] = arr[r-1], arr[i]
 	return i
 }
 
-func kthSmallest(arr []int, l, r, k int) int {
-	pos := randomPartition(arr, l, r)
+// kthSmallest returns k-th smallest element of arr[l:r] counting from zero, arr is reordered
+func kthSmallest(arr []int, l, r, k int, rng *rand.Rand) int {
+	pos := randomPartition(arr, l, r, rng)
 	leftPartSize := pos - l
 	switch {
 	case leftPartSize == k:
 		return arr[pos]
 	case leftPartSize > k:
-		return kthSmallest(arr, l, pos, k)
+		return kthSmallest(arr, l, pos, k, rng)
 	default:
-		return kthSmallest(arr, pos, r, k-leftPartSize)
+		return kthSmallest(arr, pos+1, r, k-leftPartSize-1, rng)
 	}
 }
 
-func Median(im image.Image, windowSize int) image.RGBA {
+// Median replaces colors with median of hue, saturation and value of non-premultiplied colors in window,
+// alpha is replaced with median alpha
+func Median(im image.Image, windowSize int, border Border) image.NRGBA64 {
 	halfWindowSize := windowSize / 2
-	himage := image.NewRGBA(im.Bounds())
-	window := make([]Color, windowSize*windowSize)
-	hWindow := make([]int, windowSize*windowSize)
-	sWindow := make([]int, windowSize*windowSize)
-	vWindow := make([]int, windowSize*windowSize)
-	for i := im.Bounds().Min.X; i < im.Bounds().Max.X; i++ {
-		for j := im.Bounds().Min.Y; j < im.Bounds().Max.Y; j++ {
+	bounds := border.bounds(im.Bounds(), windowSize, windowSize)
+	himage := image.NewNRGBA64(bounds)
+	// channels are scaled to 0..0xFFFF
+	var windows [4][]int
+	for c := range windows {
+		windows[c] = make([]int, windowSize*windowSize)
+	}
+	// pivots affect speed only, result does not depend on seed
+	rng := rand.New(rand.NewSource(0))
+	for i := bounds.Min.X; i < bounds.Max.X; i++ {
+		for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
 			k := 0
 			for ki := -halfWindowSize; ki <= halfWindowSize; ki++ {
 				for kj := -halfWindowSize; kj <= halfWindowSize; kj++ {
-					r, g, b, _ := im.At(
-						min(max(im.Bounds().Min.X, i+ki), im.Bounds().Max.X),
-						min(max(im.Bounds().Min.Y, j+kj), im.Bounds().Max.Y),
-					).RGBA()
-					window[k] = Color{int(r), int(g), int(b)}
-					hWindow[k], sWindow[k], vWindow[k] = Rgb2Hsv(window[k])
+					c := color.NRGBA64Model.Convert(border.at(im, i+ki, j+kj)).(color.NRGBA64)
+					hsv := rgbToHSV([3]float64{float64(c.R) / 0xFFFF, float64(c.G) / 0xFFFF, float64(c.B) / 0xFFFF})
+					for c := 0; c < 3; c++ {
+						windows[c][k] = int(clamp16(hsv[c] * 0xFFFF))
+					}
+					windows[3][k] = int(c.A)
 					k++
 				}
 			}
 			// TODO: somehow sort by color
-			h := kthSmallest(hWindow, 0, len(hWindow), len(hWindow)/2)
-			s := kthSmallest(sWindow, 0, len(sWindow), len(sWindow)/2)
-			v := kthSmallest(vWindow, 0, len(vWindow), len(vWindow)/2)
-			r, g, b := Hsv2Rgb(h, s, v)
-			himage.Set(i, j, color.RGBA64{
-				uint16(r * 0x100),
-				uint16(g * 0x100),
-				uint16(b * 0x100),
-				0xFFFF,
+			var median [4]float64
+			for c, window := range windows {
+				median[c] = float64(kthSmallest(window, 0, len(window), len(window)/2, rng)) / 0xFFFF
+			}
+			rgb := hsvToRGB([3]float64{median[0], median[1], median[2]})
+			himage.SetNRGBA64(i, j, color.NRGBA64{
+				clamp16(rgb[0] * 0xFFFF),
+				clamp16(rgb[1] * 0xFFFF),
+				clamp16(rgb[2] * 0xFFFF),
+				clamp16(median[3] * 0xFFFF),
 			})
 		}
 	}
 	return *himage
 }
 
-func MedianFilter(sourceImageFilename, resultImageFilename string, windowSize int) error {
-	if windowSize < 0 || windowSize%2 == 0 {
-		return fmt.Errorf("window size must be positive and odd, but it isn't: %d", windowSize)
-	}
-	im, err := LoadImageFile(sourceImageFilename)
-	if err != nil {
-		return fmt.Errorf("error occured during loading image:\n%q", err)
-	}
-	resImage := Median(im, windowSize)
-	return saveImage(resImage, resultImageFilename)
+func init() {
+	Register(&filter{
+		name:        "median",
+		title:       "Median",
+		description: "Replace each pixel's color with median color of neighbourhood.",
+		params: append([]Param{{
+			Name:    "window",
+			Alias:   "w",
+			Type:    ParamInt,
+			Usage:   "window size, must be odd and positive",
+			Default: 5,
+		}}, append(borderParams(), alphaParam())...),
+		validate: func(params Params) error {
+			if windowSize := params.Int("window"); windowSize < 0 || windowSize%2 == 0 {
+				return fmt.Errorf("window size must be positive and odd, but it isn't: %d", windowSize)
+			}
+			return validateBorder(params)
+		},
+		filtersAlpha: filtersAlphaParam,
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			border, err := borderFromParams(params)
+			if err != nil {
+				return nil, err
+			}
+			res := Median(im, params.Int("window"), border)
+			if res.Bounds().Empty() {
+				return nil, errEmptyResult
+			}
+			return &res, nil
+		},
+	})
 }
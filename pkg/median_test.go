@@ -0,0 +1,42 @@
+package fimgs
+
+import (
+	"image"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestKthSmallest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 2000; n++ {
+		arr := make([]int, 1+rng.Intn(50))
+		for i := range arr {
+			// small range gives many duplicates
+			arr[i] = rng.Intn(1 + rng.Intn(100))
+		}
+		sorted := slices.Clone(arr)
+		sort.Ints(sorted)
+		k := rng.Intn(len(arr))
+		for seed := int64(0); seed < 5; seed++ {
+			if got := kthSmallest(slices.Clone(arr), 0, len(arr), k, rand.New(rand.NewSource(seed))); got != sorted[k] {
+				t.Fatalf("%d-th smallest of %v with seed %d is %d, want %d", k, arr, seed, got, sorted[k])
+			}
+		}
+	}
+}
+
+func TestMedianWindow1(t *testing.T) {
+	im := randomImage(image.Rect(0, 0, 6, 4))
+	median, _ := LookupFilter("median")
+	params, err := ParseParams(median, func(name string) (string, bool) {
+		return "1", name == "window"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := median.Apply(im, params); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,73 @@
+package fimgs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"sort"
+)
+
+// Metadata is information about how image was produced, e.g. cluster count chosen by filter.
+// CLI prints it, web server shows it and it is saved into PNG text chunks.
+type Metadata map[string]string
+
+// Keys returns metadata keys in sorted order
+func (m Metadata) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type metadataImage struct {
+	image.Image
+	metadata Metadata
+}
+
+// WithMetadata attaches metadata to image, it is merged with metadata attached already
+func WithMetadata(im image.Image, metadata Metadata) image.Image {
+	im, merged := SplitMetadata(im)
+	if len(merged)+len(metadata) == 0 {
+		return im
+	}
+	if merged == nil {
+		merged = Metadata{}
+	}
+	for key, value := range metadata {
+		merged[key] = value
+	}
+	return &metadataImage{im, merged}
+}
+
+// SplitMetadata returns image without metadata and copy of metadata attached to it, nil if there is none
+func SplitMetadata(im image.Image) (image.Image, Metadata) {
+	withMetadata, ok := im.(*metadataImage)
+	if !ok {
+		return im, nil
+	}
+	metadata := make(Metadata, len(withMetadata.metadata))
+	for key, value := range withMetadata.metadata {
+		metadata[key] = value
+	}
+	return withMetadata.Image, metadata
+}
+
+// pngWithText inserts metadata as tEXt chunks after IHDR chunk of encoded PNG
+func pngWithText(encoded []byte, metadata Metadata) []byte {
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4 // signature, length, type, header data, crc
+	var chunks bytes.Buffer
+	for _, key := range metadata.Keys() {
+		data := append(append([]byte(key), 0), metadata[key]...)
+		binary.Write(&chunks, binary.BigEndian, uint32(len(data)))
+		typeAndData := append([]byte("tEXt"), data...)
+		chunks.Write(typeAndData)
+		binary.Write(&chunks, binary.BigEndian, crc32.ChecksumIEEE(typeAndData))
+	}
+	res := make([]byte, 0, len(encoded)+chunks.Len())
+	res = append(res, encoded[:ihdrEnd]...)
+	res = append(res, chunks.Bytes()...)
+	return append(res, encoded[ihdrEnd:]...)
+}
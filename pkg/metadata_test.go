@@ -0,0 +1,43 @@
+package fimgs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveImageFileMetadata(t *testing.T) {
+	im := WithMetadata(image.NewRGBA(image.Rect(0, 0, 2, 2)), Metadata{"seed": "1"})
+	im = WithMetadata(im, Metadata{"nclusters": "3", "seed": "2"})
+	filename := filepath.Join(t.TempDir(), "res.png")
+	if err := SaveImageFile(im, filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("saved image is not valid png: %v", err)
+	}
+	texts := []string{}
+	for offset := 8; offset < len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		typeAndData := data[offset+4 : offset+8+length]
+		if crc := binary.BigEndian.Uint32(data[offset+8+length:]); crc != crc32.ChecksumIEEE(typeAndData) {
+			t.Fatalf("invalid crc of %s chunk", typeAndData[:4])
+		}
+		if string(typeAndData[:4]) == "tEXt" {
+			texts = append(texts, string(bytes.ReplaceAll(typeAndData[4:], []byte{0}, []byte("="))))
+		}
+		offset += 12 + length
+	}
+	if len(texts) != 2 || texts[0] != "nclusters=3" || texts[1] != "seed=2" {
+		t.Fatalf("unexpected text chunks %q", texts)
+	}
+}
@@ -0,0 +1,168 @@
+package fimgs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// PaletteColor is color of palette and share of image pixels having it
+type PaletteColor struct {
+	Color color.RGBA
+	Share float64
+}
+
+func (c PaletteColor) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.Color.R, c.Color.G, c.Color.B)
+}
+
+type Palette []PaletteColor
+
+// ImagePalette returns colors used by paletted image, e.g. result of cluster filter, sorted by share descending.
+// Palette entries differing in alpha only are merged, fully transparent pixels are not counted.
+// ok is false if image is not paletted.
+func ImagePalette(im image.Image) (_ Palette, ok bool) {
+	im, _ = SplitMetadata(im)
+	paletted, ok := im.(*image.Paletted)
+	if !ok {
+		return nil, false
+	}
+	counts := make([]int, len(paletted.Palette))
+	for j := paletted.Rect.Min.Y; j < paletted.Rect.Max.Y; j++ {
+		for i := paletted.Rect.Min.X; i < paletted.Rect.Max.X; i++ {
+			counts[paletted.ColorIndexAt(i, j)]++
+		}
+	}
+	palette := Palette{}
+	index := map[color.RGBA]int{}
+	total := 0
+	for k, c := range paletted.Palette {
+		nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if counts[k] == 0 || nrgba.A == 0 {
+			continue
+		}
+		total += counts[k]
+		rgb := color.RGBA{nrgba.R, nrgba.G, nrgba.B, 255}
+		if n, ok := index[rgb]; ok {
+			palette[n].Share += float64(counts[k])
+			continue
+		}
+		index[rgb] = len(palette)
+		palette = append(palette, PaletteColor{Color: rgb, Share: float64(counts[k])})
+	}
+	for k := range palette {
+		palette[k].Share /= float64(total)
+	}
+	sort.SliceStable(palette, func(i, j int) bool {
+		return palette[i].Share > palette[j].Share
+	})
+	return palette, true
+}
+
+// WriteJSON writes palette as array of objects like {"color": "#ff8000", "share": 0.25}
+func (p Palette) WriteJSON(w io.Writer) error {
+	type jsonColor struct {
+		Color string  `json:"color"`
+		Share float64 `json:"share"`
+	}
+	colors := make([]jsonColor, len(p))
+	for k, c := range p {
+		colors[k] = jsonColor{c.Hex(), math.Round(c.Share*1e4) / 1e4}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(colors)
+}
+
+// WriteGPL writes palette in GIMP palette format
+func (p Palette) WriteGPL(w io.Writer, name string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "GIMP Palette\nName: %s\nColumns: %d\n#\n", name, len(p))
+	for _, c := range p {
+		fmt.Fprintf(bw, "%3d %3d %3d\t%s %.1f%%\n", c.Color.R, c.Color.G, c.Color.B, c.Hex(), c.Share*100)
+	}
+	return bw.Flush()
+}
+
+// WriteASE writes palette in Adobe Swatch Exchange format, colors are named by hex codes and grouped under name
+func (p Palette) WriteASE(w io.Writer, name string) error {
+	utf16Name := func(s string) []uint16 {
+		return append(utf16.Encode([]rune(s)), 0)
+	}
+	groupName := utf16Name(name)
+	data := []any{
+		[]byte("ASEF"),
+		uint16(1), uint16(0), // version
+		uint32(len(p) + 2), // blocks count, including group start and end
+		uint16(0xC001), uint32(2 + 2*len(groupName)), uint16(len(groupName)), groupName,
+	}
+	for _, c := range p {
+		colorName := utf16Name(c.Hex())
+		data = append(data,
+			uint16(0x0001), uint32(2+2*len(colorName)+4+3*4+2), uint16(len(colorName)), colorName,
+			[]byte("RGB "),
+			float32(c.Color.R)/255, float32(c.Color.G)/255, float32(c.Color.B)/255,
+			uint16(2), // normal color
+		)
+	}
+	data = append(data, uint16(0xC002), uint32(0))
+	for _, x := range data {
+		if err := binary.Write(w, binary.BigEndian, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Swatches returns strip of size x size squares of palette colors
+func (p Palette) Swatches(size int) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, size*len(p), size))
+	for j := 0; j < size; j++ {
+		for i := 0; i < size*len(p); i++ {
+			im.SetRGBA(i, j, p[i/size].Color)
+		}
+	}
+	return im
+}
+
+// PaletteFormats are extensions of palette files
+var PaletteFormats = []string{".json", ".gpl", ".ase", ".png"}
+
+// SavePaletteFile saves palette in format chosen by filename extension, one of PaletteFormats
+func SavePaletteFile(p Palette, filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".png" {
+		return SaveImageFile(p.Swatches(64), filename)
+	}
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	var write func(io.Writer) error
+	switch ext {
+	case ".json":
+		write = p.WriteJSON
+	case ".gpl":
+		write = func(w io.Writer) error { return p.WriteGPL(w, name) }
+	case ".ase":
+		write = func(w io.Writer) error { return p.WriteASE(w, name) }
+	default:
+		return fmt.Errorf("unknown palette format %q, must be one of %s", ext, strings.Join(PaletteFormats, ", "))
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
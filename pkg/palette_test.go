@@ -0,0 +1,64 @@
+package fimgs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func testPalette() Palette {
+	im := image.NewPaletted(image.Rect(0, 0, 4, 1), color.Palette{
+		color.RGBA{255, 128, 0, 255},
+		color.RGBA{0, 0, 0, 255},
+		color.RGBA{1, 2, 3, 255},
+	})
+	im.Pix = []uint8{1, 0, 1, 1}
+	p, _ := ImagePalette(im)
+	return p
+}
+
+func TestImagePalette(t *testing.T) {
+	p := testPalette()
+	if len(p) != 2 || p[0].Hex() != "#000000" || p[0].Share != 0.75 || p[1].Hex() != "#ff8000" || p[1].Share != 0.25 {
+		t.Fatalf("unexpected palette %v", p)
+	}
+	if _, ok := ImagePalette(image.NewRGBA(image.Rect(0, 0, 1, 1))); ok {
+		t.Fatal("RGBA image must have no palette")
+	}
+}
+
+func TestPaletteFormats(t *testing.T) {
+	p := testPalette()
+
+	var b bytes.Buffer
+	if err := p.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(strings.Fields(b.String()), ""); got != `[{"color":"#000000","share":0.75},{"color":"#ff8000","share":0.25}]` {
+		t.Fatalf("unexpected json %s", got)
+	}
+
+	b.Reset()
+	if err := p.WriteGPL(&b, "test"); err != nil {
+		t.Fatal(err)
+	}
+	want := "GIMP Palette\nName: test\nColumns: 2\n#\n  0   0   0\t#000000 75.0%\n255 128   0\t#ff8000 25.0%\n"
+	if b.String() != want {
+		t.Fatalf("unexpected gpl:\n%s", b.String())
+	}
+
+	b.Reset()
+	if err := p.WriteASE(&b, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// header, group start with name, two colors with 8 character names and group end
+	if size := 12 + (6 + 2 + 2*5) + 2*(6+2+2*8+4+12+2) + 6; b.Len() != size || !bytes.HasPrefix(b.Bytes(), []byte("ASEF")) {
+		t.Fatalf("unexpected ase of %d bytes, want %d", b.Len(), size)
+	}
+
+	if swatches := p.Swatches(4); swatches.Bounds() != image.Rect(0, 0, 8, 4) || swatches.RGBAAt(5, 3) != p[1].Color {
+		t.Fatalf("unexpected swatches %v", swatches.Bounds())
+	}
+}
@@ -0,0 +1,180 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+type PipelineStep struct {
+	Filter Filter
+	Params Params
+}
+
+// Pipeline is sequence of filters applied one after another to image in memory.
+type Pipeline []PipelineStep
+
+func (p Pipeline) Apply(im image.Image) (image.Image, error) {
+	return p.ApplyEach(im, nil)
+}
+
+// ApplyEach applies pipeline calling onStep, if not nil, with result of every step, steps are numbered from 1.
+// Metadata of steps results is merged, so later steps override values set by earlier ones.
+func (p Pipeline) ApplyEach(im image.Image, onStep func(step int, im image.Image) error) (image.Image, error) {
+	im, metadata := SplitMetadata(im)
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+	for i, step := range p {
+		res, err := step.Filter.Apply(im, step.Params)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i+1, step.Filter.Name(), err)
+		}
+		// filters get images without metadata, so they can use fast paths for concrete image types
+		var stepMetadata Metadata
+		im, stepMetadata = SplitMetadata(res)
+		for key, value := range stepMetadata {
+			metadata[key] = value
+		}
+		if onStep != nil {
+			if err := onStep(i+1, WithMetadata(im, metadata)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return WithMetadata(im, metadata), nil
+}
+
+const pipeToken = "|"
+
+// tokenizePipeline splits pipeline source into words and pipes. Words might be
+// quoted with ' or ", everything after # until the end of line is ignored.
+func tokenizePipeline(source string) ([]string, error) {
+	tokens := []string{}
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			tokens = append(tokens, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(source); i++ {
+		switch c := source[i]; c {
+		case ' ', '\t', '\n', '\r':
+			flush()
+		case '|':
+			flush()
+			tokens = append(tokens, pipeToken)
+		case '#':
+			flush()
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case '\'', '"':
+			end := strings.IndexByte(source[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote at position %d", i)
+			}
+			word.WriteString(source[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+func parsePipelineStep(words []string, readText func(string) (string, error)) (PipelineStep, error) {
+	f, ok := LookupFilter(words[0])
+	if !ok {
+		return PipelineStep{}, fmt.Errorf("unknown filter %q", words[0])
+	}
+	raw := map[string]string{}
+	for i := 1; i < len(words); i++ {
+		arg := words[i]
+		flag := strings.TrimLeft(arg, "-")
+		if flag == arg || flag == "" {
+			return PipelineStep{}, fmt.Errorf("%s: expected flag, got %q", f.Name(), arg)
+		}
+		name, value, hasValue := strings.Cut(flag, "=")
+		if !hasValue {
+			if i+1 == len(words) {
+				return PipelineStep{}, fmt.Errorf("%s: flag %q has no value", f.Name(), arg)
+			}
+			i++
+			value = words[i]
+		}
+		param, ok := findParam(f, name)
+		if !ok {
+			return PipelineStep{}, fmt.Errorf("%s: unknown flag %q", f.Name(), arg)
+		}
+		if param.Type == ParamText || param.Type == ParamFile {
+			text, err := readText(value)
+			if err != nil {
+				return PipelineStep{}, fmt.Errorf("%s: error loading %q param: %w", f.Name(), param.Name, err)
+			}
+			value = text
+		}
+		if prev, ok := raw[param.Name]; ok && param.Repeated {
+			value = prev + "\n" + value
+		}
+		raw[param.Name] = value
+	}
+	params, err := ParseParams(f, func(name string) (string, bool) {
+		value, ok := raw[name]
+		return value, ok
+	})
+	if err != nil {
+		return PipelineStep{}, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return PipelineStep{f, params}, nil
+}
+
+func findParam(f Filter, name string) (Param, bool) {
+	for _, param := range f.Params() {
+		if param.Name == name || param.Alias == name {
+			return param, true
+		}
+	}
+	return Param{}, false
+}
+
+// ParsePipeline parses pipeline like "median -w 5 | cluster -n 6 | edgedetect2".
+// Values of text and file params are passed through readText, e.g. to load them from files.
+func ParsePipeline(source string, readText func(string) (string, error)) (Pipeline, error) {
+	tokens, err := tokenizePipeline(source)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := Pipeline{}
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && tokens[end] != pipeToken {
+			end++
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("empty step %d in pipeline", len(pipeline)+1)
+		}
+		step, err := parsePipelineStep(tokens[:end], readText)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", len(pipeline)+1, err)
+		}
+		pipeline = append(pipeline, step)
+		if end == len(tokens) {
+			break
+		}
+		tokens = tokens[end+1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("empty step %d in pipeline", len(pipeline)+1)
+		}
+	}
+	if len(pipeline) == 0 {
+		return nil, fmt.Errorf("pipeline is empty")
+	}
+	return pipeline, nil
+}
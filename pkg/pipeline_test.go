@@ -0,0 +1,46 @@
+package fimgs
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	readText := func(filename string) (string, error) {
+		return "source of " + filename, nil
+	}
+	pipeline, err := ParsePipeline(`
+# comment | not a step
+median -w 5 | cluster --nclusters=6
+| shader -s "my shader.glsl" -u a=1 -u b=2,3`, readText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprintf("%s %v %s %v %s %q %q",
+		pipeline[0].Filter.Name(), pipeline[0].Params["window"],
+		pipeline[1].Filter.Name(), pipeline[1].Params["nclusters"],
+		pipeline[2].Filter.Name(), pipeline[2].Params["shader"], pipeline[2].Params["uniforms"],
+	)
+	want := `median 5 cluster 6 shader "source of my shader.glsl" "a=1\nb=2,3"`
+	if len(pipeline) != 3 || got != want {
+		t.Fatalf("got %d steps: %s, want: %s", len(pipeline), got, want)
+	}
+
+	for _, source := range []string{
+		"",
+		"median |",
+		"| median",
+		"median || cluster -n 3",
+		"nosuchfilter",
+		"median -w",
+		"median -w 4",
+		"median -x 5",
+		"cluster",
+		"median 'unterminated",
+		"shader -s x.glsl -u a",
+	} {
+		if _, err := ParsePipeline(source, readText); err == nil {
+			t.Errorf("expected error for %q", source)
+		}
+	}
+}
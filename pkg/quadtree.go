@@ -74,7 +74,7 @@ func colorDiff(minColor, maxColor Color) int {
 	return max3(maxColor[0]-minColor[0], maxColor[1]-minColor[1], maxColor[2]-minColor[2])
 }
 
-func QuadTree(im image.Image, power float64, threshold int) *image.RGBA {
+func QuadTree(im image.Image, power float64, threshold int) *image.NRGBA64 {
 	imageWidth := im.Bounds().Dx()
 	imageSize := imageWidth * im.Bounds().Dy()
 	dsuParent := make([]int, imageSize)
@@ -84,7 +84,7 @@ func QuadTree(im image.Image, power float64, threshold int) *image.RGBA {
 	for i := 0; i < imageSize; i++ {
 		dsuParent[i] = i
 		blockWidth[i] = 1
-		r, g, b, _ := im.At(i%imageWidth, i/imageWidth).RGBA()
+		r, g, b, _ := im.At(im.Bounds().Min.X+i%imageWidth, im.Bounds().Min.Y+i/imageWidth).RGBA()
 		minColor[i] = Color{int(r), int(g), int(b)}
 		maxColor[i] = Color{int(r), int(g), int(b)}
 	}
@@ -117,7 +117,7 @@ func QuadTree(im image.Image, power float64, threshold int) *image.RGBA {
 			}
 		}
 	}
-	himage := image.NewRGBA(im.Bounds())
+	himage := image.NewNRGBA64(im.Bounds())
 	draw.Draw(himage, himage.Bounds(), &image.Uniform{color.RGBA{0, 0, 0, 255}}, image.Point{}, draw.Src)
 	for i := 0; i < imageSize; i++ {
 		p := parent(dsuParent, i)
@@ -128,23 +128,44 @@ func QuadTree(im image.Image, power float64, threshold int) *image.RGBA {
 		if math.Pow(math.Pow(math.Abs(float64(dx)), power)+math.Pow(math.Abs(float64(dy)), power), 1./power) <= float64(halfQuadSize) {
 			ci := minColor[p]
 			ca := maxColor[p]
-			himage.Set(xi, yi, color.RGBA64{uint16((ci[0] + ca[0]) / 2), uint16((ci[1] + ca[1]) / 2), uint16((ci[2] + ca[2]) / 2), 0xFFFF})
+			himage.Set(im.Bounds().Min.X+xi, im.Bounds().Min.Y+yi, color.NRGBA64{uint16((ci[0] + ca[0]) / 2), uint16((ci[1] + ca[1]) / 2), uint16((ci[2] + ca[2]) / 2), 0xFFFF})
 		}
 	}
 	return himage
 }
 
-func QudTreeFilter(sourceImageFilename, resultImageFilename string, power float64, threshold int) error {
-	if power <= 0.0 {
-		return fmt.Errorf("power should be greater than 0")
-	}
-	if threshold <= 0 || threshold > 0xFFFF {
-		return fmt.Errorf("threshold should be greater than 0 and less than 65535")
-	}
-	im, err := LoadImageFile(sourceImageFilename)
-	if err != nil {
-		return err
-	}
-	tmp := QuadTree(im, power, threshold)
-	return saveImage(*tmp, resultImageFilename)
+func init() {
+	Register(&filter{
+		name:        "quadtree",
+		title:       "Quad tree",
+		description: "Apply quad tree like filter.",
+		params: []Param{
+			{
+				Name:    "threshold",
+				Alias:   "t",
+				Type:    ParamInt,
+				Usage:   "must be from 0 to 65536 exclusive",
+				Default: 32000,
+			},
+			{
+				Name:    "power",
+				Alias:   "p",
+				Type:    ParamFloat,
+				Usage:   "must be greater than 0.0",
+				Default: 2.0,
+			},
+		},
+		validate: func(params Params) error {
+			if params.Float("power") <= 0.0 {
+				return fmt.Errorf("power should be greater than 0")
+			}
+			if threshold := params.Int("threshold"); threshold <= 0 || threshold > 0xFFFF {
+				return fmt.Errorf("threshold should be greater than 0 and less than 65535")
+			}
+			return nil
+		},
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			return QuadTree(im, params.Float("power"), params.Int("threshold")), nil
+		},
+	})
 }
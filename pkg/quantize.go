@@ -0,0 +1,298 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Dithering is the way quantization error is hidden
+type Dithering = string
+
+const (
+	DitherNone           Dithering = "none"
+	DitherFloydSteinberg Dithering = "floyd-steinberg"
+	DitherAtkinson       Dithering = "atkinson"
+	DitherSierra         Dithering = "sierra"
+	DitherBayer2         Dithering = "bayer2"
+	DitherBayer4         Dithering = "bayer4"
+	DitherBayer8         Dithering = "bayer8"
+)
+
+var Ditherings = []string{DitherNone, DitherFloydSteinberg, DitherAtkinson, DitherSierra, DitherBayer2, DitherBayer4, DitherBayer8}
+
+// errorDiffusion distributes quantization error of pixel to its neighbours to the right and below
+type errorDiffusion []struct {
+	dx, dy int
+	weight float64
+}
+
+var errorDiffusions = map[Dithering]errorDiffusion{
+	DitherFloydSteinberg: {
+		{1, 0, 7.0 / 16},
+		{-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16},
+	},
+	// Atkinson diffuses only 3/4 of error, so contrast is kept
+	DitherAtkinson: {
+		{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8},
+		{-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8},
+		{0, 2, 1.0 / 8},
+	},
+	DitherSierra: {
+		{1, 0, 5.0 / 32}, {2, 0, 3.0 / 32},
+		{-2, 1, 2.0 / 32}, {-1, 1, 4.0 / 32}, {0, 1, 5.0 / 32}, {1, 1, 4.0 / 32}, {2, 1, 2.0 / 32},
+		{-1, 2, 2.0 / 32}, {0, 2, 3.0 / 32}, {1, 2, 2.0 / 32},
+	},
+}
+
+var bayerSizes = map[Dithering]int{DitherBayer2: 2, DitherBayer4: 4, DitherBayer8: 8}
+
+// bayerMatrix returns size x size ordered dithering thresholds in (0, 1), size must be power of 2
+func bayerMatrix(size int) [][]float64 {
+	m := [][]int{{0}}
+	for n := 1; n < size; n *= 2 {
+		next := make([][]int, 2*n)
+		for i := range next {
+			next[i] = make([]int, 2*n)
+			for j := range next[i] {
+				next[i][j] = 4*m[i%n][j%n] + [2][2]int{{0, 2}, {3, 1}}[i/n][j/n]
+			}
+		}
+		m = next
+	}
+	res := make([][]float64, size)
+	for i := range res {
+		res[i] = make([]float64, size)
+		for j := range res[i] {
+			res[i][j] = (float64(m[i][j]) + 0.5) / float64(size*size)
+		}
+	}
+	return res
+}
+
+// Quantize replaces colors of image with the nearest colors of palette, comparing them in color space and metric
+// of opts. Dithering is done in sRGB.
+func Quantize(im image.Image, palette color.Palette, dithering Dithering, opts KMeansOptions) *image.Paletted {
+	space, dist := opts.spaceAndMetric()
+	paletteRGB := make([][3]float64, len(palette))
+	paletteColors := make([][3]float64, len(palette))
+	for k, c := range palette {
+		r, g, b, _ := c.RGBA()
+		paletteRGB[k] = [3]float64{float64(r) / 0xFFFF, float64(g) / 0xFFFF, float64(b) / 0xFFFF}
+		paletteColors[k] = space.from(paletteRGB[k])
+	}
+
+	bounds := im.Bounds()
+	width := bounds.Dx()
+	pixels := make([][3]float64, width*bounds.Dy())
+	for j := 0; j < bounds.Dy(); j++ {
+		for i := 0; i < width; i++ {
+			r, g, b, _ := im.At(bounds.Min.X+i, bounds.Min.Y+j).RGBA()
+			pixels[j*width+i] = [3]float64{float64(r) / 0xFFFF, float64(g) / 0xFFFF, float64(b) / 0xFFFF}
+		}
+	}
+
+	diffusion := errorDiffusions[dithering]
+	var thresholds [][]float64
+	if size, ok := bayerSizes[dithering]; ok {
+		thresholds = bayerMatrix(size)
+	}
+	// ordered dithering shifts colors by up to typical distance between palette colors
+	spread := 1 / math.Cbrt(float64(len(palette)))
+
+	res := image.NewPaletted(bounds, palette)
+	for j := 0; j < bounds.Dy(); j++ {
+		for i := 0; i < width; i++ {
+			p := pixels[j*width+i]
+			if thresholds != nil {
+				offset := (thresholds[j%len(thresholds)][i%len(thresholds)] - 0.5) * spread
+				p = [3]float64{p[0] + offset, p[1] + offset, p[2] + offset}
+			}
+			// error is taken from clamped color, otherwise it grows without bound for colors out of palette gamut
+			clamped := mapChannels(p, func(x float64) float64 { return math.Min(math.Max(x, 0), 1) })
+			nearest, _ := nearestCluster(space.from(clamped), paletteColors, dist)
+			res.Pix[j*res.Stride+i] = uint8(nearest)
+			for _, d := range diffusion {
+				x, y := i+d.dx, j+d.dy
+				if x < 0 || x >= width || y >= bounds.Dy() {
+					continue
+				}
+				q := &pixels[y*width+x]
+				for c := 0; c < 3; c++ {
+					q[c] += (clamped[c] - paletteRGB[nearest][c]) * d.weight
+				}
+			}
+		}
+	}
+	return res
+}
+
+func hexPalette(colors ...string) color.Palette {
+	palette := make(color.Palette, len(colors))
+	for k, c := range colors {
+		palette[k], _ = ParseHexColor(c)
+	}
+	return palette
+}
+
+func webSafePalette() color.Palette {
+	palette := make(color.Palette, 0, 216)
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				palette = append(palette, color.RGBA{uint8(r * 0x33), uint8(g * 0x33), uint8(b * 0x33), 255})
+			}
+		}
+	}
+	return palette
+}
+
+// PalettePresets are well known palettes available by name
+var PalettePresets = map[string]color.Palette{
+	"bw":      hexPalette("#000000", "#ffffff"),
+	"gameboy": hexPalette("#0f380f", "#306230", "#8bac0f", "#9bbc0f"),
+	"websafe": webSafePalette(),
+}
+
+// ParsePalette parses palette preset name, GIMP palette or list of hex colors separated by spaces, commas or new lines
+func ParsePalette(s string) (color.Palette, error) {
+	s = strings.TrimSpace(s)
+	if palette, ok := PalettePresets[s]; ok {
+		return palette, nil
+	}
+	palette := color.Palette{}
+	if strings.HasPrefix(s, "GIMP Palette") {
+		for n, line := range strings.Split(s, "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.Contains(fields[0], ":") {
+				continue
+			}
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("invalid color in line %d of GIMP palette: %q", n+2, line)
+			}
+			var rgb [3]uint8
+			for c := range rgb {
+				x, err := strconv.ParseUint(fields[c], 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid color in line %d of GIMP palette: %q", n+2, line)
+				}
+				rgb[c] = uint8(x)
+			}
+			palette = append(palette, color.RGBA{rgb[0], rgb[1], rgb[2], 255})
+		}
+	} else {
+		for _, hex := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' || unicode.IsSpace(c) }) {
+			c, err := ParseHexColor(hex)
+			if err != nil {
+				return nil, err
+			}
+			palette = append(palette, c)
+		}
+	}
+	if len(palette) == 0 || len(palette) > 256 {
+		return nil, fmt.Errorf("palette must have from 1 to 256 colors, but it has %d", len(palette))
+	}
+	return palette, nil
+}
+
+// paletteParam returns palette given inline, as file contents or clustered from image file
+func paletteParam(params Params) (color.Palette, error) {
+	palette, paletteFile, paletteImage := params.String("palette"), params.String("palettefile"), params.String("paletteimage")
+	given := 0
+	for _, source := range []string{palette, paletteFile, paletteImage} {
+		if source != "" {
+			given++
+		}
+	}
+	switch {
+	case given != 1:
+		return nil, fmt.Errorf("palette must be given by exactly one of palette, palettefile and paletteimage params")
+	case palette != "":
+		return ParsePalette(palette)
+	case paletteFile != "":
+		return ParsePalette(paletteFile)
+	default:
+		im, err := DecodeImage(strings.NewReader(paletteImage))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding palette image:\n%q", err)
+		}
+		return ApplyKMeans(im, params.Int("ncolors"), kmeansOptionsFromParams(params)).Palette, nil
+	}
+}
+
+func init() {
+	Register(&filter{
+		name:  "quantize",
+		title: "Quantize",
+		description: `Replace colors with the nearest colors of given palette, optionally dithering.
+Palette is preset name, list of colors, GIMP palette or colors clustered from another image.`,
+		params: append([]Param{
+			{
+				Name:    "palette",
+				Alias:   "p",
+				Type:    ParamString,
+				Usage:   "colors like \"#000000 #ff8000\" or preset: bw, gameboy, websafe",
+				Default: "",
+			},
+			{
+				Name:    "palettefile",
+				Alias:   "P",
+				Type:    ParamText,
+				Usage:   "GIMP .gpl palette or list of colors file",
+				Default: "",
+			},
+			{
+				Name:    "paletteimage",
+				Alias:   "I",
+				Type:    ParamFile,
+				Usage:   "image file whose colors are clustered into palette",
+				Default: "",
+			},
+			{
+				Name:    "ncolors",
+				Alias:   "n",
+				Type:    ParamInt,
+				Usage:   "number of colors clustered from paletteimage, from 2 to 256",
+				Default: 8,
+			},
+			{
+				Name:    "dither",
+				Alias:   "d",
+				Type:    ParamString,
+				Usage:   "dithering algorithm",
+				Default: DitherFloydSteinberg,
+				Choices: Ditherings,
+			},
+		}, kmeansParams()...),
+		validate: func(params Params) error {
+			if ncolors := params.Int("ncolors"); ncolors < 2 || ncolors > 256 {
+				return fmt.Errorf("ncolors must be in 2..256, you gave %d", ncolors)
+			}
+			// palette image is loaded only when filter is applied
+			if params.String("paletteimage") == "" {
+				if _, err := paletteParam(params); err != nil {
+					return err
+				}
+			} else if params.String("palette") != "" || params.String("palettefile") != "" {
+				return fmt.Errorf("palette must be given by exactly one of palette, palettefile and paletteimage params")
+			}
+			return validateKMeansOptions(params)
+		},
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			palette, err := paletteParam(params)
+			if err != nil {
+				return nil, err
+			}
+			opts := kmeansOptionsFromParams(params)
+			res := Quantize(im, palette, params.String("dither"), opts)
+			if params.String("paletteimage") != "" {
+				return WithMetadata(res, opts.Metadata()), nil
+			}
+			return res, nil
+		},
+	})
+}
@@ -0,0 +1,94 @@
+package fimgs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParsePalette(t *testing.T) {
+	gpl := "GIMP Palette\nName: test\nColumns: 2\n# comment\n255 128   0\torange\n  0   0   0 black\n"
+	for _, test := range []struct {
+		source string
+		want   color.Palette
+	}{
+		{gpl, color.Palette{color.RGBA{255, 128, 0, 255}, color.RGBA{0, 0, 0, 255}}},
+		{"#ff8000, 000000\n#FFFFFF", color.Palette{color.RGBA{255, 128, 0, 255}, color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}},
+		{"bw", color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}},
+	} {
+		got, err := ParsePalette(test.source)
+		if err != nil {
+			t.Fatalf("%q: %v", test.source, err)
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("%q: got %v, want %v", test.source, got, test.want)
+		}
+		for k := range got {
+			if got[k] != test.want[k] {
+				t.Fatalf("%q: got %v, want %v", test.source, got, test.want)
+			}
+		}
+	}
+	for _, source := range []string{"", "#12345", "GIMP Palette\n1 2\n"} {
+		if _, err := ParsePalette(source); err == nil {
+			t.Fatalf("%q: error expected", source)
+		}
+	}
+	if len(PalettePresets["websafe"]) != 216 {
+		t.Fatalf("websafe palette has %d colors", len(PalettePresets["websafe"]))
+	}
+}
+
+func TestQuantizeDithering(t *testing.T) {
+	gray := image.NewUniform(color.Gray{128})
+	im := image.NewRGBA(image.Rect(3, -2, 67, 62))
+	for y := im.Rect.Min.Y; y < im.Rect.Max.Y; y++ {
+		for x := im.Rect.Min.X; x < im.Rect.Max.X; x++ {
+			im.Set(x, y, gray.C)
+		}
+	}
+	for _, dithering := range Ditherings {
+		res := Quantize(im, PalettePresets["bw"], dithering, KMeansOptions{})
+		if res.Rect != im.Rect {
+			t.Fatalf("%s: bounds changed to %v", dithering, res.Rect)
+		}
+		white := 0
+		for _, index := range res.Pix {
+			white += int(index)
+		}
+		share := float64(white) / float64(len(res.Pix))
+		switch {
+		case dithering == DitherNone && share != 1:
+			t.Fatalf("without dithering all pixels must be white, %.3f are", share)
+		case dithering != DitherNone && (share < 0.4 || share > 0.6):
+			t.Fatalf("%s: half of pixels must be white, %.3f are", dithering, share)
+		}
+	}
+}
+
+func TestQuantizePaletteImage(t *testing.T) {
+	paletteImage := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for k := range paletteImage.Pix {
+		paletteImage.Pix[k] = 255
+	}
+	var encoded bytes.Buffer
+	if err := EncodeImage(&encoded, paletteImage, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	quantize, _ := LookupFilter("quantize")
+	params, err := ParseParams(quantize, func(name string) (string, bool) {
+		value, ok := map[string]string{"paletteimage": encoded.String(), "ncolors": "2"}[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := quantize.Apply(shaderTestImage(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.RGBAModel.Convert(res.At(5, 6)); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Fatalf("got %v, want white", got)
+	}
+}
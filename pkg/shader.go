@@ -1,196 +1,202 @@
 package fimgs
 
 import (
+	"errors"
 	"fmt"
 	"image"
-	"image/draw"
-	"os"
-	"reflect"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
-	"unsafe"
-
-	"github.com/go-gl/gl/v4.1-core/gl"
-	"github.com/go-gl/glfw/v3.3/glfw"
 )
 
-func compileShader(source string, shaderType uint32) (uint32, error) {
-	shader := gl.CreateShader(shaderType)
-
-	csources, free := gl.Strs(source)
-	gl.ShaderSource(shader, 1, csources, nil)
-	free()
-	gl.CompileShader(shader)
-
-	var status int32
-	gl.GetShaderiv(shader, gl.COMPILE_STATUS, &status)
-	if status == gl.FALSE {
-		var logLength int32
-		gl.GetShaderiv(shader, gl.INFO_LOG_LENGTH, &logLength)
+// ShaderBackend is the way shaders are rendered
+type ShaderBackend = string
 
-		log := strings.Repeat("\x00", int(logLength+1))
-		gl.GetShaderInfoLog(shader, logLength, nil, gl.Str(log))
+const (
+	// ShaderAuto renders on GPU if OpenGL context can be created and on CPU otherwise
+	ShaderAuto ShaderBackend = "auto"
+	// ShaderGPU renders with OpenGL, needs fimgs built with gl tag, display and libgl1-mesa-dev, xorg-dev packages
+	ShaderGPU ShaderBackend = "gpu"
+	// ShaderCPU runs shader on CPU, needs nothing, but supports only subset of GLSL, see compileGLSL
+	ShaderCPU ShaderBackend = "cpu"
+)
 
-		return 0, fmt.Errorf("failed to compile shader source:\n%v\nerror:\n%v", source, log)
+var ShaderBackends = []string{ShaderAuto, ShaderGPU, ShaderCPU}
+
+// errNoGPU is returned by GPU backend if OpenGL context can't be created
+var errNoGPU = errors.New("OpenGL is not available")
+
+// ShaderUniforms are values of uniforms by name. Vectors and matrices (by columns) are given
+// by components, bools are 0 or 1.
+type ShaderUniforms map[string][]float64
+
+// ParseShaderUniforms parses uniforms given as "name=value" separated by ";" or newlines,
+// value is comma separated numbers, true or false, e.g. "strength=0.5;tint=1,0.5,0"
+func ParseShaderUniforms(s string) (ShaderUniforms, error) {
+	uniforms := ShaderUniforms{}
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("uniform must be given as name=value, got %q", strings.TrimSpace(item))
+		}
+		if _, ok := uniforms[name]; ok {
+			return nil, fmt.Errorf("uniform %q is given twice", name)
+		}
+		var values []float64
+		for _, x := range strings.Split(value, ",") {
+			switch x = strings.TrimSpace(x); x {
+			case "true":
+				values = append(values, 1)
+			case "false":
+				values = append(values, 0)
+			default:
+				v, err := strconv.ParseFloat(x, 64)
+				if err != nil {
+					return nil, fmt.Errorf("uniform %q: %q is not a number", name, x)
+				}
+				values = append(values, v)
+			}
+		}
+		uniforms[name] = values
 	}
-	return shader, nil
+	return uniforms, nil
 }
 
-func newTexture(file string) (int, int, error) {
-	imgFile, err := os.Open(file)
-	if err != nil {
-		return 0, 0, fmt.Errorf("texture %q not found on disk: %v", file, err)
-	}
-	img, _, err := image.Decode(imgFile)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	rgba := image.NewRGBA(img.Bounds())
-	if rgba.Stride != rgba.Rect.Size().X*4 {
-		return 0, 0, fmt.Errorf("unsupported stride")
+// standardUniforms are set for shaders using them like on Shadertoy: iResolution is image size in pixels,
+// iTime, iFrame and iMouse are zero unless they are given by user
+func standardUniforms(bounds image.Rectangle) ShaderUniforms {
+	return ShaderUniforms{
+		"iResolution": {float64(bounds.Dx()), float64(bounds.Dy()), 1},
+		"iTime":       {0},
+		"iFrame":      {0},
+		"iMouse":      {0, 0, 0, 0},
 	}
-	draw.Draw(rgba, rgba.Bounds(), img, image.Point{0, 0}, draw.Src)
-
-	var texture uint32
-	gl.GenTextures(1, &texture)
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, texture)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-	gl.TexImage2D(
-		gl.TEXTURE_2D,
-		0,
-		gl.RGBA,
-		int32(rgba.Rect.Size().X),
-		int32(rgba.Rect.Size().Y),
-		0,
-		gl.RGBA,
-		gl.UNSIGNED_BYTE,
-		gl.Ptr(rgba.Pix),
-	)
-	return rgba.Rect.Size().X, rgba.Rect.Size().Y, nil
 }
 
-// requires libgl1-mesa-dev, xorg-dev packages
-func ShaderFilter(sourceImageFilename, resultImageFilename, fragmentShaderSource string) error {
-	if err := glfw.Init(); err != nil {
-		return fmt.Errorf("couldn't initialize glfw: %q", err)
+// bindUniforms checks user uniforms against types of active uniforms of linked shader and returns
+// values to set, including standard uniforms used by shader
+func bindUniforms(active map[string]glslType, bounds image.Rectangle, uniforms ShaderUniforms) (map[string]glslValue, error) {
+	all := standardUniforms(bounds)
+	for name, value := range uniforms {
+		all[name] = value
 	}
-	defer glfw.Terminate()
-
-	// FIX: panics sometimes in webserver mode
-	window, err := glfw.CreateWindow(1, 1, "Thou shalt not exist", nil, nil) // Size (1, 1) for show nothing in window
-	if err != nil {
-		return fmt.Errorf("couldn't create window: %q", err)
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
 	}
-
-	// Set context to window
-	window.MakeContextCurrent()
-
-	if err := gl.Init(); err != nil {
-		return fmt.Errorf("couldn't initialize glow: %q", err)
+	sort.Strings(names)
+	values := make(map[string]glslValue, len(all))
+	for _, name := range names {
+		typ, ok := active[name]
+		if !ok {
+			if _, ok := uniforms[name]; ok {
+				return nil, ParamError{fmt.Errorf("shader has no active uniform %q", name)}
+			}
+			continue
+		}
+		value, err := glslUniformValue(typ, all[name])
+		if err != nil {
+			return nil, ParamError{fmt.Errorf("uniform %q: %w", name, err)}
+		}
+		values[name] = value
 	}
+	return values, nil
+}
 
-	// Initial data
-	quad := []float32{
-		// [x, y, z=0] positions [u=(x+1)/2, v=(y+1)/2] texture coordinates
-		-1., -1., 0., 0., 0.,
-		1., -1., 0., 1., 0.,
-		1., 1., 0., 1., 1.,
-		-1., 1., 0., 0., 1.,
+// glslUniformValue converts uniform value given by user to value of type typ
+func glslUniformValue(typ glslType, value []float64) (glslValue, error) {
+	switch typ.kind {
+	case glslSampler:
+		return glslValue{}, fmt.Errorf("sampler2D is bound to image and can't be set")
+	case glslVoid:
+		return glslValue{}, fmt.Errorf("type of uniform is not supported")
 	}
-	// Vertices indices order
-	indices := []uint32{
-		0, 1, 2,
-		2, 3, 0,
-	}
-
-	// Vertex shader
-	vertex_shader := `#version 330
-layout(location = 0) in vec3 position;
-layout(location = 1) in vec2 inTexCoords;
-out vec2 outTexCoords;
-
-void main() {
-    gl_Position = vec4(position, 1.0);
-    outTexCoords = inTexCoords;
-}`
-
-	// Compile shaders
-	vertexShader, err := compileShader(vertex_shader, gl.VERTEX_SHADER)
-	if err != nil {
-		return fmt.Errorf("error compiling vertex shader:\n%q", err)
+	if len(value) != typ.components() {
+		return glslValue{}, fmt.Errorf("%s needs %d values, got %d", typ, typ.components(), len(value))
 	}
-	fragmentShader, err := compileShader(fragmentShaderSource, gl.FRAGMENT_SHADER)
-	if err != nil {
-		return fmt.Errorf("error compiling fragment shader:\n%s", err)
+	var res glslValue
+	for i, x := range value {
+		switch {
+		case typ.kind == glslInt && x != math.Trunc(x):
+			return glslValue{}, fmt.Errorf("%s needs integer values, got %v", typ, x)
+		case typ.kind == glslBool && x != 0 && x != 1:
+			return glslValue{}, fmt.Errorf("%s needs true or false values, got %v", typ, x)
+		}
+		res[i] = float32(x)
 	}
-	program := gl.CreateProgram()
-	gl.AttachShader(program, vertexShader)
-	gl.AttachShader(program, fragmentShader)
-	gl.LinkProgram(program)
-
-	var vertex_buffer_object uint32
-	gl.GenBuffers(1, &vertex_buffer_object)
-	gl.BindBuffer(gl.ARRAY_BUFFER, vertex_buffer_object)
-	gl.BufferData(gl.ARRAY_BUFFER, len(quad)*4, gl.Ptr(quad), gl.STATIC_DRAW)
-
-	var entity_buffer_object uint32
-	gl.GenBuffers(1, &entity_buffer_object)
-	gl.BindBuffer(gl.ELEMENT_ARRAY_BUFFER, entity_buffer_object)
-	gl.BufferData(gl.ELEMENT_ARRAY_BUFFER, len(indices)*4, gl.Ptr(indices), gl.STATIC_DRAW)
-
-	// Configure positions of initial data
-	gl.VertexAttribPointerWithOffset(0, 3, gl.FLOAT, false, 4*5, 0)
-	gl.EnableVertexAttribArray(0)
+	return res, nil
+}
 
-	// Configure texture coordinates of initial data
-	gl.VertexAttribPointerWithOffset(1, 2, gl.FLOAT, false, 4*5, 12)
-	gl.EnableVertexAttribArray(1)
+// Shader renders fragment shader over image on GPU if it is available and on CPU otherwise.
+// Shader gets image as "sampler2D" uniform and texture coordinates as "in vec2 outTexCoords".
+func Shader(im image.Image, fragmentShaderSource string) (*image.NRGBA, error) {
+	return RenderShader(im, fragmentShaderSource, ShaderAuto, nil)
+}
 
-	imageWidth, imageHeight, err := newTexture(sourceImageFilename)
-	if err != nil {
-		return fmt.Errorf("error loading texture: %q", err)
+// RenderShader renders fragment shader over image with given backend, result has bounds of image
+// and colors written by shader as they are, i.e. not premultiplied by alpha.
+// Uniforms must be active in shader, standard iResolution, iTime, iFrame and iMouse are set if shader uses them.
+func RenderShader(im image.Image, fragmentShaderSource string, backend ShaderBackend, uniforms ShaderUniforms) (*image.NRGBA, error) {
+	var res *image.NRGBA
+	var err error
+	switch backend {
+	case ShaderGPU:
+		res, err = gpuShader(im, fragmentShaderSource, uniforms)
+	case ShaderCPU:
+		res, err = cpuShader(im, fragmentShaderSource, uniforms)
+	default:
+		res, err = gpuShader(im, fragmentShaderSource, uniforms)
+		if errors.Is(err, errNoGPU) {
+			res, err = cpuShader(im, fragmentShaderSource, uniforms)
+		}
 	}
-
-	// Create render buffer with size (image.width x image.height)
-	var rb_obj uint32
-	gl.GenRenderbuffers(1, &rb_obj)
-	gl.BindRenderbuffer(gl.RENDERBUFFER, rb_obj)
-	gl.RenderbufferStorage(gl.RENDERBUFFER, gl.RGBA, int32(imageWidth), int32(imageHeight))
-
-	// Create frame buffer
-	var fb_obj uint32
-	gl.GenFramebuffers(1, &fb_obj)
-	gl.BindFramebuffer(gl.FRAMEBUFFER, fb_obj)
-	gl.FramebufferRenderbuffer(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.RENDERBUFFER, rb_obj)
-
-	// FIX: sometimes fail with 0
-	if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
-		return fmt.Errorf("incomplete framebuffer object, status is %d, gl error is %q", status, gl.GetError())
+	if err != nil {
+		return nil, err
 	}
+	res.Rect = im.Bounds()
+	return res, nil
+}
 
-	// Install program
-	gl.UseProgram(program)
-
-	// Bind framebuffer and set viewport size
-	gl.BindFramebuffer(gl.FRAMEBUFFER, fb_obj)
-	gl.Viewport(0, 0, int32(imageWidth), int32(imageHeight))
-
-	gl.DrawElements(gl.TRIANGLES, 6, gl.UNSIGNED_INT, nil)
-
-	var data []uint8 = make([]uint8, 4*imageHeight*imageWidth)
-	gl.ReadPixels(0, 0, int32(imageWidth), int32(imageHeight), gl.RGBA, gl.UNSIGNED_BYTE, unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&data)).Data))
-
-	image_out := image.RGBA{
-		Pix:    data,
-		Stride: imageWidth * 4,
-		Rect:   image.Rect(0, 0, imageWidth, imageHeight),
-	}
-	if err = saveImage(image_out, resultImageFilename); err != nil {
-		return fmt.Errorf("error saving file: %q", err)
-	}
-	return nil
+func init() {
+	Register(&filter{
+		name:        "shader",
+		title:       "Shader",
+		description: "Apply GLSL filter to image. It is rendered on GPU if fimgs is built with gl tag and display is available, otherwise on CPU, which supports GLSL subset: scalars, vectors, square matrices, functions, control flow and common built-in functions.",
+		params: []Param{{
+			Name:  "shader",
+			Alias: "s",
+			Type:  ParamText,
+			Usage: "shader file, must be valid fragment shader source, see shader_examples directory for examples",
+		}, {
+			Name:    "backend",
+			Alias:   "b",
+			Type:    ParamString,
+			Usage:   "where shader is rendered, auto uses gpu if it is available",
+			Default: ShaderAuto,
+			Choices: ShaderBackends,
+		}, {
+			Name:     "uniforms",
+			Alias:    "u",
+			Type:     ParamString,
+			Usage:    `uniform values as "name=x,y,...", e.g. "tint=1,0.5,0", iResolution, iTime, iFrame and iMouse are set by default`,
+			Default:  "",
+			Repeated: true,
+		}},
+		validate: func(params Params) error {
+			_, err := ParseShaderUniforms(params.String("uniforms"))
+			return err
+		},
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			uniforms, err := ParseShaderUniforms(params.String("uniforms"))
+			if err != nil {
+				return nil, err
+			}
+			return RenderShader(im, params.String("shader"), params.String("backend"), uniforms)
+		},
+	})
 }
@@ -0,0 +1,130 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+)
+
+// texel returns color of texture pixel, coordinates out of texture are clamped like GL_CLAMP_TO_EDGE
+func (s *glslState) texel(i, j int) glslValue {
+	rect := s.texture.Rect
+	i = min(max(i, 0), rect.Dx()-1)
+	j = min(max(j, 0), rect.Dy()-1)
+	p := s.texture.Pix[j*s.texture.Stride+i*4:]
+	return glslValue{float32(p[0]) / 255, float32(p[1]) / 255, float32(p[2]) / 255, float32(p[3]) / 255}
+}
+
+// sample returns bilinear filtered color of texture at texture coordinates like GL_LINEAR,
+// centers of texels are at (i+0.5)/width, (j+0.5)/height, row 0 is top row of image
+func (s *glslState) sample(u, v float32) glslValue {
+	w, h := float64(s.texture.Rect.Dx()), float64(s.texture.Rect.Dy())
+	x := math.Max(-1, math.Min(float64(u)*w-0.5, w))
+	y := math.Max(-1, math.Min(float64(v)*h-0.5, h))
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return s.texel(0, 0)
+	}
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := float32(x-x0), float32(y-y0)
+	i, j := int(x0), int(y0)
+	c00, c10 := s.texel(i, j), s.texel(i+1, j)
+	c01, c11 := s.texel(i, j+1), s.texel(i+1, j+1)
+	var r glslValue
+	for k := 0; k < 4; k++ {
+		top := c00[k]*(1-fx) + c10[k]*fx
+		bottom := c01[k]*(1-fx) + c11[k]*fx
+		r[k] = top*(1-fy) + bottom*fy
+	}
+	return r
+}
+
+// run runs shader for pixel with center at (x, y), ok is false if pixel is discarded
+func (s *glslState) run(prog *glslProgram, x, y float32) (_ glslValue, ok bool) {
+	clear(s.globals)
+	for slot, value := range s.uniforms {
+		s.globals[slot] = value
+	}
+	s.globals[prog.fragCoord] = glslValue{x, y, 0.5, 1}
+	if prog.texCoord != -1 {
+		s.globals[prog.texCoord] = glslValue{x / float32(s.texture.Rect.Dx()), y / float32(s.texture.Rect.Dy())}
+	}
+	s.discarded = false
+	s.base, s.top = 0, 0
+	for _, init := range prog.init {
+		init(s)
+	}
+	s.call(prog.main, nil, nil)
+	return s.globals[prog.output], !s.discarded
+}
+
+// glslUnorm8 converts color component to byte like GL does when writing to RGBA8 framebuffer
+func glslUnorm8(x float32) uint8 {
+	switch {
+	case !(x > 0): // NaN too
+		return 0
+	case x >= 1:
+		return 255
+	}
+	return uint8(math.RoundToEven(float64(x) * 255))
+}
+
+// cpuShader renders fragment shader on CPU, shader must be in GLSL subset supported by compileGLSL
+func cpuShader(im image.Image, fragmentShaderSource string, uniforms ShaderUniforms) (*image.NRGBA, error) {
+	prog, err := compileGLSL(fragmentShaderSource)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling fragment shader:\n%s", err)
+	}
+	bounds := image.Rect(0, 0, im.Bounds().Dx(), im.Bounds().Dy())
+	active := make(map[string]glslType, len(prog.uniforms))
+	for name, u := range prog.uniforms {
+		active[name] = u.typ
+	}
+	values, err := bindUniforms(active, bounds, uniforms)
+	if err != nil {
+		return nil, err
+	}
+	slots := make(map[int]glslValue, len(values))
+	for name, value := range values {
+		slots[prog.uniforms[name].slot] = value
+	}
+	texture := image.NewRGBA(bounds)
+	draw.Draw(texture, bounds, im, im.Bounds().Min, draw.Src)
+	res := image.NewNRGBA(bounds)
+	if bounds.Empty() {
+		return res, nil
+	}
+
+	errs := make([]error, runtime.NumCPU())
+	parallelRows(bounds, func(worker, j0, j1 int) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg, ok := r.(glslRuntimeError)
+				if !ok {
+					panic(r)
+				}
+				errs[worker] = fmt.Errorf("error running fragment shader: %s", msg)
+			}
+		}()
+		s := &glslState{globals: make([]glslValue, prog.globals), texture: texture, uniforms: slots}
+		for j := j0; j < j1; j++ {
+			for i := 0; i < bounds.Dx(); i++ {
+				c, ok := s.run(prog, float32(i)+0.5, float32(j)+0.5)
+				if !ok {
+					continue
+				}
+				p := res.Pix[j*res.Stride+i*4:]
+				for k := 0; k < 4; k++ {
+					p[k] = glslUnorm8(c[k])
+				}
+			}
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,291 @@
+//go:build gl
+
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/go-gl/gl/v4.1-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func compileShader(source string, shaderType uint32) (uint32, error) {
+	shader := gl.CreateShader(shaderType)
+
+	csources, free := gl.Strs(source)
+	gl.ShaderSource(shader, 1, csources, nil)
+	free()
+	gl.CompileShader(shader)
+
+	var status int32
+	gl.GetShaderiv(shader, gl.COMPILE_STATUS, &status)
+	if status == gl.FALSE {
+		var logLength int32
+		gl.GetShaderiv(shader, gl.INFO_LOG_LENGTH, &logLength)
+
+		log := strings.Repeat("\x00", int(logLength+1))
+		gl.GetShaderInfoLog(shader, logLength, nil, gl.Str(log))
+
+		return 0, fmt.Errorf("failed to compile shader:\n%s", strings.TrimRight(log, "\x00\n"))
+	}
+	return shader, nil
+}
+
+func newTexture(img image.Image) (int, int, error) {
+	rgba := image.NewRGBA(img.Bounds())
+	if rgba.Stride != rgba.Rect.Size().X*4 {
+		return 0, 0, fmt.Errorf("unsupported stride")
+	}
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	var texture uint32
+	gl.GenTextures(1, &texture)
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, texture)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexImage2D(
+		gl.TEXTURE_2D,
+		0,
+		gl.RGBA,
+		int32(rgba.Rect.Size().X),
+		int32(rgba.Rect.Size().Y),
+		0,
+		gl.RGBA,
+		gl.UNSIGNED_BYTE,
+		gl.Ptr(rgba.Pix),
+	)
+	return rgba.Rect.Size().X, rgba.Rect.Size().Y, nil
+}
+
+// glUniformTypes are GL types of uniforms supported by shader filter
+var glUniformTypes = map[uint32]glslType{
+	gl.BOOL:       {glslBool, 1},
+	gl.BOOL_VEC2:  {glslBool, 2},
+	gl.BOOL_VEC3:  {glslBool, 3},
+	gl.BOOL_VEC4:  {glslBool, 4},
+	gl.INT:        {glslInt, 1},
+	gl.INT_VEC2:   {glslInt, 2},
+	gl.INT_VEC3:   {glslInt, 3},
+	gl.INT_VEC4:   {glslInt, 4},
+	gl.FLOAT:      {glslFloat, 1},
+	gl.FLOAT_VEC2: {glslFloat, 2},
+	gl.FLOAT_VEC3: {glslFloat, 3},
+	gl.FLOAT_VEC4: {glslFloat, 4},
+	gl.FLOAT_MAT2: {glslMat, 2},
+	gl.FLOAT_MAT3: {glslMat, 3},
+	gl.FLOAT_MAT4: {glslMat, 4},
+	gl.SAMPLER_2D: {glslSampler, 1},
+}
+
+// activeUniforms returns types and locations of active uniforms of linked program,
+// arrays and other unsupported types have void type
+func activeUniforms(program uint32) (map[string]glslType, map[string]int32) {
+	var count, maxLength int32
+	gl.GetProgramiv(program, gl.ACTIVE_UNIFORMS, &count)
+	gl.GetProgramiv(program, gl.ACTIVE_UNIFORM_MAX_LENGTH, &maxLength)
+	types := make(map[string]glslType, count)
+	locations := make(map[string]int32, count)
+	name := make([]uint8, maxLength+1)
+	for i := uint32(0); i < uint32(count); i++ {
+		var length, size int32
+		var xtype uint32
+		gl.GetActiveUniform(program, i, int32(len(name)), &length, &size, &xtype, &name[0])
+		typ, ok := glUniformTypes[xtype]
+		if !ok || size != 1 {
+			typ = glslType{glslVoid, 0}
+		}
+		key := strings.TrimSuffix(string(name[:length]), "[0]")
+		types[key] = typ
+		locations[key] = gl.GetUniformLocation(program, &name[0])
+	}
+	return types, locations
+}
+
+// setUniform sets value of uniform of type typ at location of program in use
+func setUniform(location int32, typ glslType, value glslValue) {
+	var ints [4]int32
+	for i := range ints {
+		ints[i] = int32(value[i])
+	}
+	switch {
+	case typ.kind == glslMat && typ.size == 2:
+		gl.UniformMatrix2fv(location, 1, false, &value[0])
+	case typ.kind == glslMat && typ.size == 3:
+		gl.UniformMatrix3fv(location, 1, false, &value[0])
+	case typ.kind == glslMat:
+		gl.UniformMatrix4fv(location, 1, false, &value[0])
+	case typ.kind == glslFloat && typ.size == 1:
+		gl.Uniform1fv(location, 1, &value[0])
+	case typ.kind == glslFloat && typ.size == 2:
+		gl.Uniform2fv(location, 1, &value[0])
+	case typ.kind == glslFloat && typ.size == 3:
+		gl.Uniform3fv(location, 1, &value[0])
+	case typ.kind == glslFloat:
+		gl.Uniform4fv(location, 1, &value[0])
+	case typ.size == 1:
+		gl.Uniform1iv(location, 1, &ints[0])
+	case typ.size == 2:
+		gl.Uniform2iv(location, 1, &ints[0])
+	case typ.size == 3:
+		gl.Uniform3iv(location, 1, &ints[0])
+	default:
+		gl.Uniform4iv(location, 1, &ints[0])
+	}
+}
+
+// shaderMu serializes shader rendering, glfw and GL context are global state
+var shaderMu sync.Mutex
+
+// gpuShader renders shader with OpenGL, requires libgl1-mesa-dev, xorg-dev packages and display
+func gpuShader(im image.Image, fragmentShaderSource string, uniforms ShaderUniforms) (*image.NRGBA, error) {
+	shaderMu.Lock()
+	defer shaderMu.Unlock()
+	// GL context is bound to OS thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := glfw.Init(); err != nil {
+		return nil, fmt.Errorf("%w: couldn't initialize glfw: %q", errNoGPU, err)
+	}
+	defer glfw.Terminate()
+
+	window, err := glfw.CreateWindow(1, 1, "Thou shalt not exist", nil, nil) // Size (1, 1) for show nothing in window
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't create window: %q", errNoGPU, err)
+	}
+
+	// Set context to window
+	window.MakeContextCurrent()
+
+	if err := gl.Init(); err != nil {
+		return nil, fmt.Errorf("%w: couldn't initialize glow: %q", errNoGPU, err)
+	}
+
+	// Initial data
+	quad := []float32{
+		// [x, y, z=0] positions [u=(x+1)/2, v=(y+1)/2] texture coordinates
+		-1., -1., 0., 0., 0.,
+		1., -1., 0., 1., 0.,
+		1., 1., 0., 1., 1.,
+		-1., 1., 0., 0., 1.,
+	}
+	// Vertices indices order
+	indices := []uint32{
+		0, 1, 2,
+		2, 3, 0,
+	}
+
+	// Vertex shader
+	vertex_shader := `#version 330
+layout(location = 0) in vec3 position;
+layout(location = 1) in vec2 inTexCoords;
+out vec2 outTexCoords;
+
+void main() {
+    gl_Position = vec4(position, 1.0);
+    outTexCoords = inTexCoords;
+}`
+
+	// Compile shaders
+	vertexShader, err := compileShader(vertex_shader, gl.VERTEX_SHADER)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling vertex shader:\n%s", err)
+	}
+	fragmentShader, err := compileShader(fragmentShaderSource, gl.FRAGMENT_SHADER)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling fragment shader:\n%s", err)
+	}
+	program := gl.CreateProgram()
+	gl.AttachShader(program, vertexShader)
+	gl.AttachShader(program, fragmentShader)
+	gl.LinkProgram(program)
+
+	var status int32
+	gl.GetProgramiv(program, gl.LINK_STATUS, &status)
+	if status == gl.FALSE {
+		var logLength int32
+		gl.GetProgramiv(program, gl.INFO_LOG_LENGTH, &logLength)
+
+		log := strings.Repeat("\x00", int(logLength+1))
+		gl.GetProgramInfoLog(program, logLength, nil, gl.Str(log))
+
+		return nil, fmt.Errorf("failed to link shader program:\n%s", strings.TrimRight(log, "\x00\n"))
+	}
+
+	types, locations := activeUniforms(program)
+	values, err := bindUniforms(types, im.Bounds(), uniforms)
+	if err != nil {
+		return nil, err
+	}
+
+	var vertex_buffer_object uint32
+	gl.GenBuffers(1, &vertex_buffer_object)
+	gl.BindBuffer(gl.ARRAY_BUFFER, vertex_buffer_object)
+	gl.BufferData(gl.ARRAY_BUFFER, len(quad)*4, gl.Ptr(quad), gl.STATIC_DRAW)
+
+	var entity_buffer_object uint32
+	gl.GenBuffers(1, &entity_buffer_object)
+	gl.BindBuffer(gl.ELEMENT_ARRAY_BUFFER, entity_buffer_object)
+	gl.BufferData(gl.ELEMENT_ARRAY_BUFFER, len(indices)*4, gl.Ptr(indices), gl.STATIC_DRAW)
+
+	// Configure positions of initial data
+	gl.VertexAttribPointerWithOffset(0, 3, gl.FLOAT, false, 4*5, 0)
+	gl.EnableVertexAttribArray(0)
+
+	// Configure texture coordinates of initial data
+	gl.VertexAttribPointerWithOffset(1, 2, gl.FLOAT, false, 4*5, 12)
+	gl.EnableVertexAttribArray(1)
+
+	imageWidth, imageHeight, err := newTexture(im)
+	if err != nil {
+		return nil, fmt.Errorf("error loading texture: %q", err)
+	}
+
+	// Create render buffer with size (image.width x image.height)
+	var rb_obj uint32
+	gl.GenRenderbuffers(1, &rb_obj)
+	gl.BindRenderbuffer(gl.RENDERBUFFER, rb_obj)
+	gl.RenderbufferStorage(gl.RENDERBUFFER, gl.RGBA, int32(imageWidth), int32(imageHeight))
+
+	// Create frame buffer
+	var fb_obj uint32
+	gl.GenFramebuffers(1, &fb_obj)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, fb_obj)
+	gl.FramebufferRenderbuffer(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, gl.RENDERBUFFER, rb_obj)
+
+	// FIX: sometimes fail with 0
+	if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
+		return nil, fmt.Errorf("incomplete framebuffer object, status is %d, gl error is %q", status, gl.GetError())
+	}
+
+	// Install program and set its uniforms
+	gl.UseProgram(program)
+	for name, value := range values {
+		setUniform(locations[name], types[name], value)
+	}
+
+	// Bind framebuffer and set viewport size
+	gl.BindFramebuffer(gl.FRAMEBUFFER, fb_obj)
+	gl.Viewport(0, 0, int32(imageWidth), int32(imageHeight))
+
+	gl.DrawElements(gl.TRIANGLES, 6, gl.UNSIGNED_INT, nil)
+
+	var data []uint8 = make([]uint8, 4*imageHeight*imageWidth)
+	gl.ReadPixels(0, 0, int32(imageWidth), int32(imageHeight), gl.RGBA, gl.UNSIGNED_BYTE, unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&data)).Data))
+
+	return &image.NRGBA{
+		Pix:    data,
+		Stride: imageWidth * 4,
+		Rect:   image.Rect(0, 0, imageWidth, imageHeight),
+	}, nil
+}
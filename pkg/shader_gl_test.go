@@ -0,0 +1,38 @@
+//go:build gl
+
+package fimgs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShaderBackendsMatch(t *testing.T) {
+	examples, err := filepath.Glob(filepath.Join("..", "shader_examples", "*.glsl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := shaderTestImage()
+	for _, example := range examples {
+		source, err := os.ReadFile(example)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gpu, err := RenderShader(im, string(source), ShaderGPU, nil)
+		if errors.Is(err, errNoGPU) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", example, err)
+		}
+		cpu, err := RenderShader(im, string(source), ShaderCPU, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", example, err)
+		}
+		if string(gpu.Pix) != string(cpu.Pix) {
+			t.Errorf("%s: gpu and cpu results differ", example)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !gl
+
+package fimgs
+
+import (
+	"fmt"
+	"image"
+)
+
+// gpuShader is not available, OpenGL backend is built only with gl tag
+func gpuShader(image.Image, string, ShaderUniforms) (*image.NRGBA, error) {
+	return nil, fmt.Errorf("%w: fimgs is built without gl tag", errNoGPU)
+}
@@ -0,0 +1,175 @@
+package fimgs
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// shaderTestImage is opaque 16x8 image with not zero origin, its first row has colors close to removed
+// by remove_color.glsl example
+func shaderTestImage() *image.RGBA {
+	im := randomImage(image.Rect(2, 3, 18, 11))
+	for i := 3; i < len(im.Pix); i += 4 {
+		im.Pix[i] = 255
+	}
+	for i := 0; i < 16; i++ {
+		copy(im.Pix[i*4:], []uint8{uint8(74 + i*4), 38, uint8(26 - i)})
+	}
+	return im
+}
+
+func TestShaderExamples(t *testing.T) {
+	f := func(b uint8) float32 { return float32(b) / 255 }
+	for name, want := range map[string]func(x, y int, c []uint8) [4]uint8{
+		"do_nothing.glsl": func(_, _ int, c []uint8) [4]uint8 {
+			return [4]uint8{c[0], c[1], c[2], c[3]}
+		},
+		"inversion.glsl": func(_, _ int, c []uint8) [4]uint8 {
+			return [4]uint8{255 - c[0], 255 - c[1], 255 - c[2], 255}
+		},
+		"coloring.glsl": func(_, _ int, c []uint8) [4]uint8 {
+			return [4]uint8{glslUnorm8(f(c[0]) * 0.3), glslUnorm8(f(c[1]) * 0.1), glslUnorm8(f(c[2]) * 0.2), 255}
+		},
+		"rgb_coloring.glsl": func(x, _ int, c []uint8) [4]uint8 {
+			res := [4]uint8{0, 0, 0, 255}
+			third := (x*3 + 1) / 16 // x from 0 to 15 in thirds of width, centers of pixels are at x+0.5
+			res[third] = c[third]
+			return res
+		},
+		"remove_color.glsl": func(_, _ int, c []uint8) [4]uint8 {
+			r, g, b := f(c[0]), f(c[1]), f(c[2])
+			d := max32(max32(abs32(r-float32(74)/255), abs32(g-float32(38)/255)), abs32(b-float32(26)/255))
+			if d >= float32(60)/255 {
+				return [4]uint8{c[0], c[1], c[2], c[3]}
+			}
+			gray := glslUnorm8((r + g + b) / 3)
+			return [4]uint8{gray, gray, gray, 255}
+		},
+	} {
+		source, err := os.ReadFile(filepath.Join("..", "shader_examples", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		im := shaderTestImage()
+		res, err := RenderShader(im, string(source), ShaderCPU, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if res.Rect != im.Rect {
+			t.Fatalf("%s: result bounds %v, want %v", name, res.Rect, im.Rect)
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 16; x++ {
+				i := y*im.Stride + x*4
+				if got, want := [4]uint8(res.Pix[i:i+4]), want(x, y, im.Pix[i:i+4]); got != want {
+					t.Fatalf("%s: pixel (%d, %d) of %v is %v, want %v", name, x, y, im.Pix[i:i+4], got, want)
+				}
+			}
+		}
+	}
+}
+
+func max32(x, y float32) float32 {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func abs32(x float32) float32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func TestShaderMirrorExample(t *testing.T) {
+	source, err := os.ReadFile(filepath.Join("..", "shader_examples", "mirror_horizontally.glsl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := shaderTestImage()
+	res, err := RenderShader(im, string(source), ShaderCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			from := x
+			if x < 8 {
+				from = 15 - x
+			}
+			if got, want := res.Pix[y*res.Stride+x*4:][:4], im.Pix[y*im.Stride+from*4:][:4]; string(got) != string(want) {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestShaderUniforms(t *testing.T) {
+	source := `
+uniform sampler2D source;
+uniform vec3 iResolution;
+uniform int iFrame;
+uniform float strength;
+uniform vec3 tint;
+uniform bool invert;
+uniform float unused;
+
+void main() {
+	vec3 c = tint * strength;
+	if (invert) {
+		c = 1. - c;
+	}
+	gl_FragColor = vec4(c, iResolution.x / 255. + float(iFrame));
+}`
+	uniforms, err := ParseShaderUniforms("strength=0.5; tint=1,0.5,0\ninvert=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := RenderShader(image.NewRGBA(image.Rect(0, 0, 51, 1)), source, ShaderCPU, uniforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint8{128, 191, 255, 51}
+	if got := res.Pix[:4]; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{
+		"strength=0.5,1",
+		"tint=1,2",
+		"iFrame=0.5",
+		"invert=2",
+		"source=0",
+		"unused=1",
+		"nosuchuniform=1",
+	} {
+		uniforms, err := ParseShaderUniforms(bad)
+		if err != nil {
+			t.Fatalf("%s: %v", bad, err)
+		}
+		if _, err := RenderShader(image.NewRGBA(image.Rect(0, 0, 1, 1)), source, ShaderCPU, uniforms); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	for _, bad := range []string{"strength", "=1", "strength=x", "strength=1;strength=2"} {
+		if _, err := ParseShaderUniforms(bad); err == nil {
+			t.Errorf("expected parse error for %q", bad)
+		}
+	}
+}
+
+func TestShaderTranslucent(t *testing.T) {
+	res, err := RenderShader(image.NewRGBA(image.Rect(0, 0, 1, 1)), "void main() { gl_FragColor = vec4(1., 0.6, 0., 0.4); }", ShaderCPU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.NRGBAAt(0, 0), (color.NRGBA{255, 153, 0, 102}); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package fimgs
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// UnsharpMask adds difference between image and its Gaussian blur of given sigma multiplied by amount.
+// Channels differing from blur by less than threshold (in 0..255 scale) are left as is, so flat areas
+// keep their noise level. Result is clamped, not stretched.
+func UnsharpMask(im image.Image, amount, sigma, threshold float64, border Border) image.NRGBA64 {
+	src := toRGBA64(im)
+	bounds, blurred := convolveResponses(GaussianKernel(sigma).newConvolver(src, border))
+	res := image.NewNRGBA64(bounds)
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		for i := bounds.Min.X; i < bounds.Max.X; i++ {
+			k := (j-bounds.Min.Y)*bounds.Dx() + (i - bounds.Min.X)
+			original := rgbFloat(src.RGBA64At(i, j))
+			p := [4]uint16{3: 0xFFFF}
+			for c := 0; c < 3; c++ {
+				x := original[c]
+				if diff := x - blurred[k][c]; math.Abs(diff) >= threshold*0x101 {
+					x += amount * diff
+				}
+				p[c] = clamp16(x)
+			}
+			setPixel16(res.Pix[k*8:], p)
+		}
+	}
+	return *res
+}
+
+func init() {
+	Register(&filter{
+		name:        "unsharp",
+		title:       "Unsharp mask",
+		description: "Sharpen image by adding its difference with blurred copy.",
+		params: append([]Param{
+			{
+				Name:    "amount",
+				Alias:   "a",
+				Type:    ParamFloat,
+				Usage:   "strength of sharpening, 1 doubles local contrast",
+				Default: 1.0,
+			},
+			{
+				Name:    "radius",
+				Alias:   "r",
+				Type:    ParamFloat,
+				Usage:   "standard deviation of blur in pixels, size of sharpened details, must be positive",
+				Default: 2.0,
+			},
+			{
+				Name:    "threshold",
+				Alias:   "t",
+				Type:    ParamFloat,
+				Usage:   "minimal difference with blurred image to sharpen, in 0..255 scale",
+				Default: 0.0,
+			},
+		}, borderParams()...),
+		validate: func(params Params) error {
+			if amount := params.Float("amount"); amount < 0 {
+				return fmt.Errorf("amount must not be negative, you gave %v", amount)
+			}
+			if radius := params.Float("radius"); radius <= 0 {
+				return fmt.Errorf("radius must be positive, you gave %v", radius)
+			}
+			if threshold := params.Float("threshold"); threshold < 0 || threshold > 255 {
+				return fmt.Errorf("threshold must be in 0..255, you gave %v", threshold)
+			}
+			return validateBorder(params)
+		},
+		apply: func(im image.Image, params Params) (image.Image, error) {
+			border, err := borderFromParams(params)
+			if err != nil {
+				return nil, err
+			}
+			res := UnsharpMask(im, params.Float("amount"), params.Float("radius"), params.Float("threshold"), border)
+			if res.Bounds().Empty() {
+				return nil, errEmptyResult
+			}
+			return &res, nil
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package fimgs
+
+import (
+	"image"
+	"testing"
+)
+
+func TestUnsharpMaskKeepsImage(t *testing.T) {
+	im := randomImage(image.Rect(-2, 4, 30, 25))
+	for _, test := range []struct {
+		name                     string
+		amount, sigma, threshold float64
+	}{
+		{"zero amount", 0, 2, 0},
+		{"max threshold", 3, 2, 255.5},
+	} {
+		res := UnsharpMask(im, test.amount, test.sigma, test.threshold, Border{})
+		for y := im.Rect.Min.Y; y < im.Rect.Max.Y; y++ {
+			for x := im.Rect.Min.X; x < im.Rect.Max.X; x++ {
+				got, want := res.NRGBA64At(x, y), im.RGBA64At(x, y)
+				if got.R != want.R || got.G != want.G || got.B != want.B {
+					t.Fatalf("%s: pixel (%d, %d) changed from %v to %v", test.name, x, y, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestUnsharpMaskStep(t *testing.T) {
+	im := stepImage(image.Rect(0, 0, 20, 3), 10)
+	for k := range im.Pix {
+		if k%4 != 3 {
+			im.Pix[k] = 64 + im.Pix[k]/2 // gray 64 to 191 step
+		}
+	}
+	res := UnsharpMask(im, 1, 1, 0, Border{})
+	dark, light := rgba8(&res, 9, 1).R, rgba8(&res, 10, 1).R
+	if dark >= 64 || light <= 191 {
+		t.Fatalf("contrast of step must increase, got %d and %d", dark, light)
+	}
+	if edge := rgba8(&res, 0, 1).R; edge != 64 {
+		t.Fatalf("flat area must be kept, got %d", edge)
+	}
+}
@@ -1,11 +1,11 @@
 #version 330
 
 uniform sampler2D source;
+uniform vec3 iResolution; // Width and height of image
 in vec2 outTexCoords;
 
 void main() {
-    ivec2 textureSize2d = textureSize(source, 0); // Width and height of texture image
-    vec2 uv = gl_FragCoord.xy / textureSize2d;
+    vec2 uv = gl_FragCoord.xy / iResolution.xy;
     vec3 color;
     if (uv.x < 1./3.) {
         color = vec3(1., 0., 0.);